@@ -0,0 +1,212 @@
+// cmd/migrate-stats/main.go
+
+// Command migrate-stats rewrites legacy nsfw_stats documents keyed by the email
+// local part (emailpart_YYYY-MM-DD) into the UID keyed scheme (uid_YYYY-MM-DD).
+//
+// Legacy documents are recognised by their userId field holding an email address.
+// The email is resolved to a Firebase UID, the counters are added onto the UID
+// document (which may already hold newer counts) and the legacy document is
+// deleted in the same transaction, so the command is safe to run more than once.
+// Counts that two users sharing an email local part already mixed into one legacy
+// document cannot be split; they go to the user whose email is stored on it.
+//
+// Usage:
+//
+//	go run ./cmd/migrate-stats -dry-run
+//	go run ./cmd/migrate-stats
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"firebase.google.com/go/v4/auth"
+	"github.com/joho/godotenv"
+	"google.golang.org/api/iterator"
+
+	"go-gin-project/internal/firebaseapp"
+	"go-gin-project/internal/models"
+	"go-gin-project/internal/services"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "Only report what would be migrated")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: .env file not found, using system environment variables")
+	}
+
+	ctx := context.Background()
+	authClient, db, err := firebaseapp.Setup(ctx)
+	if err != nil {
+		log.Fatalf("Error setting up Firebase: %v", err)
+	}
+	defer db.Close()
+
+	m := &migrator{
+		db:     db,
+		auth:   authClient,
+		dryRun: *dryRun,
+		uids:   make(map[string]string),
+	}
+	if err := m.run(ctx); err != nil {
+		log.Fatalf("Migration failed: %v", err)
+	}
+
+	log.Printf("Done: %d migrated, %d already migrated, %d skipped", m.migrated, m.current, m.skipped)
+}
+
+type migrator struct {
+	db     *firestore.Client
+	auth   *auth.Client
+	dryRun bool
+
+	// uids caches email -> UID lookups, an empty value marks an unknown email
+	uids map[string]string
+
+	migrated int
+	current  int
+	skipped  int
+}
+
+// run walks every statistic document and migrates the legacy ones
+func (m *migrator) run(ctx context.Context) error {
+	iter := m.db.Collection(services.StatisticCollection).Documents(ctx)
+	defer iter.Stop()
+
+	for {
+		snap, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("list %s: %w", services.StatisticCollection, err)
+		}
+
+		if err := m.migrateDoc(ctx, snap); err != nil {
+			return fmt.Errorf("document %s: %w", snap.Ref.ID, err)
+		}
+	}
+}
+
+// migrateDoc moves a single legacy document onto its UID keyed counterpart
+func (m *migrator) migrateDoc(ctx context.Context, snap *firestore.DocumentSnapshot) error {
+	var stat models.StatisticDocument
+	if err := snap.DataTo(&stat); err != nil {
+		return err
+	}
+
+	// Documents written by the new scheme store the UID, which never contains "@"
+	if !strings.Contains(stat.UserID, "@") {
+		m.current++
+		return nil
+	}
+
+	day, err := legacyDay(snap.Ref.ID)
+	if err != nil {
+		log.Printf("Skipping %s: %v", snap.Ref.ID, err)
+		m.skipped++
+		return nil
+	}
+
+	uid, err := m.lookupUID(ctx, stat.UserID)
+	if err != nil {
+		return err
+	}
+	if uid == "" {
+		log.Printf("Skipping %s: no Firebase user for %s", snap.Ref.ID, stat.UserID)
+		m.skipped++
+		return nil
+	}
+
+	targetRef := m.db.Collection(services.StatisticCollection).Doc(services.StatisticDocID(uid, day))
+	log.Printf("Migrating %s -> %s (%d detections)", snap.Ref.ID, targetRef.ID, stat.GrandTotal)
+	if m.dryRun {
+		m.migrated++
+		return nil
+	}
+
+	err = m.db.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// Re-read inside the transaction so a concurrent run cannot add the counts twice
+		legacy, err := tx.Get(snap.Ref)
+		if err != nil {
+			return err
+		}
+		var latest models.StatisticDocument
+		if err := legacy.DataTo(&latest); err != nil {
+			return err
+		}
+
+		if targetRef.ID == snap.Ref.ID {
+			return tx.Set(targetRef, map[string]interface{}{"userId": uid}, firestore.MergeAll)
+		}
+		if err := tx.Set(targetRef, incrementsFor(uid, latest), firestore.MergeAll); err != nil {
+			return err
+		}
+		return tx.Delete(snap.Ref)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.migrated++
+	return nil
+}
+
+// lookupUID resolves an email to its Firebase UID, returning "" when no such user exists
+func (m *migrator) lookupUID(ctx context.Context, email string) (string, error) {
+	if uid, ok := m.uids[email]; ok {
+		return uid, nil
+	}
+
+	user, err := m.auth.GetUserByEmail(ctx, email)
+	if auth.IsUserNotFound(err) {
+		m.uids[email] = ""
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("look up %s: %w", email, err)
+	}
+
+	m.uids[email] = user.UID
+	return user.UID, nil
+}
+
+// legacyDay extracts the day from a legacy document ID in format: emailpart_YYYY-MM-DD
+func legacyDay(docID string) (time.Time, error) {
+	idx := strings.LastIndex(docID, "_")
+	if idx < 0 {
+		return time.Time{}, fmt.Errorf("unexpected document ID format")
+	}
+	return time.Parse("2006-01-02", docID[idx+1:])
+}
+
+// incrementsFor builds a merge update adding every counter of stat onto the target document
+func incrementsFor(uid string, stat models.StatisticDocument) map[string]interface{} {
+	appCounts := make(map[string]interface{}, len(stat.AppCounts))
+	for app, counter := range stat.AppCounts {
+		appCounts[app] = map[string]interface{}{
+			"total":  firestore.Increment(counter.Total),
+			"low":    firestore.Increment(counter.Low),
+			"medium": firestore.Increment(counter.Medium),
+			"high":   firestore.Increment(counter.High),
+		}
+	}
+
+	return map[string]interface{}{
+		"userId":      uid,
+		"date":        stat.Date,
+		"grandTotal":  firestore.Increment(stat.GrandTotal),
+		"totalLow":    firestore.Increment(stat.TotalLow),
+		"totalMedium": firestore.Increment(stat.TotalMedium),
+		"totalHigh":   firestore.Increment(stat.TotalHigh),
+		"appCounts":   appCounts,
+	}
+}
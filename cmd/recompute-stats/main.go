@@ -0,0 +1,144 @@
+// cmd/recompute-stats/main.go
+
+// Command recompute-stats rebuilds a user's daily nsfw_stats rollups from the
+// nsfw_events log. Days without logged events are left as they are. With
+// -reclassify the stored class measures of every event are run through the
+// classification policy first (NSFW_POLICY_PATH or the built-in one) with the
+// user's current sensitivity profile and application overrides, and the event
+// level is updated, which is how statistics are corrected after the
+// classification rules change. Events logged before class measures were stored
+// only kept their top scores and are not reclassified.
+//
+// Usage:
+//
+//	go run ./cmd/recompute-stats -uid USER_UID -from 2025-09-01 -to 2025-09-30
+//	go run ./cmd/recompute-stats -uid USER_UID -from 2025-09-01 -to 2025-09-30 -reclassify
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"cloud.google.com/go/firestore"
+	"github.com/joho/godotenv"
+	"google.golang.org/api/iterator"
+
+	"go-gin-project/internal/firebaseapp"
+	"go-gin-project/internal/models"
+	"go-gin-project/internal/services"
+)
+
+func main() {
+	uid := flag.String("uid", "", "Firebase UID whose statistics are rebuilt")
+	from := flag.String("from", "", "First day to rebuild (YYYY-MM-DD, user's timezone)")
+	to := flag.String("to", "", "Last day to rebuild (YYYY-MM-DD, user's timezone)")
+	reclassify := flag.Bool("reclassify", false, "Re-run the classifier on stored event classes before rebuilding")
+	flag.Parse()
+
+	if *uid == "" || *from == "" || *to == "" {
+		flag.Usage()
+		log.Fatal("-uid, -from and -to are required")
+	}
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("Warning: .env file not found, using system environment variables")
+	}
+
+	ctx := context.Background()
+	_, db, err := firebaseapp.Setup(ctx)
+	if err != nil {
+		log.Fatalf("Error setting up Firebase: %v", err)
+	}
+	defer db.Close()
+
+	if *reclassify {
+		policy := services.DefaultPolicy()
+		if path := os.Getenv("NSFW_POLICY_PATH"); path != "" {
+			if policy, err = services.LoadPolicyFile(path); err != nil {
+				log.Fatalf("Error loading NSFW classification policy: %v", err)
+			}
+		}
+
+		sensitivity, err := services.ResolveSensitivity(ctx, db, policy, *uid)
+		if err != nil {
+			log.Fatalf("Error resolving sensitivity profile: %v", err)
+		}
+
+		changed, legacy, err := reclassifyEvents(ctx, db, policy, sensitivity, *uid, *from, *to)
+		if err != nil {
+			log.Fatalf("Reclassification failed: %v", err)
+		}
+		log.Printf("Reclassified events with policy %s (profile %s), %d changed level, %d without class measures kept", policy.Version, sensitivity.Profile, changed, legacy)
+	}
+
+	written, err := services.RebuildRollups(ctx, db, *uid, *from, *to)
+	if err != nil {
+		log.Fatalf("Rebuild failed: %v", err)
+	}
+	log.Printf("Done: %d daily documents written", written)
+}
+
+// reclassifyEvents updates the level and classifier version of the user's events in the range and
+// returns how many changed level and how many had no class measures to reclassify
+func reclassifyEvents(ctx context.Context, db *firestore.Client, policy *services.Policy, sensitivity services.Sensitivity, uid, fromDay, toDay string) (changed, legacy int, err error) {
+	iter := db.Collection(services.EventCollection).
+		Where("userId", "==", uid).
+		Where("day", ">=", fromDay).
+		Where("day", "<=", toDay).
+		Documents(ctx)
+	defer iter.Stop()
+
+	// Application overrides are loaded once per application
+	appPolicies := make(map[string]*models.AppPolicy)
+
+	for {
+		snap, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			return changed, legacy, nil
+		}
+		if err != nil {
+			return changed, legacy, fmt.Errorf("list events: %w", err)
+		}
+
+		var event models.DetectionEvent
+		if err := snap.DataTo(&event); err != nil {
+			return changed, legacy, fmt.Errorf("parse event %s: %w", snap.Ref.ID, err)
+		}
+
+		// Top scores alone classify differently than the live path (min aggregates, counts, geometry)
+		if len(event.Classes) == 0 && len(event.TopClasses) > 0 {
+			legacy++
+			continue
+		}
+		appPolicy, ok := appPolicies[event.Application]
+		if !ok {
+			if appPolicy, err = services.LoadAppPolicy(ctx, db, event.Application); err != nil {
+				return changed, legacy, err
+			}
+			appPolicies[event.Application] = appPolicy
+		}
+
+		decision := services.ReclassifyNSFW(policy, event.Classes, sensitivity, appPolicy)
+
+		if decision.Level == event.Level && event.ClassifierVersion == policy.Version && event.Profile == decision.Profile {
+			continue
+		}
+		if decision.Level != event.Level {
+			changed++
+		}
+
+		_, err = snap.Ref.Update(ctx, []firestore.Update{
+			{Path: "level", Value: decision.Level},
+			{Path: "classifierVersion", Value: decision.PolicyVersion},
+			{Path: "rule", Value: decision.Rule},
+			{Path: "profile", Value: decision.Profile},
+		})
+		if err != nil {
+			return changed, legacy, fmt.Errorf("update event %s: %w", snap.Ref.ID, err)
+		}
+	}
+}
@@ -6,7 +6,11 @@ require (
 	cloud.google.com/go/firestore v1.18.0
 	firebase.google.com/go/v4 v4.18.0
 	github.com/gin-gonic/gin v1.10.1
+	github.com/joho/godotenv v1.5.1
+	golang.org/x/image v0.25.0
 	google.golang.org/api v0.248.0
+	google.golang.org/grpc v1.74.2
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -80,7 +84,5 @@ require (
 	google.golang.org/genproto v0.0.0-20250603155806-513f23925822 // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20250603155806-513f23925822 // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20250818200422-3122310a409c // indirect
-	google.golang.org/grpc v1.74.2 // indirect
 	google.golang.org/protobuf v1.36.7 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
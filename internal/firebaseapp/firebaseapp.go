@@ -0,0 +1,54 @@
+// internal/firebaseapp/firebaseapp.go
+
+package firebaseapp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/firestore"
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/auth"
+	"google.golang.org/api/option"
+)
+
+// Setup initializes the Firebase Admin SDK from the environment and returns auth & firestore clients.
+// Credentials come from FIREBASE_CREDENTIALS_JSON (Vercel) or FIREBASE_CREDENTIALS_PATH (local).
+func Setup(ctx context.Context) (*auth.Client, *firestore.Client, error) {
+	var opt option.ClientOption
+
+	// Try to load from JSON string first (for Vercel deployment)
+	credJSON := os.Getenv("FIREBASE_CREDENTIALS_JSON")
+	if credJSON != "" {
+		opt = option.WithCredentialsJSON([]byte(credJSON))
+	} else {
+		// Fallback to file path (for local development)
+		credPath := os.Getenv("FIREBASE_CREDENTIALS_PATH")
+		if credPath == "" {
+			return nil, nil, errors.New("neither FIREBASE_CREDENTIALS_JSON nor FIREBASE_CREDENTIALS_PATH environment variable is set")
+		}
+		opt = option.WithCredentialsFile(credPath)
+	}
+
+	// Inisialisasi App
+	app, err := firebase.NewApp(ctx, nil, opt)
+	if err != nil {
+		return nil, nil, fmt.Errorf("initializing Firebase app: %w", err)
+	}
+
+	// Inisialisasi Auth Client
+	authClient, err := app.Auth(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting Firebase Auth client: %w", err)
+	}
+
+	// Inisialisasi Firestore Client
+	firestoreClient, err := app.Firestore(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("initializing Firestore client: %w", err)
+	}
+
+	return authClient, firestoreClient, nil
+}
@@ -0,0 +1,116 @@
+// internal/handlers/apppolicy/apppolicy.go
+package apppolicy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"go-gin-project/internal/middleware"
+	"go-gin-project/internal/models"
+	"go-gin-project/internal/services"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ListAppPoliciesHandler returns every application override
+func ListAppPoliciesHandler(db *firestore.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		iter := db.Collection(services.AppPolicyCollection).Documents(c.Request.Context())
+		defer iter.Stop()
+
+		appPolicies := []models.AppPolicy{}
+		for {
+			doc, err := iter.Next()
+			if errors.Is(err, iterator.Done) {
+				break
+			}
+			if err != nil {
+				log.Printf("Error listing application policies: %v\n", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list application policies"})
+				return
+			}
+
+			var appPolicy models.AppPolicy
+			if err := doc.DataTo(&appPolicy); err != nil {
+				log.Printf("Error parsing application policy %s: %v\n", doc.Ref.ID, err)
+				continue
+			}
+			appPolicies = append(appPolicies, appPolicy)
+		}
+
+		c.JSON(http.StatusOK, gin.H{"app_policies": appPolicies, "status": "success"})
+	}
+}
+
+// GetAppPolicyHandler returns the override of one application
+func GetAppPolicyHandler(db *firestore.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		appPolicy, err := services.LoadAppPolicy(c.Request.Context(), db, c.Param("application"))
+		if err != nil {
+			log.Printf("Error loading application policy: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load application policy"})
+			return
+		}
+		if appPolicy == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Application policy not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"app_policy": appPolicy, "status": "success"})
+	}
+}
+
+// PutAppPolicyHandler creates or replaces the override of one application
+func PutAppPolicyHandler(db *firestore.Client, policy *services.Policy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var appPolicy models.AppPolicy
+		if err := c.ShouldBindJSON(&appPolicy); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		// The path decides which application is overridden, same key as the statistic counters
+		appPolicy.Application = services.AppPolicyID(c.Param("application"))
+		if err := policy.ValidateAppPolicy(appPolicy); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		appPolicy.UpdatedAt = time.Now()
+		appPolicy.UpdatedBy = middleware.CurrentIdentity(c).UID
+
+		_, err := db.Collection(services.AppPolicyCollection).Doc(appPolicy.Application).Set(c.Request.Context(), appPolicy)
+		if err != nil {
+			log.Printf("Error saving application policy: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save application policy"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"app_policy": appPolicy, "status": "success"})
+	}
+}
+
+// DeleteAppPolicyHandler removes the override of one application
+func DeleteAppPolicyHandler(db *firestore.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ref := db.Collection(services.AppPolicyCollection).Doc(services.AppPolicyID(c.Param("application")))
+		_, err := ref.Delete(c.Request.Context(), firestore.Exists)
+		if status.Code(err) == codes.NotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Application policy not found"})
+			return
+		}
+		if err != nil {
+			log.Printf("Error deleting application policy: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete application policy"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Application policy deleted", "status": "success"})
+	}
+}
@@ -0,0 +1,26 @@
+// internal/handlers/detectioncache/detectioncache.go
+package detectioncache
+
+import (
+	"net/http"
+
+	"go-gin-project/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StatsHandler returns the hit-rate counters of the detection cache. cache is nil when caching is off.
+func StatsHandler(cache *services.CachingDetector) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cache == nil {
+			c.JSON(http.StatusOK, gin.H{"enabled": false, "status": "success"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"enabled": true,
+			"stats":   cache.Stats(),
+			"status":  "success",
+		})
+	}
+}
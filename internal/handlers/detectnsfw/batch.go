@@ -0,0 +1,185 @@
+package detectnsfw
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"sync"
+
+	"go-gin-project/internal/models"
+	"go-gin-project/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// BatchConfig limits the batch detection endpoint
+type BatchConfig struct {
+	MaxImages   int // Images accepted per request
+	Concurrency int // Images sent to the detector at the same time
+}
+
+// DefaultBatchConfig returns the limits used when no environment override is set
+func DefaultBatchConfig() BatchConfig {
+	return BatchConfig{MaxImages: 20, Concurrency: 4}
+}
+
+// errReadImage marks a batch image whose upload could not be read, a server-side failure
+var errReadImage = errors.New("failed to read image file")
+
+// batchItem is the per-image entry of a batch response, either a result or an error
+type batchItem struct {
+	Index            int                      `json:"index"`
+	Filename         string                   `json:"filename"`
+	Status           string                   `json:"status"` // "success" or "error"
+	NSFWLevel        *int                     `json:"nsfw_level,omitempty"`
+	PolicyVersion    string                   `json:"policy_version,omitempty"`
+	Explanation      *services.Decision       `json:"explanation,omitempty"`
+	ImageSize        *services.ImageSize      `json:"image_size,omitempty"`
+	DetectionResults []models.DetectionResult `json:"detection_results,omitempty"`
+	Cached           bool                     `json:"cached,omitempty"`
+	Error            string                   `json:"error,omitempty"`
+	ErrorStatus      int                      `json:"error_status,omitempty"` // HTTP status the single-image endpoint would return
+	ErrorCode        string                   `json:"error_code,omitempty"`   // Set for rejected uploads, see uploadErrorResponse
+	UpstreamStatus   int                      `json:"upstream_status,omitempty"`
+}
+
+// DetectNSFWBatchHandler classifies every repeated "image" part of the form. Images are sent to the
+// detector with bounded concurrency, failures are reported per image, and all successful detections
+// are recorded in a single statistics update. Each image is validated against deps.Limits like the
+// single-image endpoint does.
+func DetectNSFWBatchHandler(deps Deps) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limitRequestBody(c, deps.Limits.MaxBytes*int64(deps.Batch.MaxImages))
+		form, err := c.MultipartForm()
+		if err != nil && isUploadError(err) {
+			respondUploadError(c, err)
+			return
+		}
+		if err != nil || len(form.File["image"]) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "At least one image file is required"})
+			return
+		}
+		files := form.File["image"]
+		if len(files) > deps.Batch.MaxImages {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("At most %d images per batch", deps.Batch.MaxImages)})
+			return
+		}
+
+		req, ok := newDetectionRequest(c, deps.DB, deps.Policy, deps.Shadows)
+		if !ok {
+			return
+		}
+
+		items := make([]batchItem, len(files))
+		events := make([]*models.DetectionEvent, len(files))
+		errs := make([]error, len(files))
+
+		// Semaphore bounds how many images are at the detector at once
+		sem := make(chan struct{}, deps.Batch.Concurrency)
+		var wg sync.WaitGroup
+		for i, fh := range files {
+			wg.Add(1)
+			go func(i int, fh *multipart.FileHeader) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				items[i] = batchItem{Index: i, Filename: fh.Filename}
+				var upload *services.Upload
+				image, err := readUpload(fh, deps.Limits.MaxBytes)
+				if err == nil {
+					upload, err = services.ValidateImage(image, deps.Limits)
+				}
+				if err != nil && isUploadError(err) {
+					items[i].setUploadError(err)
+					errs[i] = err
+					return
+				}
+				if err != nil {
+					items[i].Status = "error"
+					items[i].Error = "Failed to read image file"
+					items[i].ErrorStatus = http.StatusInternalServerError
+					errs[i] = fmt.Errorf("%w: %v", errReadImage, err)
+					return
+				}
+
+				result, event, err := req.classify(c.Request.Context(), deps.Detector, fh.Filename, upload)
+				if err != nil {
+					log.Printf("Error calling NSFW detector for batch image %d: %v\n", i, err)
+					items[i].setError(err)
+					errs[i] = err
+					return
+				}
+
+				level := result.Decision.Level
+				items[i].Status = "success"
+				items[i].NSFWLevel = &level
+				items[i].PolicyVersion = result.Decision.PolicyVersion
+				items[i].Explanation = &result.Decision
+				items[i].ImageSize = &result.Size
+				items[i].DetectionResults = result.Results
+				items[i].Cached = result.Cached
+				events[i] = &event
+			}(i, fh)
+		}
+		wg.Wait()
+
+		// One statistics update for the whole batch
+		var recorded []models.DetectionEvent
+		for _, event := range events {
+			if event != nil {
+				recorded = append(recorded, *event)
+			}
+		}
+		if len(recorded) > 0 {
+			recordEvents(deps.DB, recorded...)
+		}
+
+		// Nothing succeeded: answer like the single-image endpoint would for the first failure
+		if len(recorded) == 0 {
+			code, body := detectorErrorResponse(errs[0])
+			switch {
+			case isUploadError(errs[0]):
+				code, body = uploadErrorResponse(errs[0])
+			case errors.Is(errs[0], errReadImage):
+				code, body = http.StatusInternalServerError, gin.H{"error": items[0].Error}
+			}
+			setRetryAfter(c, errs[0])
+			body["results"] = items
+			body["status"] = "failed"
+			c.JSON(code, body)
+			return
+		}
+
+		status := "success"
+		if len(recorded) < len(items) {
+			status = "partial_success"
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"results":   items,
+			"succeeded": len(recorded),
+			"failed":    len(items) - len(recorded),
+			"status":    status,
+		})
+	}
+}
+
+// setError fills the error fields of a batch item from a detector failure
+func (item *batchItem) setError(err error) {
+	code, body := detectorErrorResponse(err)
+	item.Status = "error"
+	item.ErrorStatus = code
+	item.Error, _ = body["error"].(string)
+	item.UpstreamStatus, _ = body["upstream_status"].(int)
+}
+
+// setUploadError fills the error fields of a batch item from a rejected upload
+func (item *batchItem) setUploadError(err error) {
+	code, body := uploadErrorResponse(err)
+	item.Status = "error"
+	item.ErrorStatus = code
+	item.Error, _ = body["error"].(string)
+	item.ErrorCode, _ = body["code"].(string)
+}
@@ -1,14 +1,13 @@
 package detectnsfw
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
-	"fmt"
-	"io"
-	"mime/multipart"
+	"errors"
+	"log"
+	"math"
+	"net"
 	"net/http"
-	"strings"
+	"strconv"
 	"time"
 
 	"go-gin-project/internal/models"
@@ -18,212 +17,272 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func DetectNSFWHandler(db *firestore.Client) gin.HandlerFunc {
+// Deps holds the clients, policies and settings the detection handlers share
+type Deps struct {
+	DB       *firestore.Client
+	Detector services.Detector
+	Policy   *services.Policy
+	Shadows  []*services.Policy  // Candidate policies classified in the shadow of Policy
+	Jobs     *services.JobRunner // nil when async mode is disabled on this deployment
+	Limits   services.UploadLimits
+	Redact   services.RedactConfig
+	Batch    BatchConfig
+	Media    MediaConfig
+}
+
+// DetectNSFWHandler classifies one uploaded image. Uploads over deps.Limits, in other formats than
+// JPEG/PNG/WebP/GIF/HEIC or failing to decode are rejected before reaching the detector.
+// With async=true (query or form) the image is queued on deps.Jobs and the handler answers 202 with
+// a job ID to poll, see GetJobHandler.
+// With redact=pixelate or blur the response also carries the image with the regions matching
+// deps.Redact hidden, see respondRedacted; this needs a synchronous call.
+func DetectNSFWHandler(deps Deps) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Parse multipart form
-		file, header, err := c.Request.FormFile("image")
+		// Parse multipart form, the body is capped so oversized uploads fail early
+		limitRequestBody(c, deps.Limits.MaxBytes)
+		header, err := c.FormFile("image")
 		if err != nil {
+			if isUploadError(err) {
+				respondUploadError(c, err)
+				return
+			}
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Image file is required"})
 			return
 		}
-		defer file.Close()
-
-		// Get application parameter from form
-		application := c.PostForm("application")
-		if application == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Application parameter is required"})
-			return
-		}
-
-		// Get user email from context (set by auth middleware)
-		email, exists := c.Get("email")
-		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User email not found in context"})
-			return
-		}
-		userEmail := email.(string)
 
 		// Read the file content
-		fileBytes, err := io.ReadAll(file)
+		fileBytes, err := readUpload(header, deps.Limits.MaxBytes)
 		if err != nil {
+			if isUploadError(err) {
+				respondUploadError(c, err)
+				return
+			}
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read image file"})
 			return
 		}
 
-		// Create a new multipart form for forwarding
-		body := &bytes.Buffer{}
-		writer := multipart.NewWriter(body)
-
-		// Add the image file to the new form
-		part, err := writer.CreateFormFile("image", header.Filename)
+		// Sniff the format and decode once so only sane images are forwarded
+		upload, err := services.ValidateImage(fileBytes, deps.Limits)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create form file"})
+			log.Printf("Rejected upload %s: %v\n", header.Filename, err)
+			respondUploadError(c, err)
 			return
 		}
-		part.Write(fileBytes)
-		writer.Close()
 
-		// Forward the request to the external service
-		req, err := http.NewRequest("POST", "http://127.0.0.1:5000/detect", body)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create request"})
+		redactOpts, ok := parseRedactOptions(c)
+		if !ok {
+			return
+		}
+		async := c.Query("async") == "true" || c.PostForm("async") == "true"
+		if async && deps.Jobs == nil {
+			c.JSON(http.StatusNotImplemented, errAsyncUnavailable)
+			return
+		}
+		if redactOpts.mode != "" && async {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "redact is not available for async detections"})
+			return
+		}
+		if redactOpts.mode != "" && upload.Format == services.FormatHEIC {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "redact is not available for HEIC images", "code": "redaction_unsupported_format"})
 			return
 		}
-		req.Header.Set("Content-Type", writer.FormDataContentType())
 
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to forward request"})
+		req, ok := newDetectionRequest(c, deps.DB, deps.Policy, deps.Shadows)
+		if !ok {
 			return
 		}
-		defer resp.Body.Close()
 
-		// Read the response from the external service
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read response"})
+		if async {
+			submitJob(c, deps.DB, deps.Detector, deps.Jobs, req, header.Filename, fileBytes)
 			return
 		}
 
-		// Parse the JSON response
-		var apiResp models.APIResponse
-		if err := json.Unmarshal(respBody, &apiResp); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse API response"})
+		result, event, err := req.classify(c.Request.Context(), deps.Detector, header.Filename, upload)
+		if err != nil {
+			log.Printf("Error calling NSFW detector: %v\n", err)
+			respondDetectorError(c, err)
 			return
 		}
 
-		// Classify NSFW level
-		nsfwLevel := services.ClassifyNSFW(apiResp.Results)
+		// Append the detection to the event log; flagged levels (> 0) also update the daily rollup
+		recordEvents(deps.DB, event)
 
-		// If NSFW level > 0, save to Firestore with proper document naming and counting
-		if nsfwLevel > 0 {
-			err = updateStatisticDocument(db, userEmail, application, nsfwLevel)
-			if err != nil {
-				// Log error but don't fail the request
-				// You could add proper logging here
-			}
+		if redactOpts.mode != "" {
+			respondRedacted(c, result, upload, redactOpts, deps.Redact)
+			return
 		}
 
 		// Return the classification result along with original detection results
-		c.JSON(http.StatusOK, gin.H{
-			"filename":          apiResp.Filename,
-			"nsfw_level":        nsfwLevel,
-			"detection_results": apiResp.Results,
-			"status":            "success",
-		})
+		c.JSON(http.StatusOK, detectionResponse(result))
+	}
+}
+
+// detectionResponse is the body returned for a classified image, synchronously or as a job result
+func detectionResponse(result imageResult) gin.H {
+	return gin.H{
+		"filename":          result.Filename,
+		"nsfw_level":        result.Decision.Level,
+		"policy_version":    result.Decision.PolicyVersion,
+		"explanation":       result.Decision,
+		"image_size":        result.Size,
+		"detection_results": result.Results,
+		"cached":            result.Cached,
+		"status":            "success",
 	}
 }
 
-// updateStatisticDocument creates or updates the statistic document with proper counting and app tracking
-func updateStatisticDocument(db *firestore.Client, email, application string, nsfwLevel int) error {
-	now := time.Now()
+// detectionRequest holds everything resolved once per request and shared by its images
+type detectionRequest struct {
+	uid         string
+	application string
+	device      string
+	loc         *time.Location
+	policy      *services.Policy
+	shadows     []*services.Policy
+	sensitivity services.Sensitivity
+	appPolicy   *models.AppPolicy
+}
+
+// imageResult is the classification of one image
+type imageResult struct {
+	Filename string
+	Size     services.ImageSize
+	Results  []models.DetectionResult
+	Decision services.Decision
+	Cached   bool // Detections came from the detection cache
+	Upright  bool // Boxes are in the EXIF-oriented coordinates of the image, see models.APIResponse
+}
+
+// newDetectionRequest validates the form and resolves the user's settings; it responds and returns false on error
+func newDetectionRequest(c *gin.Context, db *firestore.Client, policy *services.Policy, shadows []*services.Policy) (*detectionRequest, bool) {
+	// Get application parameter from form
+	application := c.PostForm("application")
+	if application == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Application parameter is required"})
+		return nil, false
+	}
 
-	// Create document ID in format: email_YYYY-MM-DD
-	emailPart := strings.Split(email, "@")[0] // Get part before @
-	docID := fmt.Sprintf("%s_%04d-%02d-%02d", emailPart, now.Year(), int(now.Month()), now.Day())
+	// Get user ID from context (set by auth middleware)
+	uid := c.GetString("uid")
+	if uid == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+		return nil, false
+	}
 
-	// Format date as "September 19, 2025" (no time)
-	dateString := now.Format("January 2, 2006")
+	// One profile read serves both the timezone and the sensitivity
+	userDetails, err := services.LoadUserDetails(c.Request.Context(), db, uid)
+	if err != nil {
+		// Fall back to the server zone and the default profile rather than failing the detection
+		log.Printf("Error loading user details for %s: %v\n", uid, err)
+		userDetails = models.UserDetails{}
+	}
 
-	docRef := db.Collection("nsfw_stats").Doc(docID)
+	// Resolve the user's timezone for the daily statistic bucket (?tz= overrides the profile)
+	loc, err := services.UserLocation(userDetails, c.Query("tz"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tz parameter. Use an IANA name such as Asia/Jakarta"})
+		return nil, false
+	}
 
-	// Try to get existing document
-	doc, err := docRef.Get(context.Background())
+	// Sensitivity profile chosen by the user (or their parent), else by age band
+	sensitivity := policy.SensitivityFor(userDetails)
 
+	// Override untuk aplikasi ini (ignored classes, thresholds, escalation), jika ada
+	appPolicy, err := services.LoadAppPolicy(c.Request.Context(), db, application)
 	if err != nil {
-		// Document doesn't exist, create new one
-		appCounts := make(map[string]models.AppStatCounter)
-
-		// Initialize app counter
-		appCounter := models.AppStatCounter{
-			Total:  1,
-			Low:    0,
-			Medium: 0,
-			High:   0,
-		}
+		log.Printf("Error loading application policy: %v\n", err)
+	}
 
-		// Set appropriate counter based on NSFW level
-		switch nsfwLevel {
-		case 1:
-			appCounter.Low = 1
-		case 2:
-			appCounter.Medium = 1
-		case 3:
-			appCounter.High = 1
-		}
+	return &detectionRequest{
+		uid:         uid,
+		application: application,
+		device:      c.PostForm("device"),
+		loc:         loc,
+		policy:      policy,
+		shadows:     shadows,
+		sensitivity: sensitivity,
+		appPolicy:   appPolicy,
+	}, true
+}
 
-		appCounts[strings.ToLower(application)] = appCounter
+// classify sends one image to the detector, classifies it and builds its event
+func (r *detectionRequest) classify(ctx context.Context, detector services.Detector, filename string, upload *services.Upload) (imageResult, models.DetectionEvent, error) {
+	// Forward the image to the detection backend
+	apiResp, err := detector.Detect(ctx, filename, upload)
+	if err != nil {
+		return imageResult{}, models.DetectionEvent{}, err
+	}
 
-		newDoc := models.StatisticDocument{
-			UserID:      email,
-			Date:        dateString,
-			GrandTotal:  1,
-			TotalLow:    0,
-			TotalMedium: 0,
-			TotalHigh:   0,
-			AppCounts:   appCounts,
-		}
+	// Express boxes as fractions of the image so rules can weigh region size and position
+	size := upload.Size
+	if apiResp.Upright {
+		size = upload.UprightSize()
+	}
+	results := services.NormalizeBoxes(apiResp.Results, size)
 
-		// Set grand totals
-		switch nsfwLevel {
-		case 1:
-			newDoc.TotalLow = 1
-		case 2:
-			newDoc.TotalMedium = 1
-		case 3:
-			newDoc.TotalHigh = 1
-		}
+	// Classify NSFW level with the active policy
+	decision := services.ClassifyNSFW(r.policy, results, r.sensitivity, r.appPolicy)
 
-		_, err = docRef.Set(context.Background(), newDoc)
-		return err
-	} else {
-		// Document exists, update counters
-		var existingDoc models.StatisticDocument
-		err = doc.DataTo(&existingDoc)
-		if err != nil {
-			return err
-		}
+	event := services.NewDetectionEvent(r.uid, r.application, r.device, decision, results, time.Now().In(r.loc))
+	// Candidate policies only classify in the shadow, their levels are recorded but never returned
+	event.ShadowLevels = services.ClassifyShadows(r.shadows, results, r.sensitivity, r.appPolicy)
 
-		// Initialize appCounts if nil
-		if existingDoc.AppCounts == nil {
-			existingDoc.AppCounts = make(map[string]models.AppStatCounter)
-		}
+	return imageResult{Filename: apiResp.Filename, Size: size, Results: results, Decision: decision, Cached: apiResp.Cached, Upright: apiResp.Upright}, event, nil
+}
 
-		appKey := strings.ToLower(application)
+// recordEvents writes the events and their rollups, then the shadow counters.
+// Errors are logged but never fail the request.
+func recordEvents(db *firestore.Client, events ...models.DetectionEvent) {
+	if err := services.RecordDetections(context.Background(), db, events...); err != nil {
+		log.Printf("Error recording NSFW detection: %v\n", err)
+		return
+	}
 
-		// Get existing app counter or create new one
-		appCounter, exists := existingDoc.AppCounts[appKey]
-		if !exists {
-			appCounter = models.AppStatCounter{
-				Total:  0,
-				Low:    0,
-				Medium: 0,
-				High:   0,
-			}
+	var shadowed []models.DetectionEvent
+	for _, event := range events {
+		if len(event.ShadowLevels) > 0 {
+			shadowed = append(shadowed, event)
 		}
-
-		// Update app-specific counters
-		appCounter.Total++
-		switch nsfwLevel {
-		case 1:
-			appCounter.Low++
-			existingDoc.TotalLow++
-		case 2:
-			appCounter.Medium++
-			existingDoc.TotalMedium++
-		case 3:
-			appCounter.High++
-			existingDoc.TotalHigh++
+	}
+	if len(shadowed) > 0 {
+		if err := services.RecordShadowComparisons(context.Background(), db, shadowed...); err != nil {
+			log.Printf("Error recording shadow comparison: %v\n", err)
 		}
+	}
+}
 
-		// Update grand total
-		existingDoc.GrandTotal++
+// respondDetectorError maps a detector failure to the matching gateway status code
+func respondDetectorError(c *gin.Context, err error) {
+	code, body := detectorErrorResponse(err)
+	setRetryAfter(c, err)
+	c.JSON(code, body)
+}
 
-		// Save updated app counter
-		existingDoc.AppCounts[appKey] = appCounter
+// setRetryAfter tells the client when to retry if the detector circuit is open
+func setRetryAfter(c *gin.Context, err error) {
+	var circuitErr *services.CircuitOpenError
+	if errors.As(err, &circuitErr) {
+		retryAfter := int(math.Ceil(circuitErr.RetryAfter.Seconds()))
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+	}
+}
 
-		_, err = docRef.Set(context.Background(), existingDoc)
-		return err
+// detectorErrorResponse returns the status code and error body for a detector failure
+func detectorErrorResponse(err error) (int, gin.H) {
+	var circuitErr *services.CircuitOpenError
+	var statusErr *services.UpstreamStatusError
+	var netErr net.Error
+
+	switch {
+	case errors.As(err, &circuitErr):
+		return http.StatusServiceUnavailable, gin.H{"error": "NSFW detector is temporarily unavailable, please retry later"}
+	case errors.As(err, &statusErr):
+		return http.StatusBadGateway, gin.H{"error": "NSFW detector returned an error", "upstream_status": statusErr.StatusCode}
+	case errors.Is(err, services.ErrInvalidResponse):
+		return http.StatusBadGateway, gin.H{"error": "Failed to parse API response"}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, gin.H{"error": "NSFW detector timed out"}
+	default:
+		return http.StatusBadGateway, gin.H{"error": "Failed to forward request"}
 	}
 }
@@ -0,0 +1,82 @@
+package detectnsfw
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"go-gin-project/internal/services"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// errAsyncUnavailable is the response body when async jobs are disabled on this deployment
+var errAsyncUnavailable = gin.H{"error": "Async detections are not available on this deployment"}
+
+// submitJob queues the image on the worker pool and answers 202 with the job to poll.
+// An optional callback_url form field receives the signed job when it finishes.
+func submitJob(c *gin.Context, db *firestore.Client, detector services.Detector, jobs *services.JobRunner, req *detectionRequest, filename string, image []byte) {
+	callbackURL := c.PostForm("callback_url")
+	if callbackURL != "" {
+		if err := jobs.ValidateCallbackURL(c.Request.Context(), callbackURL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Only the bytes wait in the queue, the worker decodes them again so pending jobs hold no pixels
+	job, err := jobs.Submit(req.uid, callbackURL, func(ctx context.Context) (any, error) {
+		result, event, err := req.classify(ctx, detector, filename, services.NewUpload(image))
+		if err != nil {
+			log.Printf("Error calling NSFW detector: %v\n", err)
+			code, body := detectorErrorResponse(err)
+			message, _ := body["error"].(string)
+			return nil, &services.JobError{Status: code, Message: message, Err: err}
+		}
+
+		recordEvents(db, event)
+		return detectionResponse(result), nil
+	})
+	if errors.Is(err, services.ErrQueueFull) {
+		c.Header("Retry-After", "5")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many pending detections, please retry later"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error submitting detection job: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue detection"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"job_id":     job.ID,
+		"status":     job.Status,
+		"status_url": "/api/detectnsfw/jobs/" + job.ID,
+	})
+}
+
+// GetJobHandler returns an asynchronous detection job of the caller. jobs is nil when async mode is disabled.
+func GetJobHandler(jobs *services.JobRunner) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if jobs == nil {
+			c.JSON(http.StatusNotImplemented, errAsyncUnavailable)
+			return
+		}
+
+		uid := c.GetString("uid")
+		if uid == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		job, ok := jobs.Get(uid, c.Param("id"))
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, job)
+	}
+}
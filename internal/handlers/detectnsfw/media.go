@@ -0,0 +1,210 @@
+package detectnsfw
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"go-gin-project/internal/models"
+	"go-gin-project/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MediaConfig controls the animation and video detection endpoint
+type MediaConfig struct {
+	Frames      services.FrameConfig
+	Concurrency int   // Frames sent to the detector at the same time
+	MaxBytes    int64 // Size of one upload, videos are larger than the still image limit
+}
+
+// DefaultMediaConfig returns the settings used when no environment override is set
+func DefaultMediaConfig() MediaConfig {
+	return MediaConfig{Frames: services.DefaultFrameConfig(), Concurrency: 4, MaxBytes: 50 << 20}
+}
+
+// frameItem is the per-frame entry of a media response, either a result or an error
+type frameItem struct {
+	Index            int                      `json:"index"`
+	OffsetMs         int64                    `json:"offset_ms"`
+	Status           string                   `json:"status"` // "success" or "error"
+	NSFWLevel        *int                     `json:"nsfw_level,omitempty"`
+	DetectionResults []models.DetectionResult `json:"detection_results,omitempty"`
+	Error            string                   `json:"error,omitempty"`
+	ErrorStatus      int                      `json:"error_status,omitempty"`
+	UpstreamStatus   int                      `json:"upstream_status,omitempty"`
+}
+
+// DetectNSFWMediaHandler classifies an animated GIF/WebP or a short video clip from the "media" form
+// field. Sampled frames are classified separately; the response carries every frame's level and the
+// aggregate, which is the level of the worst frame. Still images are accepted as a single frame.
+// Only the worst frame is recorded in the statistics, so one upload counts as one detection.
+// Uploads are limited to deps.Media.MaxBytes; images and animation canvases to the dimensions of deps.Limits.
+func DetectNSFWMediaHandler(deps Deps) gin.HandlerFunc {
+	limits := deps.Limits
+	limits.MaxBytes = deps.Media.MaxBytes
+
+	return func(c *gin.Context) {
+		limitRequestBody(c, limits.MaxBytes)
+		header, err := c.FormFile("media")
+		if err != nil {
+			if isUploadError(err) {
+				respondUploadError(c, err)
+				return
+			}
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Media file is required"})
+			return
+		}
+
+		data, err := readUpload(header, limits.MaxBytes)
+		if err != nil {
+			if isUploadError(err) {
+				respondUploadError(c, err)
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read media file"})
+			return
+		}
+
+		upload, err := services.ValidateMedia(data, limits)
+		if err != nil {
+			log.Printf("Rejected media upload %s: %v\n", header.Filename, err)
+			respondUploadError(c, err)
+			return
+		}
+
+		req, ok := newDetectionRequest(c, deps.DB, deps.Policy, deps.Shadows)
+		if !ok {
+			return
+		}
+
+		kind, frames, err := services.SampleFrames(c.Request.Context(), upload, deps.Media.Frames, limits)
+		switch {
+		case errors.Is(err, services.ErrUnsupportedMedia):
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Media must be an image, an animated GIF/WebP or a video"})
+			return
+		case errors.Is(err, services.ErrVideoUnsupported):
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Video is not supported on this server"})
+			return
+		case errors.Is(err, services.ErrImageDimensions):
+			// Only video frames are measured while sampling, ffmpeg should already have shrunk them
+			log.Printf("Rejected media frames: %v\n", err)
+			respondUploadError(c, err)
+			return
+		case errors.Is(err, services.ErrInvalidMedia):
+			log.Printf("Error decoding media: %v\n", err)
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to decode media file"})
+			return
+		case err != nil:
+			log.Printf("Error sampling media frames: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sample media frames"})
+			return
+		}
+
+		items := make([]frameItem, len(frames))
+		results := make([]*imageResult, len(frames))
+		events := make([]*models.DetectionEvent, len(frames))
+		errs := make([]error, len(frames))
+
+		// Semaphore bounds how many frames are at the detector at once
+		sem := make(chan struct{}, deps.Media.Concurrency)
+		var wg sync.WaitGroup
+		for i, frame := range frames {
+			wg.Add(1)
+			go func(i int, frame services.Frame) {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+
+				items[i] = frameItem{Index: frame.Index, OffsetMs: frame.Offset.Milliseconds()}
+				result, event, err := req.classify(c.Request.Context(), deps.Detector, frameFilename(header.Filename, kind, frame), frame.Image)
+				if err != nil {
+					log.Printf("Error calling NSFW detector for frame %d: %v\n", frame.Index, err)
+					code, body := detectorErrorResponse(err)
+					items[i].Status = "error"
+					items[i].ErrorStatus = code
+					items[i].Error, _ = body["error"].(string)
+					items[i].UpstreamStatus, _ = body["upstream_status"].(int)
+					errs[i] = err
+					return
+				}
+
+				level := result.Decision.Level
+				items[i].Status = "success"
+				items[i].NSFWLevel = &level
+				items[i].DetectionResults = result.Results
+				results[i] = &result
+				events[i] = &event
+			}(i, frame)
+		}
+		wg.Wait()
+
+		// The worst frame decides the level of the upload, the earliest one wins ties
+		worst, flagged := -1, 0
+		for i, result := range results {
+			if result == nil {
+				continue
+			}
+			if result.Decision.Level > 0 {
+				flagged++
+			}
+			if worst < 0 || result.Decision.Level > results[worst].Decision.Level {
+				worst = i
+			}
+		}
+
+		// Nothing succeeded: answer like the single-image endpoint would for the first failure
+		if worst < 0 {
+			code, body := detectorErrorResponse(errs[0])
+			setRetryAfter(c, errs[0])
+			body["frames"] = items
+			body["status"] = "failed"
+			c.JSON(code, body)
+			return
+		}
+
+		recordEvents(deps.DB, *events[worst])
+
+		status := "success"
+		if failed := countFailed(items); failed > 0 {
+			status = "partial_success"
+		}
+		decision := results[worst].Decision
+		c.JSON(http.StatusOK, gin.H{
+			"filename":       header.Filename,
+			"media_type":     kind,
+			"nsfw_level":     decision.Level,
+			"policy_version": decision.PolicyVersion,
+			"explanation":    decision,
+			"worst_frame":    items[worst].Index,
+			"flagged_frames": flagged,
+			"frame_count":    len(items),
+			"frames":         items,
+			"status":         status,
+		})
+	}
+}
+
+// frameFilename names a sampled frame after its upload, so detector logs can be traced back
+func frameFilename(filename, kind string, frame services.Frame) string {
+	if kind == services.MediaImage {
+		return filename
+	}
+	base := strings.TrimSuffix(filename, filepath.Ext(filename))
+	return fmt.Sprintf("%s_frame%05d.jpg", base, frame.Index)
+}
+
+// countFailed returns how many frames could not be classified
+func countFailed(items []frameItem) int {
+	failed := 0
+	for _, item := range items {
+		if item.Status != "success" {
+			failed++
+		}
+	}
+	return failed
+}
@@ -0,0 +1,75 @@
+package detectnsfw
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strconv"
+
+	"go-gin-project/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Ways a redacted preview is returned
+const (
+	redactOutputBase64 = "base64" // redacted_image field next to the detection response
+	redactOutputImage  = "image"  // JPEG body, the classification in X-NSFW-* headers
+)
+
+// redactOptions is the redacted preview requested with ?redact= and ?redact_output= (or form fields)
+type redactOptions struct {
+	mode   string // Empty when no preview is requested
+	output string
+}
+
+// parseRedactOptions reads the preview options; it responds and returns false when they are invalid
+func parseRedactOptions(c *gin.Context) (redactOptions, bool) {
+	opts := redactOptions{mode: requestOption(c, "redact"), output: requestOption(c, "redact_output")}
+	if opts.output == "" {
+		opts.output = redactOutputBase64
+	}
+
+	if opts.mode != "" && !services.ValidRedactMode(opts.mode) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "redact must be pixelate or blur"})
+		return redactOptions{}, false
+	}
+	if opts.output != redactOutputBase64 && opts.output != redactOutputImage {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "redact_output must be base64 or image"})
+		return redactOptions{}, false
+	}
+	return opts, true
+}
+
+// requestOption returns a parameter from the query string, or from the form when the query lacks it
+func requestOption(c *gin.Context, key string) string {
+	if value := c.Query(key); value != "" {
+		return value
+	}
+	return c.PostForm(key)
+}
+
+// respondRedacted answers with the detection and the image with its flagged regions hidden
+func respondRedacted(c *gin.Context, result imageResult, upload *services.Upload, opts redactOptions, cfg services.RedactConfig) {
+	redacted, regions, err := services.RedactImage(upload, result.Results, result.Upright, opts.mode, cfg)
+	if err != nil {
+		log.Printf("Error redacting image: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redact image"})
+		return
+	}
+
+	if opts.output == redactOutputImage {
+		c.Header("X-NSFW-Level", strconv.Itoa(result.Decision.Level))
+		c.Header("X-NSFW-Policy-Version", result.Decision.PolicyVersion)
+		c.Header("X-NSFW-Redacted-Regions", strconv.Itoa(regions))
+		c.Data(http.StatusOK, "image/jpeg", redacted)
+		return
+	}
+
+	body := detectionResponse(result)
+	body["redaction_mode"] = opts.mode
+	body["redacted_regions"] = regions
+	body["redacted_content_type"] = "image/jpeg"
+	body["redacted_image"] = base64.StdEncoding.EncodeToString(redacted)
+	c.JSON(http.StatusOK, body)
+}
@@ -0,0 +1,80 @@
+package detectnsfw
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"go-gin-project/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// multipartOverhead is allowed on top of the file limits for the other form fields and part headers
+const multipartOverhead = 1 << 20
+
+// limitRequestBody caps the request body so an oversized upload fails while the form is parsed,
+// before it is buffered in memory or spooled to disk
+func limitRequestBody(c *gin.Context, maxBytes int64) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes+multipartOverhead)
+}
+
+// readUpload reads an uploaded file into memory, failing with ErrUploadTooLarge past maxBytes
+func readUpload(fh *multipart.FileHeader, maxBytes int64) ([]byte, error) {
+	if fh.Size > maxBytes {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d allowed", services.ErrUploadTooLarge, fh.Size, maxBytes)
+	}
+
+	file, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("%w: more than %d bytes", services.ErrUploadTooLarge, maxBytes)
+	}
+	return data, nil
+}
+
+// isUploadError reports whether err is a rejected upload rather than a server failure
+func isUploadError(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr) ||
+		errors.Is(err, services.ErrEmptyUpload) ||
+		errors.Is(err, services.ErrUploadTooLarge) ||
+		errors.Is(err, services.ErrUnsupportedImageType) ||
+		errors.Is(err, services.ErrImageDimensions) ||
+		errors.Is(err, services.ErrCorruptImage)
+}
+
+// uploadErrorResponse returns the status code and error body for a rejected upload. The code field
+// lets clients tell the rejections apart without parsing the message.
+func uploadErrorResponse(err error) (int, gin.H) {
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesErr), errors.Is(err, services.ErrUploadTooLarge):
+		return http.StatusRequestEntityTooLarge, gin.H{"error": "Upload is too large", "code": "upload_too_large"}
+	case errors.Is(err, services.ErrEmptyUpload):
+		return http.StatusBadRequest, gin.H{"error": "Uploaded file is empty", "code": "empty_upload"}
+	case errors.Is(err, services.ErrUnsupportedImageType):
+		return http.StatusUnsupportedMediaType, gin.H{"error": "File must be a JPEG, PNG, WebP, GIF or HEIC image", "code": "unsupported_image_type"}
+	case errors.Is(err, services.ErrImageDimensions):
+		return http.StatusUnprocessableEntity, gin.H{"error": "Image dimensions exceed the allowed maximum", "code": "image_dimensions_exceeded"}
+	default:
+		return http.StatusUnprocessableEntity, gin.H{"error": "Image cannot be decoded", "code": "image_corrupt"}
+	}
+}
+
+// respondUploadError answers a rejected upload
+func respondUploadError(c *gin.Context, err error) {
+	code, body := uploadErrorResponse(err)
+	c.JSON(code, body)
+}
@@ -0,0 +1,37 @@
+// internal/handlers/policyshadow/policyshadow.go
+package policyshadow
+
+import (
+	"log"
+	"net/http"
+
+	"go-gin-project/internal/services"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// ShadowReportHandler returns the disagreement matrices between the active and candidate policies.
+// ?candidate= limits the report to one candidate version.
+func ShadowReportHandler(db *firestore.Client, policy *services.Policy, shadows []*services.Policy) gin.HandlerFunc {
+	candidates := make([]string, 0, len(shadows))
+	for _, shadow := range shadows {
+		candidates = append(candidates, shadow.Version)
+	}
+
+	return func(c *gin.Context) {
+		report, err := services.ShadowReport(c.Request.Context(), db, c.Query("candidate"))
+		if err != nil {
+			log.Printf("Error building shadow report: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build shadow report"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"active_version":     policy.Version,
+			"running_candidates": candidates,
+			"comparisons":        report,
+			"status":             "success",
+		})
+	}
+}
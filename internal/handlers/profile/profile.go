@@ -6,24 +6,31 @@ import (
 	"context"
 	"net/http"
 
+	"go-gin-project/internal/middleware"
 	"go-gin-project/internal/models"
+	"go-gin-project/internal/services"
 
 	"cloud.google.com/go/firestore"
 	"firebase.google.com/go/v4/auth"
 	"github.com/gin-gonic/gin"
 )
 
-func ProfileHandler(authClient *auth.Client, db *firestore.Client) gin.HandlerFunc {
+func ProfileHandler(authClient *auth.Client, db *firestore.Client, policy *services.Policy) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		uid := c.MustGet("uid").(string)
-		email := c.MustGet("email").(string)
-		isVerified := c.MustGet("is_verified").(bool)
+		identity := middleware.CurrentIdentity(c)
+		uid := identity.UID
+		email := identity.Email
 
 		// Ambil displayName dari Firebase Auth
-		var displayName string
+		var displayName, phoneNumber string
 		user, err := authClient.GetUser(context.Background(), uid)
 		if err == nil && user != nil {
 			displayName = user.DisplayName
+			phoneNumber = user.PhoneNumber
+			// Token tanpa klaim email (mis. custom token) masih bisa punya email di user record
+			if email == "" {
+				email = user.Email
+			}
 		}
 
 		// Ambil data tambahan dari Firestore
@@ -35,14 +42,30 @@ func ProfileHandler(authClient *auth.Client, db *firestore.Client) gin.HandlerFu
 			doc.DataTo(&userDetails)
 		}
 
+		// Sapa dengan nama, email, atau UID sesuai data yang tersedia
+		greeting := displayName
+		if greeting == "" {
+			greeting = email
+		}
+		if greeting == "" {
+			greeting = uid
+		}
+
 		response := models.ProfileResponse{
-			Message:     "Welcome " + email + "!",
-			UserID:      uid,
-			Email:       email,
-			DisplayName: displayName, // Tambahkan displayName dari Firebase Auth
-			IsVerified:  isVerified,
-			Gender:      userDetails.Gender, // Tambahkan data dari Firestore
-			Age:         userDetails.Age,    // Tambahkan data dari Firestore
+			Message:        "Welcome " + greeting + "!",
+			UserID:         uid,
+			Email:          email,
+			PhoneNumber:    phoneNumber,
+			DisplayName:    displayName, // Tambahkan displayName dari Firebase Auth
+			IsVerified:     identity.IsVerified,
+			IsAnonymous:    identity.IsAnonymous(),
+			SignInProvider: identity.SignInProvider,
+			Gender:         userDetails.Gender, // Tambahkan data dari Firestore
+			Age:            userDetails.Age,    // Tambahkan data dari Firestore
+			Timezone:       userDetails.Timezone,
+			Sensitivity:    policy.SensitivityFor(userDetails).Profile, // Tersimpan atau sesuai umur
+			ParentUID:      userDetails.ParentUID,
+			ParentLinked:   userDetails.HasParent(),
 		}
 
 		c.JSON(http.StatusOK, response)
@@ -0,0 +1,163 @@
+// internal/handlers/profile/sensitivity.go
+package profile
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"go-gin-project/internal/middleware"
+	"go-gin-project/internal/models"
+	"go-gin-project/internal/services"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Error untuk hasil pengecekan akun anak di dalam transaksi
+var (
+	errChildNotFound   = errors.New("child account not found")
+	errNotParent       = errors.New("caller is not the parent of this account")
+	errNotConfirmed    = errors.New("parent link is not confirmed")
+	errParentInAgeBand = errors.New("parent account is in a child age band")
+)
+
+// ConfirmChildHandler lets a parent confirm the link a child account requested by saving parent_uid
+// through SaveUserDetailsHandler. Only then can the parent choose the child's profile and relax it
+// past the age band. The parent account needs a saved age outside every age band of the policy.
+func ConfirmChildHandler(db *firestore.Client, policy *services.Policy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		parentUID := middleware.CurrentIdentity(c).UID
+		childUID := c.Param("uid")
+
+		childRef := db.Collection("users").Doc(childUID)
+		parentRef := db.Collection("users").Doc(parentUID)
+		err := db.RunTransaction(context.Background(), func(ctx context.Context, tx *firestore.Transaction) error {
+			child, err := loadLinkedChild(tx, childRef, parentUID)
+			if err != nil {
+				return err
+			}
+
+			var parent models.UserDetails
+			doc, err := tx.Get(parentRef)
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+			if err == nil {
+				if err := doc.DataTo(&parent); err != nil {
+					return err
+				}
+			}
+			if _, inBand := policy.AgeSensitivity(parent.Age); inBand || parent.Age <= 0 {
+				return errParentInAgeBand
+			}
+
+			if child.ParentConfirmed {
+				return nil
+			}
+			return tx.Update(childRef, []firestore.Update{{Path: "ParentConfirmed", Value: true}})
+		})
+		switch {
+		case errors.Is(err, errChildNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Child account not found"})
+			return
+		case errors.Is(err, errNotParent):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account has not requested you as parent"})
+			return
+		case errors.Is(err, errParentInAgeBand):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Save an adult age on your own profile before confirming a child account"})
+			return
+		case err != nil:
+			log.Printf("Error confirming child account: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to confirm child account"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Child account confirmed", "user_id": childUID})
+	}
+}
+
+// loadLinkedChild reads the child profile in the transaction and checks it names parentUID as parent
+func loadLinkedChild(tx *firestore.Transaction, ref *firestore.DocumentRef, parentUID string) (models.UserDetails, error) {
+	doc, err := tx.Get(ref)
+	if status.Code(err) == codes.NotFound {
+		return models.UserDetails{}, errChildNotFound
+	}
+	if err != nil {
+		return models.UserDetails{}, err
+	}
+
+	var child models.UserDetails
+	if err := doc.DataTo(&child); err != nil {
+		return models.UserDetails{}, err
+	}
+	if child.ParentUID != parentUID {
+		return models.UserDetails{}, errNotParent
+	}
+	return child, nil
+}
+
+// SetChildSensitivityHandler lets a parent choose the sensitivity profile of a child account whose
+// link the parent confirmed through ConfirmChildHandler.
+func SetChildSensitivityHandler(db *firestore.Client, policy *services.Policy) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		parentUID := middleware.CurrentIdentity(c).UID
+		childUID := c.Param("uid")
+
+		var req struct {
+			Sensitivity       string                    `json:"sensitivity" binding:"required"`
+			CustomSensitivity *models.SensitivityScales `json:"custom_sensitivity"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+
+		sensitivity, err := policy.Sensitivity(req.Sensitivity, req.CustomSensitivity)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sensitivity. Use strict, standard, relaxed or custom with custom_sensitivity scales"})
+			return
+		}
+
+		// Cek kepemilikan dan simpan dalam satu transaksi agar tidak balapan dengan perubahan parent_uid
+		ref := db.Collection("users").Doc(childUID)
+		err = db.RunTransaction(context.Background(), func(ctx context.Context, tx *firestore.Transaction) error {
+			child, err := loadLinkedChild(tx, ref, parentUID)
+			if err != nil {
+				return err
+			}
+			if !child.ParentConfirmed {
+				return errNotConfirmed
+			}
+
+			return tx.Update(ref, []firestore.Update{
+				{Path: "Sensitivity", Value: req.Sensitivity},
+				{Path: "CustomSensitivity", Value: req.CustomSensitivity},
+			})
+		})
+		switch {
+		case errors.Is(err, errChildNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": "Child account not found"})
+			return
+		case errors.Is(err, errNotParent):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account is not linked to you as parent"})
+			return
+		case errors.Is(err, errNotConfirmed):
+			c.JSON(http.StatusForbidden, gin.H{"error": "Confirm the child account before choosing its sensitivity"})
+			return
+		case err != nil:
+			log.Printf("Error saving child sensitivity: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save sensitivity"})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"message":     "Sensitivity saved successfully",
+			"user_id":     childUID,
+			"sensitivity": sensitivity,
+		})
+	}
+}
@@ -6,16 +6,21 @@ import (
 	"log"
 	"net/http"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-gin-project/internal/middleware"
 	"go-gin-project/internal/models"
+	"go-gin-project/internal/services"
 
 	"cloud.google.com/go/firestore"
 	"github.com/gin-gonic/gin"
 )
 
-func SaveUserDetailsHandler(db *firestore.Client) gin.HandlerFunc {
+func SaveUserDetailsHandler(db *firestore.Client, policy *services.Policy) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		uid := c.MustGet("uid").(string)
-		email := c.MustGet("email").(string)
+		identity := middleware.CurrentIdentity(c)
+		uid := identity.UID
 
 		var userDetails models.UserDetails
 		if err := c.ShouldBindJSON(&userDetails); err != nil {
@@ -23,12 +28,76 @@ func SaveUserDetailsHandler(db *firestore.Client) gin.HandlerFunc {
 			return
 		}
 
-		// Set email dari token agar aman
-		userDetails.Email = email
+		// Validasi timezone jika dikirim, dipakai untuk batas harian statistik
+		if userDetails.Timezone != "" {
+			if _, err := services.LoadTimezone(userDetails.Timezone); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid timezone. Use an IANA name such as Asia/Jakarta"})
+				return
+			}
+		}
+
+		// Validasi profil sensitivitas jika dikirim
+		var chosen services.Sensitivity
+		if userDetails.Sensitivity != "" {
+			var err error
+			if chosen, err = policy.Sensitivity(userDetails.Sensitivity, userDetails.CustomSensitivity); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid sensitivity. Use strict, standard, relaxed or custom with custom_sensitivity scales"})
+				return
+			}
+		}
+		if userDetails.ParentUID == uid {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "An account cannot be its own parent"})
+			return
+		}
+
+		// Akun anak yang tautannya sudah dikonfirmasi orang tua tidak bisa mengubah profil, umur atau orang tuanya sendiri
+		var existing models.UserDetails
+		doc, err := db.Collection("users").Doc(uid).Get(c.Request.Context())
+		if err != nil && status.Code(err) != codes.NotFound {
+			log.Printf("Error loading user details: %v\n", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save user details"})
+			return
+		}
+		if err == nil {
+			doc.DataTo(&existing)
+		}
+		if existing.HasParent() {
+			if userDetails.Sensitivity != "" || (userDetails.ParentUID != "" && userDetails.ParentUID != existing.ParentUID) {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Sensitivity is managed by the parent account"})
+				return
+			}
+			// Umur menentukan profil default, anak tidak boleh keluar dari kelompok umurnya sendiri
+			if userDetails.Age != existing.Age {
+				c.JSON(http.StatusForbidden, gin.H{"error": "Age is managed by the parent account"})
+				return
+			}
+		}
+
+		// Pengguna dalam kelompok umur (mis. 12 tahun ke bawah) hanya boleh memilih profil yang sama ketat atau lebih ketat
+		if band, ok := policy.AgeSensitivity(userDetails.Age); ok && userDetails.Sensitivity != "" && !chosen.AtLeastAsStrictAs(band) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "At this age only profiles at least as strict as " + band.Profile + " can be chosen"})
+			return
+		}
+
+		// Set email dari token agar aman (kosong untuk login phone/anonymous/custom token)
+		userDetails.Email = identity.Email
+
+		// Hanya timpa field yang dikirim agar pengaturan lain (mis. timezone) tidak terhapus
+		fields := []firestore.FieldPath{{"Gender"}, {"Age"}, {"Email"}}
+		if userDetails.Timezone != "" {
+			fields = append(fields, firestore.FieldPath{"Timezone"})
+		}
+		if userDetails.Sensitivity != "" {
+			fields = append(fields, firestore.FieldPath{"Sensitivity"}, firestore.FieldPath{"CustomSensitivity"})
+		}
+		// parent_uid hanya permintaan tautan; orang tua yang baru harus mengonfirmasi lagi lewat ConfirmChildHandler
+		if userDetails.ParentUID != "" && userDetails.ParentUID != existing.ParentUID {
+			fields = append(fields, firestore.FieldPath{"ParentUID"}, firestore.FieldPath{"ParentConfirmed"})
+		}
 
 		// Simpan data ke Firestore dengan UID sebagai ID dokumen
 		// Ini akan membuat collection 'users' jika belum ada
-		_, err := db.Collection("users").Doc(uid).Set(context.Background(), userDetails)
+		_, err = db.Collection("users").Doc(uid).Set(context.Background(), userDetails, firestore.Merge(fields...))
 		if err != nil {
 			// TAMBAHKAN BARIS INI untuk melihat error asli di terminal
 			log.Printf("Error saving to Firestore: %v\n", err)
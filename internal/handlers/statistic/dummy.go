@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"go-gin-project/internal/models"
+	"go-gin-project/internal/services"
 
 	"cloud.google.com/go/firestore"
 	"github.com/gin-gonic/gin"
@@ -16,10 +17,10 @@ import (
 
 var dummyApps = []string{"tiktok", "chrome", "gallery", "instagram", "youtube", "facebook", "twitter"}
 
-// GenerateDummyStatisticHandler generates dummy statistics for a specific email (historical data)
+// GenerateDummyStatisticHandler generates dummy statistics for a specific user ID (historical data)
 func GenerateDummyStatisticHandler(db *firestore.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		userId := "dummyuser@gmail.com" // bisa diubah ke multi user jika mau
+		userId := c.DefaultQuery("userId", "dummyuser") // Firebase UID pemilik statistik
 		startDate := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
 		endDate := time.Now()
 		numDays := int(endDate.Sub(startDate).Hours()/24) + 1
@@ -27,8 +28,7 @@ func GenerateDummyStatisticHandler(db *firestore.Client) gin.HandlerFunc {
 		for i := 0; i < numDays; i++ {
 			date := startDate.AddDate(0, 0, i)
 			dateString := date.Format("January 2, 2006")
-			emailPart := userId[:len(userId)-10] // ambil sebelum @, asumsi @gmail.com
-			docID := emailPart + "_" + date.Format("2006-01-02")
+			docID := services.StatisticDocID(userId, date)
 
 			appCounts := make(map[string]models.AppStatCounter)
 			grandTotal := 0
@@ -67,7 +67,7 @@ func GenerateDummyStatisticHandler(db *firestore.Client) gin.HandlerFunc {
 				AppCounts:   appCounts,
 			}
 
-			_, err := db.Collection("nsfw_stats").Doc(docID).Set(context.Background(), statDoc)
+			_, err := db.Collection(services.StatisticCollection).Doc(docID).Set(context.Background(), statDoc)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed at " + docID, "detail": err.Error()})
 				return
@@ -78,21 +78,21 @@ func GenerateDummyStatisticHandler(db *firestore.Client) gin.HandlerFunc {
 	}
 }
 
-// GenerateTodayDummyStatisticHandler generates dummy statistics for specified period with email input (POST only)
+// GenerateTodayDummyStatisticHandler generates dummy statistics for specified period with user ID input (POST only)
 func GenerateTodayDummyStatisticHandler(db *firestore.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Only accept POST method with JSON body
 		var reqBody struct {
-			Email  string `json:"email" binding:"required,email"`
+			UserID string `json:"userId" binding:"required"`
 			Period string `json:"period"`
 		}
 
 		if err := c.ShouldBindJSON(&reqBody); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body. Expected JSON with email and optional period"})
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body. Expected JSON with userId and optional period"})
 			return
 		}
 
-		email := reqBody.Email
+		userId := reqBody.UserID
 		period := reqBody.Period
 
 		// Default period is today if not specified
@@ -114,9 +114,9 @@ func GenerateTodayDummyStatisticHandler(db *firestore.Client) gin.HandlerFunc {
 			return
 		}
 
-		// Validasi email sederhana
-		if len(email) < 5 || !strings.Contains(email, "@") {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email format"})
+		// Firebase UID tidak boleh mengandung "/" karena dipakai sebagai bagian ID dokumen
+		if strings.Contains(userId, "/") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid userId format"})
 			return
 		}
 
@@ -138,8 +138,6 @@ func GenerateTodayDummyStatisticHandler(db *firestore.Client) gin.HandlerFunc {
 			startDate = time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 0, 0, 0, 0, startDate.Location())
 		}
 
-		emailPart := email[:strings.Index(email, "@")] // ambil sebelum @
-
 		// Track statistics
 		createdCount := 0
 		skippedCount := 0
@@ -150,10 +148,10 @@ func GenerateTodayDummyStatisticHandler(db *firestore.Client) gin.HandlerFunc {
 		current := startDate
 		for current.Before(now.AddDate(0, 0, 1)) || current.Equal(now) {
 			dateString := current.Format("January 2, 2006")
-			docID := emailPart + "_" + current.Format("2006-01-02")
+			docID := services.StatisticDocID(userId, current)
 
 			// Check if document already exists
-			doc, err := db.Collection("nsfw_stats").Doc(docID).Get(context.Background())
+			doc, err := db.Collection(services.StatisticCollection).Doc(docID).Get(context.Background())
 			if err == nil && doc.Exists() {
 				// Document already exists, skip
 				skippedCount++
@@ -191,7 +189,7 @@ func GenerateTodayDummyStatisticHandler(db *firestore.Client) gin.HandlerFunc {
 			}
 
 			statDoc := models.StatisticDocument{
-				UserID:      email,
+				UserID:      userId,
 				Date:        dateString,
 				GrandTotal:  grandTotal,
 				TotalLow:    totalLow,
@@ -200,7 +198,7 @@ func GenerateTodayDummyStatisticHandler(db *firestore.Client) gin.HandlerFunc {
 				AppCounts:   appCounts,
 			}
 
-			_, err = db.Collection("nsfw_stats").Doc(docID).Set(context.Background(), statDoc)
+			_, err = db.Collection(services.StatisticCollection).Doc(docID).Set(context.Background(), statDoc)
 			if err != nil {
 				c.JSON(http.StatusInternalServerError, gin.H{
 					"error":  "Failed to create dummy data at " + docID,
@@ -217,7 +215,7 @@ func GenerateTodayDummyStatisticHandler(db *firestore.Client) gin.HandlerFunc {
 
 		c.JSON(http.StatusOK, gin.H{
 			"message":      "Dummy statistics generation completed",
-			"email":        email,
+			"userId":       userId,
 			"period":       period,
 			"startDate":    startDate.Format("January 2, 2006"),
 			"endDate":      now.Format("January 2, 2006"),
@@ -0,0 +1,122 @@
+package statistic
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go-gin-project/internal/models"
+	"go-gin-project/internal/services"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+)
+
+// heatmapWeekdays lists the heatmap rows, weeks start on Monday like the week granularity
+var heatmapWeekdays = []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"}
+
+// HourlyHeatmap holds weekday-by-hour detection counts; rows follow Weekdays, columns are hours 0-23
+type HourlyHeatmap struct {
+	Weekdays []string     `json:"weekdays"`
+	Total    [7][24]int   `json:"total"`
+	Low      [7][24]int   `json:"low"`
+	Medium   [7][24]int   `json:"medium"`
+	High     [7][24]int   `json:"high"`
+	Peak     *HeatmapPeak `json:"peak,omitempty"`
+
+	// Detections recorded before hourly counters existed, so they have no hour
+	Unattributed int `json:"unattributed"`
+}
+
+// HeatmapPeak is the weekday and hour with the most detections
+type HeatmapPeak struct {
+	Weekday string `json:"weekday"`
+	Hour    int    `json:"hour"`
+	Total   int    `json:"total"`
+}
+
+// GetHeatmapHandler returns a 7x24 weekday-by-hour breakdown of detections for a period or from/to range
+func GetHeatmapHandler(db *firestore.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get user ID from context (set by auth middleware)
+		uid := c.GetString("uid")
+		if uid == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
+			return
+		}
+
+		// Hours are bucketed in the user's timezone (?tz= overrides the profile)
+		loc, err := services.ResolveLocation(c.Request.Context(), db, uid, c.Query("tz"))
+		if errors.Is(err, services.ErrInvalidTimezone) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tz parameter. Use an IANA name such as Asia/Jakarta"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user timezone", "detail": err.Error()})
+			return
+		}
+
+		dr, err := resolveDateRange(c.Query("period"), c.Query("from"), c.Query("to"), time.Now().In(loc))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		stats, err := getStatisticsInDateRange(c.Request.Context(), db, uid, dr.Start, dr.End)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch statistics", "detail": err.Error()})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{
+			"period":    dr.Period,
+			"userId":    uid,
+			"timezone":  loc.String(),
+			"startDate": dr.Start.Format("January 2, 2006"),
+			"endDate":   dr.End.Format("January 2, 2006"),
+			"heatmap":   buildHeatmap(stats, loc),
+			"status":    "success",
+		})
+	}
+}
+
+// buildHeatmap sums the hourly counters of daily documents by weekday
+func buildHeatmap(stats []models.StatisticDocument, loc *time.Location) HourlyHeatmap {
+	heatmap := HourlyHeatmap{Weekdays: heatmapWeekdays}
+
+	for _, stat := range stats {
+		// Documents store their day as "January 2, 2006"
+		day, err := time.ParseInLocation("January 2, 2006", stat.Date, loc)
+		if err != nil {
+			continue
+		}
+		row := (int(day.Weekday()) + 6) % 7 // Monday first
+
+		attributed := 0
+		for key, counter := range stat.HourCounts {
+			hour, err := strconv.Atoi(key)
+			if err != nil || hour < 0 || hour > 23 {
+				continue
+			}
+			heatmap.Total[row][hour] += counter.Total
+			heatmap.Low[row][hour] += counter.Low
+			heatmap.Medium[row][hour] += counter.Medium
+			heatmap.High[row][hour] += counter.High
+			attributed += counter.Total
+		}
+		if stat.GrandTotal > attributed {
+			heatmap.Unattributed += stat.GrandTotal - attributed
+		}
+	}
+
+	for row := range heatmap.Total {
+		for hour, total := range heatmap.Total[row] {
+			if total > 0 && (heatmap.Peak == nil || total > heatmap.Peak.Total) {
+				heatmap.Peak = &HeatmapPeak{Weekday: heatmapWeekdays[row], Hour: hour, Total: total}
+			}
+		}
+	}
+
+	return heatmap
+}
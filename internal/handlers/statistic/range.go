@@ -0,0 +1,121 @@
+package statistic
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// isoDateLayout is the layout of the from/to query parameters
+const isoDateLayout = "2006-01-02"
+
+// maxCustomRangeDays caps custom from/to ranges to keep a request's reads bounded
+const maxCustomRangeDays = 731
+
+// Supported values of the granularity query parameter
+const (
+	GranularityDay   = "day"
+	GranularityWeek  = "week"
+	GranularityMonth = "month"
+)
+
+// customPeriod is reported as the period of requests using from/to instead of a preset
+const customPeriod = "custom"
+
+// dateRange is an inclusive range of local calendar days
+type dateRange struct {
+	Period string
+	Start  time.Time // Midnight of the first day
+	End    time.Time // Now for presets, midnight of the last day for custom ranges
+}
+
+// errInvalidRange describes a client error in the period, from or to parameters
+var errInvalidRange = errors.New("invalid date range")
+
+// resolveDateRange builds the range from either a preset period or from/to ISO dates in loc
+func resolveDateRange(period, from, to string, now time.Time) (dateRange, error) {
+	if from != "" || to != "" {
+		if period != "" {
+			return dateRange{}, fmt.Errorf("%w: use either period or from/to, not both", errInvalidRange)
+		}
+		return customDateRange(from, to, now.Location())
+	}
+
+	if period == "" {
+		return dateRange{}, fmt.Errorf("%w: period or from/to is required. Options: today, 7days, 1month, 3months", errInvalidRange)
+	}
+
+	var startDate time.Time
+	switch period {
+	case "today":
+		startDate = now
+	case "7days":
+		startDate = now.AddDate(0, 0, -6) // 7 days including today
+	case "1month":
+		startDate = now.AddDate(0, -1, 0) // 1 month ago
+	case "3months":
+		startDate = now.AddDate(0, -3, 0) // 3 months ago
+	default:
+		return dateRange{}, fmt.Errorf("%w: invalid period. Options: today, 7days, 1month, 3months", errInvalidRange)
+	}
+
+	return dateRange{Period: period, Start: startOfDay(startDate), End: now}, nil
+}
+
+// customDateRange parses inclusive from/to ISO dates in loc
+func customDateRange(from, to string, loc *time.Location) (dateRange, error) {
+	if from == "" || to == "" {
+		return dateRange{}, fmt.Errorf("%w: both from and to are required (YYYY-MM-DD)", errInvalidRange)
+	}
+
+	startDate, err := time.ParseInLocation(isoDateLayout, from, loc)
+	if err != nil {
+		return dateRange{}, fmt.Errorf("%w: from must be a date in YYYY-MM-DD format", errInvalidRange)
+	}
+	endDate, err := time.ParseInLocation(isoDateLayout, to, loc)
+	if err != nil {
+		return dateRange{}, fmt.Errorf("%w: to must be a date in YYYY-MM-DD format", errInvalidRange)
+	}
+	if endDate.Before(startDate) {
+		return dateRange{}, fmt.Errorf("%w: to must not be before from", errInvalidRange)
+	}
+	if startDate.AddDate(0, 0, maxCustomRangeDays).Before(endDate) {
+		return dateRange{}, fmt.Errorf("%w: range must not exceed %d days", errInvalidRange, maxCustomRangeDays)
+	}
+
+	return dateRange{Period: customPeriod, Start: startDate, End: endDate}, nil
+}
+
+// validGranularity reports whether g is a supported granularity
+func validGranularity(g string) bool {
+	return g == GranularityDay || g == GranularityWeek || g == GranularityMonth
+}
+
+// startOfDay returns midnight of t's day in t's location
+func startOfDay(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// bucketStart returns the first day of the bucket containing t; weeks start on Monday
+func bucketStart(t time.Time, granularity string) time.Time {
+	day := startOfDay(t)
+	switch granularity {
+	case GranularityWeek:
+		offset := (int(day.Weekday()) + 6) % 7 // Days since Monday
+		return day.AddDate(0, 0, -offset)
+	case GranularityMonth:
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, day.Location())
+	}
+	return day
+}
+
+// nextBucket returns the first day of the bucket following the one starting at start
+func nextBucket(start time.Time, granularity string) time.Time {
+	switch granularity {
+	case GranularityWeek:
+		return start.AddDate(0, 0, 7)
+	case GranularityMonth:
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
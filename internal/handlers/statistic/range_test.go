@@ -0,0 +1,94 @@
+package statistic
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testLoc is a user timezone east of UTC, so a UTC day boundary would show up in the results
+var testLoc = time.FixedZone("WIB", 7*60*60)
+
+// testDay returns midnight of an ISO date in testLoc
+func testDay(t *testing.T, iso string) time.Time {
+	t.Helper()
+	day, err := time.ParseInLocation(isoDateLayout, iso, testLoc)
+	if err != nil {
+		t.Fatalf("parse %s: %v", iso, err)
+	}
+	return day
+}
+
+func TestResolveDateRange(t *testing.T) {
+	now := time.Date(2025, 10, 15, 14, 30, 0, 0, testLoc) // A Wednesday
+
+	tests := []struct {
+		name             string
+		period, from, to string
+		wantPeriod       string
+		wantStart        string
+		wantEnd          time.Time
+		wantErr          bool
+	}{
+		{name: "today", period: "today", wantPeriod: "today", wantStart: "2025-10-15", wantEnd: now},
+		{name: "7 days include today", period: "7days", wantPeriod: "7days", wantStart: "2025-10-09", wantEnd: now},
+		{name: "1 month", period: "1month", wantPeriod: "1month", wantStart: "2025-09-15", wantEnd: now},
+		{name: "3 months", period: "3months", wantPeriod: "3months", wantStart: "2025-07-15", wantEnd: now},
+		{name: "custom", from: "2025-10-01", to: "2025-10-31", wantPeriod: customPeriod, wantStart: "2025-10-01", wantEnd: testDay(t, "2025-10-31")},
+		{name: "custom single day", from: "2025-10-01", to: "2025-10-01", wantPeriod: customPeriod, wantStart: "2025-10-01", wantEnd: testDay(t, "2025-10-01")},
+		{name: "custom maximum range", from: "2024-01-01", to: "2026-01-01", wantPeriod: customPeriod, wantStart: "2024-01-01", wantEnd: testDay(t, "2026-01-01")},
+		{name: "custom past the maximum range", from: "2024-01-01", to: "2026-01-02", wantErr: true},
+		{name: "period and from/to", period: "7days", from: "2025-10-01", to: "2025-10-31", wantErr: true},
+		{name: "period and to", period: "7days", to: "2025-10-31", wantErr: true},
+		{name: "from without to", from: "2025-10-01", wantErr: true},
+		{name: "to without from", to: "2025-10-31", wantErr: true},
+		{name: "from not ISO", from: "10/01/2025", to: "2025-10-31", wantErr: true},
+		{name: "to not a date", from: "2025-10-01", to: "2025-10-32", wantErr: true},
+		{name: "to before from", from: "2025-10-31", to: "2025-10-01", wantErr: true},
+		{name: "nothing", wantErr: true},
+		{name: "unknown period", period: "week", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dr, err := resolveDateRange(tt.period, tt.from, tt.to, now)
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidRange) {
+					t.Errorf("got %+v, %v; want %v", dr, err, errInvalidRange)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve: %v", err)
+			}
+			if dr.Period != tt.wantPeriod || !dr.Start.Equal(testDay(t, tt.wantStart)) || !dr.End.Equal(tt.wantEnd) {
+				t.Errorf("got %s %v - %v, want %s %s - %v", dr.Period, dr.Start, dr.End, tt.wantPeriod, tt.wantStart, tt.wantEnd)
+			}
+			if dr.Start.Location() != testLoc {
+				t.Errorf("start in %v, want the user's timezone", dr.Start.Location())
+			}
+		})
+	}
+}
+
+func TestBucketStart(t *testing.T) {
+	tests := []struct {
+		day, granularity, want string
+	}{
+		{"2025-10-15", GranularityDay, "2025-10-15"},
+		{"2025-10-13", GranularityWeek, "2025-10-13"}, // Monday
+		{"2025-10-15", GranularityWeek, "2025-10-13"},
+		{"2025-10-19", GranularityWeek, "2025-10-13"}, // Sunday ends the week
+		{"2025-10-01", GranularityWeek, "2025-09-29"}, // Week across a month boundary
+		{"2025-10-15", GranularityMonth, "2025-10-01"},
+		{"2025-10-01", GranularityMonth, "2025-10-01"},
+	}
+
+	for _, tt := range tests {
+		// Late in the day, the bucket must not depend on the time
+		at := testDay(t, tt.day).Add(23 * time.Hour)
+		if got := bucketStart(at, tt.granularity).Format(isoDateLayout); got != tt.want {
+			t.Errorf("%s by %s: got %s, want %s", tt.day, tt.granularity, got, tt.want)
+		}
+	}
+}
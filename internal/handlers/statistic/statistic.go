@@ -2,11 +2,13 @@ package statistic
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
-	"strings"
 	"time"
 
 	"go-gin-project/internal/models"
+	"go-gin-project/internal/services"
 
 	"cloud.google.com/go/firestore"
 	"github.com/gin-gonic/gin"
@@ -15,102 +17,106 @@ import (
 // GetStatisticHandler handles requests for statistic data based on time period
 func GetStatisticHandler(db *firestore.Client) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// Get period parameter from query
+		// Range comes from a preset period or from/to ISO dates, bucketed by granularity
 		period := c.Query("period")
-		if period == "" {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Period parameter is required. Options: today, 7days, 1month, 3months"})
+		from := c.Query("from")
+		to := c.Query("to")
+
+		granularity := c.DefaultQuery("granularity", GranularityDay)
+		if !validGranularity(granularity) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid granularity. Options: day, week, month"})
 			return
 		}
 
-		// Validate period
-		validPeriods := []string{"today", "7days", "1month", "3months"}
-		isValid := false
-		for _, validPeriod := range validPeriods {
-			if period == validPeriod {
-				isValid = true
-				break
-			}
-		}
-		if !isValid {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid period. Options: today, 7days, 1month, 3months"})
+		// Get user ID from context (set by auth middleware)
+		uid := c.GetString("uid")
+		if uid == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User ID not found in context"})
 			return
 		}
 
-		// Get user email from context (set by auth middleware)
-		email, exists := c.Get("email")
-		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "User email not found in context"})
+		// Resolve the user's timezone so day boundaries match their local calendar (?tz= overrides the profile)
+		loc, err := services.ResolveLocation(c.Request.Context(), db, uid, c.Query("tz"))
+		if errors.Is(err, services.ErrInvalidTimezone) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid tz parameter. Use an IANA name such as Asia/Jakarta"})
 			return
 		}
-		userEmail := email.(string)
-
-		// Calculate date range based on period
-		now := time.Now()
-		var startDate time.Time
-
-		switch period {
-		case "today":
-			startDate = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
-		case "7days":
-			startDate = now.AddDate(0, 0, -6) // 7 days including today
-			startDate = time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 0, 0, 0, 0, startDate.Location())
-		case "1month":
-			startDate = now.AddDate(0, -1, 0) // 1 month ago
-			startDate = time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 0, 0, 0, 0, startDate.Location())
-		case "3months":
-			startDate = now.AddDate(0, -3, 0) // 3 months ago
-			startDate = time.Date(startDate.Year(), startDate.Month(), startDate.Day(), 0, 0, 0, 0, startDate.Location())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load user timezone", "detail": err.Error()})
+			return
 		}
 
-		// Get email part for document ID prefix
-		emailPart := strings.Split(userEmail, "@")[0]
+		// Calculate date range based on period or from/to
+		now := time.Now().In(loc)
+		dr, err := resolveDateRange(period, from, to, now)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 
 		// Query Firestore for user's statistics within date range
-		stats, err := getStatisticsInDateRange(db, emailPart, startDate, now)
+		stats, err := getStatisticsInDateRange(c.Request.Context(), db, uid, dr.Start, dr.End)
 		if err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch statistics", "detail": err.Error()})
 			return
 		}
 
 		// Aggregate statistics
-		aggregatedStats := aggregateStatistics(stats, period)
+		aggregatedStats := aggregateStatistics(stats, dr, granularity)
 
 		c.JSON(http.StatusOK, gin.H{
-			"period":     period,
-			"email":      userEmail,
-			"startDate":  startDate.Format("January 2, 2006"),
-			"endDate":    now.Format("January 2, 2006"),
-			"statistics": aggregatedStats,
-			"status":     "success",
+			"period":      dr.Period,
+			"granularity": granularity,
+			"userId":      uid,
+			"email":       c.GetString("email"),
+			"timezone":    loc.String(),
+			"startDate":   dr.Start.Format("January 2, 2006"),
+			"endDate":     dr.End.Format("January 2, 2006"),
+			"statistics":  aggregatedStats,
+			"status":      "success",
 		})
 	}
 }
 
-// getStatisticsInDateRange retrieves statistics documents within the specified date range
-func getStatisticsInDateRange(db *firestore.Client, emailPart string, startDate, endDate time.Time) ([]models.StatisticDocument, error) {
-	var stats []models.StatisticDocument
+// maxDocsPerBatchGet bounds how many documents a single GetAll call requests
+const maxDocsPerBatchGet = 100
 
-	// Generate all possible document IDs in the date range
+// getStatisticsInDateRange retrieves the user's daily statistics documents within the date range
+// using batched reads. Days without a document are skipped, any other error is returned.
+func getStatisticsInDateRange(ctx context.Context, db *firestore.Client, uid string, startDate, endDate time.Time) ([]models.StatisticDocument, error) {
+	// Generate all possible document references in the date range
+	var refs []*firestore.DocumentRef
 	current := startDate
 	for current.Before(endDate) || current.Equal(endDate) {
-		docID := emailPart + "_" + current.Format("2006-01-02")
+		refs = append(refs, db.Collection(services.StatisticCollection).Doc(services.StatisticDocID(uid, current)))
+		current = current.AddDate(0, 0, 1)
+	}
 
-		doc, err := db.Collection("nsfw_stats").Doc(docID).Get(context.Background())
-		if err != nil {
-			// Document doesn't exist for this date, skip
-			current = current.AddDate(0, 0, 1)
-			continue
+	var stats []models.StatisticDocument
+	for start := 0; start < len(refs); start += maxDocsPerBatchGet {
+		end := start + maxDocsPerBatchGet
+		if end > len(refs) {
+			end = len(refs)
 		}
 
-		var stat models.StatisticDocument
-		if err := doc.DataTo(&stat); err != nil {
-			// Error parsing document, skip
-			current = current.AddDate(0, 0, 1)
-			continue
+		// Snapshots come back in the same order as refs, so stats stay sorted by day
+		docs, err := db.GetAll(ctx, refs[start:end])
+		if err != nil {
+			return nil, fmt.Errorf("get statistics documents: %w", err)
 		}
 
-		stats = append(stats, stat)
-		current = current.AddDate(0, 0, 1)
+		for _, doc := range docs {
+			if !doc.Exists() {
+				// Document doesn't exist for this date, skip
+				continue
+			}
+
+			var stat models.StatisticDocument
+			if err := doc.DataTo(&stat); err != nil {
+				return nil, fmt.Errorf("parse statistics document %s: %w", doc.Ref.ID, err)
+			}
+			stats = append(stats, stat)
+		}
 	}
 
 	return stats, nil
@@ -138,10 +144,25 @@ type PeriodStatistics struct {
 
 	// Daily breakdown with per-app details for each day
 	DailyBreakdown []DailySummary `json:"dailyBreakdown"`
+
+	// Zero-filled totals per day, week or month across the whole range
+	Granularity string          `json:"granularity"`
+	Buckets     []BucketSummary `json:"buckets"`
 }
 
-// aggregateStatistics combines multiple daily statistics based on the period
-func aggregateStatistics(stats []models.StatisticDocument, period string) interface{} {
+// BucketSummary represents totals for one day, week (Monday based) or month, clipped to the requested range
+type BucketSummary struct {
+	Start       string `json:"start"` // YYYY-MM-DD
+	End         string `json:"end"`   // YYYY-MM-DD, inclusive
+	GrandTotal  int    `json:"grandTotal"`
+	TotalLow    int    `json:"totalLow"`
+	TotalMedium int    `json:"totalMedium"`
+	TotalHigh   int    `json:"totalHigh"`
+}
+
+// aggregateStatistics combines multiple daily statistics based on the period and granularity
+func aggregateStatistics(stats []models.StatisticDocument, dr dateRange, granularity string) interface{} {
+	period := dr.Period
 	if len(stats) == 0 {
 		if period == "today" {
 			return map[string]interface{}{
@@ -159,6 +180,8 @@ func aggregateStatistics(stats []models.StatisticDocument, period string) interf
 				TotalHigh:       0,
 				AppBreakdown:    map[string]models.AppStatCounter{},
 				DailyBreakdown:  []DailySummary{},
+				Granularity:     granularity,
+				Buckets:         buildBuckets(stats, dr, granularity),
 			}
 		}
 	}
@@ -220,5 +243,52 @@ func aggregateStatistics(stats []models.StatisticDocument, period string) interf
 		TotalHigh:       totalHigh,
 		AppBreakdown:    appBreakdown,
 		DailyBreakdown:  dailySummaries,
+		Granularity:     granularity,
+		Buckets:         buildBuckets(stats, dr, granularity),
+	}
+}
+
+// buildBuckets sums daily documents into zero-filled buckets covering the whole range
+func buildBuckets(stats []models.StatisticDocument, dr dateRange, granularity string) []BucketSummary {
+	loc := dr.Start.Location()
+	lastDay := startOfDay(dr.End)
+
+	var buckets []BucketSummary
+	index := make(map[string]int)
+	for start := bucketStart(dr.Start, granularity); !start.After(lastDay); start = nextBucket(start, granularity) {
+		end := nextBucket(start, granularity).AddDate(0, 0, -1)
+
+		// Clip the first and last bucket to the requested range
+		clippedStart, clippedEnd := start, end
+		if clippedStart.Before(dr.Start) {
+			clippedStart = dr.Start
+		}
+		if clippedEnd.After(lastDay) {
+			clippedEnd = lastDay
+		}
+
+		index[start.Format(isoDateLayout)] = len(buckets)
+		buckets = append(buckets, BucketSummary{
+			Start: clippedStart.Format(isoDateLayout),
+			End:   clippedEnd.Format(isoDateLayout),
+		})
+	}
+
+	for _, stat := range stats {
+		// Documents store their day as "January 2, 2006"
+		day, err := time.ParseInLocation("January 2, 2006", stat.Date, loc)
+		if err != nil {
+			continue
+		}
+		i, ok := index[bucketStart(day, granularity).Format(isoDateLayout)]
+		if !ok {
+			continue
+		}
+		buckets[i].GrandTotal += stat.GrandTotal
+		buckets[i].TotalLow += stat.TotalLow
+		buckets[i].TotalMedium += stat.TotalMedium
+		buckets[i].TotalHigh += stat.TotalHigh
 	}
-}
\ No newline at end of file
+
+	return buckets
+}
@@ -0,0 +1,101 @@
+package statistic
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go-gin-project/internal/models"
+)
+
+// testStat returns a daily document of an ISO date with total flagged detections, all of them low
+func testStat(t *testing.T, iso string, total int) models.StatisticDocument {
+	t.Helper()
+	return models.StatisticDocument{
+		Date:       testDay(t, iso).Format("January 2, 2006"),
+		Day:        iso,
+		GrandTotal: total,
+		TotalLow:   total,
+	}
+}
+
+func TestBuildBuckets(t *testing.T) {
+	custom := func(from, to string) dateRange {
+		return dateRange{Period: customPeriod, Start: testDay(t, from), End: testDay(t, to)}
+	}
+	bucket := func(start, end string, total int) BucketSummary {
+		return BucketSummary{Start: start, End: end, GrandTotal: total, TotalLow: total}
+	}
+
+	tests := []struct {
+		name        string
+		dr          dateRange
+		granularity string
+		stats       []models.StatisticDocument
+		want        []BucketSummary
+	}{
+		{
+			name:        "days are zero filled",
+			dr:          custom("2025-10-01", "2025-10-03"),
+			granularity: GranularityDay,
+			stats:       []models.StatisticDocument{testStat(t, "2025-10-02", 4)},
+			want:        []BucketSummary{bucket("2025-10-01", "2025-10-01", 0), bucket("2025-10-02", "2025-10-02", 4), bucket("2025-10-03", "2025-10-03", 0)},
+		},
+		{
+			name:        "weeks start on Monday and clip to the range",
+			dr:          custom("2025-10-01", "2025-10-14"), // Wednesday to Tuesday
+			granularity: GranularityWeek,
+			stats: []models.StatisticDocument{
+				testStat(t, "2025-10-01", 1),
+				testStat(t, "2025-10-05", 2), // Sunday, still the first week
+				testStat(t, "2025-10-06", 3),
+				testStat(t, "2025-10-14", 4),
+			},
+			want: []BucketSummary{bucket("2025-10-01", "2025-10-05", 3), bucket("2025-10-06", "2025-10-12", 3), bucket("2025-10-13", "2025-10-14", 4)},
+		},
+		{
+			name:        "months clip to the range",
+			dr:          custom("2024-01-15", "2024-03-10"),
+			granularity: GranularityMonth,
+			stats: []models.StatisticDocument{
+				testStat(t, "2024-01-31", 1),
+				testStat(t, "2024-02-29", 2), // Leap day
+				testStat(t, "2024-03-10", 3),
+			},
+			want: []BucketSummary{bucket("2024-01-15", "2024-01-31", 1), bucket("2024-02-01", "2024-02-29", 2), bucket("2024-03-01", "2024-03-10", 3)},
+		},
+		{
+			name:        "range within one week",
+			dr:          custom("2025-10-14", "2025-10-16"),
+			granularity: GranularityWeek,
+			stats:       []models.StatisticDocument{testStat(t, "2025-10-15", 2)},
+			want:        []BucketSummary{bucket("2025-10-14", "2025-10-16", 2)},
+		},
+		{
+			name:        "preset ends now",
+			dr:          dateRange{Period: "7days", Start: testDay(t, "2025-10-09"), End: time.Date(2025, 10, 15, 14, 30, 0, 0, testLoc)},
+			granularity: GranularityWeek,
+			stats:       []models.StatisticDocument{testStat(t, "2025-10-15", 5)},
+			want:        []BucketSummary{bucket("2025-10-09", "2025-10-12", 0), bucket("2025-10-13", "2025-10-15", 5)},
+		},
+		{
+			name:        "documents outside the range or unparsable are skipped",
+			dr:          custom("2025-10-01", "2025-10-02"),
+			granularity: GranularityMonth,
+			stats: []models.StatisticDocument{
+				testStat(t, "2025-09-30", 7),
+				{Date: "2025-10-01", GrandTotal: 7, TotalLow: 7},
+				testStat(t, "2025-10-02", 1),
+			},
+			want: []BucketSummary{bucket("2025-10-01", "2025-10-02", 1)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := buildBuckets(tt.stats, tt.dr, tt.granularity); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
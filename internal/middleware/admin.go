@@ -0,0 +1,24 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminClaim is the Firebase custom claim that grants access to admin routes, set with
+// authClient.SetCustomUserClaims(ctx, uid, map[string]interface{}{"admin": true})
+const AdminClaim = "admin"
+
+// RequireAdmin rejects callers without the admin claim. It must run after AuthMiddleware.
+func RequireAdmin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !CurrentIdentity(c).IsAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
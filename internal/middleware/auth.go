@@ -27,15 +27,56 @@ func AuthMiddleware(authClient *auth.Client) gin.HandlerFunc {
 			return
 		}
 
-		// Set user info in context
-		c.Set("uid", token.UID)
+		// Set user info in context. Only the UID is guaranteed: phone, anonymous and
+		// custom-token sign-ins carry no email claim.
+		identity := Identity{
+			UID:            token.UID,
+			SignInProvider: token.Firebase.SignInProvider,
+		}
 		if email, ok := token.Claims["email"].(string); ok {
-			c.Set("email", email)
+			identity.Email = email
 		}
 		if isVerified, ok := token.Claims["email_verified"].(bool); ok {
-			c.Set("is_verified", isVerified)
+			identity.IsVerified = isVerified
+		}
+		if isAdmin, ok := token.Claims[AdminClaim].(bool); ok {
+			identity.IsAdmin = isAdmin
+		}
+
+		c.Set(identityKey, identity)
+		c.Set("uid", identity.UID)
+		c.Set("is_verified", identity.IsVerified)
+		if identity.Email != "" {
+			c.Set("email", identity.Email)
 		}
 
 		c.Next()
 	}
 }
+
+// identityKey is the context key holding the Identity of the authenticated caller
+const identityKey = "identity"
+
+// Identity describes the authenticated caller. UID is always set, every other field is optional.
+type Identity struct {
+	UID            string
+	Email          string // Empty for phone, anonymous and custom-token sign-in
+	IsVerified     bool
+	SignInProvider string // Firebase sign_in_provider, e.g. "password", "phone", "anonymous", "custom"
+	IsAdmin        bool   // Set by the AdminClaim custom claim
+}
+
+// IsAnonymous reports whether the caller signed in anonymously
+func (i Identity) IsAnonymous() bool {
+	return i.SignInProvider == "anonymous"
+}
+
+// CurrentIdentity returns the identity set by AuthMiddleware, or a zero Identity outside protected routes
+func CurrentIdentity(c *gin.Context) Identity {
+	if value, ok := c.Get(identityKey); ok {
+		if identity, ok := value.(Identity); ok {
+			return identity
+		}
+	}
+	return Identity{UID: c.GetString("uid"), Email: c.GetString("email"), IsVerified: c.GetBool("is_verified")}
+}
@@ -1,10 +1,28 @@
 package models
 
+import "time"
+
 // DetectionResult represents a single detection result from the API
 type DetectionResult struct {
-	Box   []int   `json:"box"`
+	Box   []int   `json:"box"` // [x, y, width, height] in pixels
 	Class string  `json:"class"`
 	Score float64 `json:"score"`
+
+	// Box as fractions of the image, set when the image size is known
+	NormalizedBox *NormalizedBox `json:"normalized_box,omitempty"`
+}
+
+// NormalizedBox is a bounding box relative to the image, every value is between 0 and 1
+type NormalizedBox struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// Area returns the fraction of the image covered by the box
+func (b NormalizedBox) Area() float64 {
+	return b.Width * b.Height
 }
 
 // APIResponse represents the response from the external NSFW detection API
@@ -12,23 +30,87 @@ type APIResponse struct {
 	Filename string            `json:"filename"`
 	Results  []DetectionResult `json:"results"`
 	Status   string            `json:"status"`
+
+	// Cached is set when the results come from the detection cache instead of the detector
+	Cached bool `json:"-"`
+	// Upright is set when the boxes are in the EXIF-oriented coordinates of the upload rather than
+	// its stored pixels, because the image was re-oriented before detection
+	Upright bool `json:"-"`
 }
 
 // StatisticDocument represents the document structure for statistics collection
 type StatisticDocument struct {
 	UserID      string                    `firestore:"userId"`
 	Date        string                    `firestore:"date"`
+	Day         string                    `firestore:"day,omitempty"` // YYYY-MM-DD in the user's timezone
 	GrandTotal  int                       `firestore:"grandTotal"`
 	TotalLow    int                       `firestore:"totalLow"`
 	TotalMedium int                       `firestore:"totalMedium"`
 	TotalHigh   int                       `firestore:"totalHigh"`
 	AppCounts   map[string]AppStatCounter `firestore:"appCounts"`
+	HourCounts  map[string]AppStatCounter `firestore:"hourCounts,omitempty"` // Keyed "00".."23", local hour of the detection
 }
 
-// AppStatCounter represents counter for each application
+// AppStatCounter represents counter for each application (also used for each hour of the day)
 type AppStatCounter struct {
 	Total  int `firestore:"total"`
 	Low    int `firestore:"low"`
 	Medium int `firestore:"medium"`
 	High   int `firestore:"high"`
 }
+
+// ClassScore is a detected class with its confidence score
+type ClassScore struct {
+	Class string  `firestore:"class" json:"class"`
+	Score float64 `firestore:"score" json:"score"`
+}
+
+// ClassMeasures are the combined detections of one class, the values classification rules compare.
+// Boxes below the class min_area of the policy that classified the event are already left out.
+type ClassMeasures struct {
+	Class        string  `firestore:"class"`
+	MaxScore     float64 `firestore:"maxScore"`
+	MinScore     float64 `firestore:"minScore"`
+	Count        int     `firestore:"count"`
+	Area         float64 `firestore:"area"`         // Summed box area as a fraction of the image
+	MaxArea      float64 `firestore:"maxArea"`      // Largest single box as a fraction of the image
+	CenterOffset float64 `firestore:"centerOffset"` // Most central box, 0 = centre, 1 = corner
+	HasBox       bool    `firestore:"hasBox"`
+}
+
+// DetectionEvent is one classified detection in the events collection. Image bytes are never stored.
+type DetectionEvent struct {
+	UserID            string          `firestore:"userId"`
+	Timestamp         time.Time       `firestore:"timestamp"`
+	Day               string          `firestore:"day"`      // YYYY-MM-DD in the user's timezone
+	Timezone          string          `firestore:"timezone"` // IANA name used to compute Day
+	Application       string          `firestore:"application"`
+	Level             int             `firestore:"level"`
+	TopClasses        []ClassScore    `firestore:"topClasses"`        // Highest scoring classes first
+	Classes           []ClassMeasures `firestore:"classes,omitempty"` // What the classifier read, absent on events logged before it was stored
+	ClassifierVersion string          `firestore:"classifierVersion"`
+	Rule              string          `firestore:"rule,omitempty"`         // Policy rule that decided Level
+	Profile           string          `firestore:"profile,omitempty"`      // Sensitivity profile applied
+	ShadowLevels      map[string]int  `firestore:"shadowLevels,omitempty"` // Level per candidate policy version, never returned to clients
+	Device            string          `firestore:"device,omitempty"`
+}
+
+// AppPolicy overrides classification for one application, stored in the app_policies collection
+// with the lower-cased application name as document ID
+type AppPolicy struct {
+	Application    string             `firestore:"application" json:"application"`
+	IgnoredClasses []string           `firestore:"ignoredClasses" json:"ignored_classes"` // Detections of these classes are dropped before classification
+	Scales         *SensitivityScales `firestore:"scales" json:"scales"`                  // Multiplied with the user's sensitivity scales
+	Escalate       int                `firestore:"escalate" json:"escalate"`              // Levels added to every flagged (level > 0) decision
+	UpdatedAt      time.Time          `firestore:"updatedAt" json:"updated_at"`
+	UpdatedBy      string             `firestore:"updatedBy" json:"updated_by"`
+}
+
+// ShadowStatDocument is one shard of the disagreement counters between the active and a candidate policy
+type ShadowStatDocument struct {
+	ActiveVersion    string                    `firestore:"activeVersion"`
+	CandidateVersion string                    `firestore:"candidateVersion"`
+	Total            int                       `firestore:"total"`
+	Agree            int                       `firestore:"agree"`
+	Matrix           map[string]map[string]int `firestore:"matrix"` // Active level -> candidate level -> count
+}
@@ -3,18 +3,46 @@ package models
 
 // ... ProfileResponse yang sudah ada
 type ProfileResponse struct {
-	Message    string `json:"message"`
-	UserID     string `json:"user_id"`
-	Email      string `json:"email"`
-	DisplayName string `json:"display_name,omitempty"` // Tambahkan displayName
-	IsVerified bool   `json:"is_verified"`
-	Gender     string `json:"gender,omitempty"` // Tambahkan gender dan age
-	Age        int    `json:"age,omitempty"`
+	Message        string `json:"message"`
+	UserID         string `json:"user_id"`
+	Email          string `json:"email"`
+	PhoneNumber    string `json:"phone_number,omitempty"`
+	DisplayName    string `json:"display_name,omitempty"` // Tambahkan displayName
+	IsVerified     bool   `json:"is_verified"`
+	IsAnonymous    bool   `json:"is_anonymous"`
+	SignInProvider string `json:"sign_in_provider,omitempty"`
+	Gender         string `json:"gender,omitempty"` // Tambahkan gender dan age
+	Age            int    `json:"age,omitempty"`
+	Timezone       string `json:"timezone,omitempty"` // IANA timezone untuk batas harian statistik
+	Sensitivity    string `json:"sensitivity"`        // Profil sensitivitas yang berlaku (tersimpan atau sesuai umur)
+	ParentUID      string `json:"parent_uid,omitempty"`
+	ParentLinked   bool   `json:"parent_linked"` // Orang tua sudah mengonfirmasi parent_uid
 }
 
 // Model untuk menyimpan data tambahan
 type UserDetails struct {
-	Gender string `json:"gender" binding:"required"`
-	Age    int    `json:"age" binding:"required"`
-	Email  string `json:"email"` // Simpan juga email untuk kemudahan query
+	Gender   string `json:"gender" binding:"required"`
+	Age      int    `json:"age" binding:"required"`
+	Timezone string `json:"timezone"` // Opsional, IANA timezone seperti "Asia/Jakarta"
+	Email    string `json:"email"`    // Simpan juga email untuk kemudahan query (opsional, kosong tanpa klaim email)
+
+	// Profil sensitivitas klasifikasi: strict, standard, relaxed atau custom. Kosong = sesuai umur
+	Sensitivity       string             `json:"sensitivity"`
+	CustomSensitivity *SensitivityScales `json:"custom_sensitivity"` // Wajib jika Sensitivity = custom
+	ParentUID         string             `json:"parent_uid"`         // Akun orang tua yang mengatur profil sensitivitas akun anak
+	ParentConfirmed   bool               `json:"-"`                  // Diisi saat akun ParentUID mengonfirmasi, tidak bisa dikirim oleh anak
+}
+
+// HasParent reports whether the account is linked to a parent that confirmed the link. A parent_uid
+// the child saved on its own grants nothing until then.
+func (u UserDetails) HasParent() bool {
+	return u.ParentUID != "" && u.ParentConfirmed
+}
+
+// SensitivityScales multiplies the score thresholds of the policy rules per level.
+// Below 1 is stricter (rules fire at lower scores), above 1 is more relaxed, 0 means 1.
+type SensitivityScales struct {
+	Mild     float64 `json:"mild" yaml:"mild"`
+	Moderate float64 `json:"moderate" yaml:"moderate"`
+	High     float64 `json:"high" yaml:"high"`
 }
@@ -5,42 +5,108 @@ package routes
 import (
 	"github.com/gin-gonic/gin"
 
+	"go-gin-project/internal/handlers/apppolicy"
+	"go-gin-project/internal/handlers/detectioncache"
 	"go-gin-project/internal/handlers/detectnsfw"
+	"go-gin-project/internal/handlers/policyshadow"
 	"go-gin-project/internal/handlers/profile"
 	"go-gin-project/internal/handlers/statistic"
 	"go-gin-project/internal/middleware"
+	"go-gin-project/internal/services"
 
 	"cloud.google.com/go/firestore"
 	"firebase.google.com/go/v4/auth"
 )
 
+// Deps holds the clients, policies and settings the routes are wired with
+type Deps struct {
+	AuthClient *auth.Client
+	DB         *firestore.Client
+	Detector   services.Detector
+	Cache      *services.CachingDetector // The cache layer of Detector, reported on the admin routes
+	Policy     *services.Policy
+	Shadows    []*services.Policy  // Candidate policies classified in the shadow of Policy
+	Jobs       *services.JobRunner // nil when async mode is disabled
+	Limits     services.UploadLimits
+	Redact     services.RedactConfig
+	Batch      detectnsfw.BatchConfig
+	Media      detectnsfw.MediaConfig
+}
+
 // SetupRoutes configures all routes for the application
-func SetupRoutes(router *gin.Engine, authClient *auth.Client, db *firestore.Client) {
+func SetupRoutes(router *gin.Engine, deps Deps) {
+	detection := detectnsfw.Deps{
+		DB:       deps.DB,
+		Detector: deps.Detector,
+		Policy:   deps.Policy,
+		Shadows:  deps.Shadows,
+		Jobs:     deps.Jobs,
+		Limits:   deps.Limits,
+		Redact:   deps.Redact,
+		Batch:    deps.Batch,
+		Media:    deps.Media,
+	}
+
 	// Public routes
 	router.GET("/public", func(c *gin.Context) {
 		c.JSON(200, gin.H{"message": "This is a public endpoint"})
 	})
 
-	// Route untuk generate dummy statistik hari ini dengan email input (tidak perlu auth, hanya untuk dev)
-	router.POST("/api/statistic/dummy", statistic.GenerateTodayDummyStatisticHandler(db))
+	// Route untuk generate dummy statistik hari ini dengan userId input (tidak perlu auth, hanya untuk dev)
+	router.POST("/api/statistic/dummy", statistic.GenerateTodayDummyStatisticHandler(deps.DB))
 
 	// Route untuk generate dummy statistik historis (tidak perlu auth, hanya untuk dev)
-	router.POST("/api/statistic/dummy/historical", statistic.GenerateDummyStatisticHandler(db))
+	router.POST("/api/statistic/dummy/historical", statistic.GenerateDummyStatisticHandler(deps.DB))
 
 	// Protected routes
 	protected := router.Group("/api")
-	protected.Use(middleware.AuthMiddleware(authClient))
+	protected.Use(middleware.AuthMiddleware(deps.AuthClient))
 	{
 		// Endpoint lama untuk mendapatkan profil (akan kita update)
-		protected.GET("/profile", profile.ProfileHandler(authClient, db)) // Berikan authClient dan db client ke handler
+		protected.GET("/profile", profile.ProfileHandler(deps.AuthClient, deps.DB, deps.Policy)) // Berikan authClient dan db client ke handler
 
 		// Endpoint BARU untuk menyimpan detail gender dan usia
-		protected.POST("/profile/details", profile.SaveUserDetailsHandler(db))
+		protected.POST("/profile/details", profile.SaveUserDetailsHandler(deps.DB, deps.Policy))
+
+		// Endpoint untuk orang tua mengonfirmasi akun anak yang mengirim parent_uid
+		protected.POST("/profile/children/:uid/confirm", profile.ConfirmChildHandler(deps.DB, deps.Policy))
+
+		// Endpoint untuk orang tua memilih profil sensitivitas akun anak yang sudah dikonfirmasi
+		protected.PUT("/profile/children/:uid/sensitivity", profile.SetChildSensitivityHandler(deps.DB, deps.Policy))
 
 		// Endpoint untuk detect NSFW
-		protected.POST("/detectnsfw", detectnsfw.DetectNSFWHandler(db))
+		protected.POST("/detectnsfw", detectnsfw.DetectNSFWHandler(detection))
+
+		// Endpoint untuk polling status deteksi async (?async=true)
+		protected.GET("/detectnsfw/jobs/:id", detectnsfw.GetJobHandler(deps.Jobs))
+
+		// Endpoint untuk detect NSFW banyak gambar sekaligus (field "image" berulang)
+		protected.POST("/detectnsfw/batch", detectnsfw.DetectNSFWBatchHandler(detection))
+
+		// Endpoint untuk detect NSFW pada GIF/WebP animasi dan video pendek (per frame)
+		protected.POST("/detectnsfw/media", detectnsfw.DetectNSFWMediaHandler(detection))
 
 		// Endpoint untuk mendapatkan statistik berdasarkan periode
-		protected.GET("/statistics", statistic.GetStatisticHandler(db))
+		protected.GET("/statistics", statistic.GetStatisticHandler(deps.DB))
+
+		// Endpoint untuk heatmap 7x24 (hari x jam) dari deteksi pada periode tertentu
+		protected.GET("/statistics/heatmap", statistic.GetHeatmapHandler(deps.DB))
+	}
+
+	// Admin routes, butuh custom claim admin pada token
+	admin := protected.Group("/admin")
+	admin.Use(middleware.RequireAdmin())
+	{
+		// Override klasifikasi per aplikasi
+		admin.GET("/app-policies", apppolicy.ListAppPoliciesHandler(deps.DB))
+		admin.GET("/app-policies/:application", apppolicy.GetAppPolicyHandler(deps.DB))
+		admin.PUT("/app-policies/:application", apppolicy.PutAppPolicyHandler(deps.DB, deps.Policy))
+		admin.DELETE("/app-policies/:application", apppolicy.DeleteAppPolicyHandler(deps.DB))
+
+		// Matriks perbedaan level antara deps.Policy aktif dan deps.Policy kandidat (shadow)
+		admin.GET("/policy-shadows", policyshadow.ShadowReportHandler(deps.DB, deps.Policy, deps.Shadows))
+
+		// Hit rate cache hasil deteksi (perceptual hash)
+		admin.GET("/detection-cache", detectioncache.StatsHandler(deps.Cache))
 	}
 }
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-gin-project/internal/models"
+)
+
+// AppPolicyCollection is the Firestore collection holding per-application classification overrides
+const AppPolicyCollection = "app_policies"
+
+// ErrInvalidAppPolicy is returned when an application override fails validation
+var ErrInvalidAppPolicy = errors.New("invalid application policy")
+
+// AppPolicyID returns the document ID for an application, matching the appCounts key
+func AppPolicyID(application string) string {
+	return strings.ToLower(application)
+}
+
+// LoadAppPolicy returns the override for an application, or nil when it has none
+func LoadAppPolicy(ctx context.Context, db *firestore.Client, application string) (*models.AppPolicy, error) {
+	id := AppPolicyID(application)
+	if !validAppPolicyID(id) {
+		return nil, nil
+	}
+
+	doc, err := db.Collection(AppPolicyCollection).Doc(id).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load application policy %s: %w", id, err)
+	}
+
+	var appPolicy models.AppPolicy
+	if err := doc.DataTo(&appPolicy); err != nil {
+		return nil, fmt.Errorf("parse application policy %s: %w", id, err)
+	}
+	return &appPolicy, nil
+}
+
+// ValidateAppPolicy checks an application override against the classification policy
+func (p *Policy) ValidateAppPolicy(appPolicy models.AppPolicy) error {
+	if !validAppPolicyID(AppPolicyID(appPolicy.Application)) {
+		return fmt.Errorf("%w: application name must not be empty or contain '/'", ErrInvalidAppPolicy)
+	}
+	for _, class := range appPolicy.IgnoredClasses {
+		if _, ok := p.Classes[class]; !ok {
+			return fmt.Errorf("%w: ignored class %s is not declared in policy %s", ErrInvalidAppPolicy, class, p.Version)
+		}
+	}
+	if appPolicy.Scales != nil {
+		if err := validateScales(*appPolicy.Scales); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidAppPolicy, err)
+		}
+	}
+	if appPolicy.Escalate < 0 || appPolicy.Escalate > 2 {
+		return fmt.Errorf("%w: escalate must be between 0 and 2", ErrInvalidAppPolicy)
+	}
+	return nil
+}
+
+// validAppPolicyID reports whether id can be used as a Firestore document ID
+func validAppPolicyID(id string) bool {
+	return id != "" && id != "." && id != ".." && !strings.Contains(id, "/")
+}
+
+// appOverride is the part of an application policy the classifier applies
+type appOverride struct {
+	name     string
+	ignored  map[string]bool
+	scales   models.SensitivityScales
+	escalate int
+}
+
+// newAppOverride prepares an application policy for classification, nil means no override
+func newAppOverride(appPolicy *models.AppPolicy) *appOverride {
+	if appPolicy == nil {
+		return nil
+	}
+	override := &appOverride{
+		name:     AppPolicyID(appPolicy.Application),
+		ignored:  make(map[string]bool, len(appPolicy.IgnoredClasses)),
+		escalate: appPolicy.Escalate,
+	}
+	for _, class := range appPolicy.IgnoredClasses {
+		override.ignored[class] = true
+	}
+	if appPolicy.Scales != nil {
+		override.scales = *appPolicy.Scales
+	}
+	return override
+}
+
+// filter drops the aggregates of ignored classes
+func (o *appOverride) filter(classes map[string]*classAggregate) map[string]*classAggregate {
+	if o == nil || len(o.ignored) == 0 {
+		return classes
+	}
+	kept := make(map[string]*classAggregate, len(classes))
+	for class, agg := range classes {
+		if !o.ignored[class] {
+			kept[class] = agg
+		}
+	}
+	return kept
+}
+
+// scale returns the application's threshold multiplier for rules of the given level
+func (o *appOverride) scale(level int) float64 {
+	if o == nil {
+		return 1
+	}
+	return levelScale(o.scales, level)
+}
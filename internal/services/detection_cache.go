@@ -0,0 +1,376 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-gin-project/internal/models"
+)
+
+// DetectionCacheCollection is the Firestore collection holding cached detector results by upload digest
+const DetectionCacheCollection = "detection_cache"
+
+// DetectionCache stores raw detector results by upload. Classification is not cached, it depends on
+// the caller's sensitivity and application.
+type DetectionCache interface {
+	Get(ctx context.Context, key DetectionKey) (CachedDetection, bool, error)
+	Set(ctx context.Context, key DetectionKey, cached CachedDetection) error
+}
+
+// DetectionKey identifies an upload in the detection cache. Exact hits need the same bytes: a
+// perceptual hash also matches an image that only gained a small region. The hash is only compared by
+// opt-in near lookups and is zero when they are off or the upload cannot be decoded.
+type DetectionKey struct {
+	Digest [sha256.Size]byte // sha256 of the uploaded bytes
+	Hash   PerceptualHash
+}
+
+// String returns the digest as hex, usable as a document ID
+func (k DetectionKey) String() string {
+	return hex.EncodeToString(k.Digest[:])
+}
+
+// CachedDetection is what the cache keeps of a detector response
+type CachedDetection struct {
+	Results []models.DetectionResult
+	Upright bool // See models.APIResponse.Upright
+}
+
+// MemoryDetectionCache is a DetectionCache in process memory. With a maxDistance above zero it also
+// answers for the nearest cached image of the same size within maxDistance hash bits, which catches
+// re-compressed copies but may hand a clean verdict to an image that differs in a small region, so near
+// matching is opt-in. Only upright results are near matched: the hash is taken upright, so a copy with
+// another EXIF orientation would get boxes in the wrong stored coordinates. Entries expire after ttl
+// and the least recently used one is evicted once maxEntries is reached.
+type MemoryDetectionCache struct {
+	ttl         time.Duration
+	maxEntries  int
+	maxDistance int
+
+	mu      sync.Mutex
+	order   *list.List // Front is the most recently used entry
+	entries map[[sha256.Size]byte]*list.Element
+	now     func() time.Time
+
+	// Near lookups split the hash into maxDistance+1 segments: a hash within maxDistance bits of
+	// another matches it exactly on at least one segment, so only the entries sharing a segment
+	// with the wanted hash are compared instead of the whole cache.
+	segments []hashMask                                     // Bit mask of each segment
+	buckets  map[hashSegment]map[[sha256.Size]byte]struct{} // Digests of the entries in each bucket
+}
+
+// hashMask selects bits of a PerceptualHash
+type hashMask [dHashSize * dHashSize / 64]uint64
+
+// hashSegment is the key of a near lookup bucket: the bits of one segment and the image size
+type hashSegment struct {
+	index         int
+	bits          hashMask // The hash bits under the segment mask
+	width, height int
+}
+
+// memoryCacheEntry is one element of the LRU list
+type memoryCacheEntry struct {
+	key       DetectionKey
+	cached    CachedDetection
+	expiresAt time.Time
+}
+
+// NewMemoryDetectionCache returns an empty cache keeping at most maxEntries results for ttl.
+// maxDistance zero only answers uploads with the same bytes.
+func NewMemoryDetectionCache(ttl time.Duration, maxEntries, maxDistance int) *MemoryDetectionCache {
+	c := &MemoryDetectionCache{
+		ttl:         ttl,
+		maxEntries:  maxEntries,
+		maxDistance: maxDistance,
+		order:       list.New(),
+		entries:     make(map[[sha256.Size]byte]*list.Element),
+		now:         time.Now,
+	}
+	if maxDistance > 0 {
+		c.segments = hashSegmentMasks(maxDistance + 1)
+		c.buckets = make(map[hashSegment]map[[sha256.Size]byte]struct{})
+	}
+	return c
+}
+
+// hashSegmentMasks splits the hash bits into n contiguous segments of nearly equal length
+func hashSegmentMasks(n int) []hashMask {
+	const total = dHashSize * dHashSize
+	n = min(n, total)
+	masks := make([]hashMask, n)
+	for i := range masks {
+		for bit := i * total / n; bit < (i+1)*total/n; bit++ {
+			masks[i][bit/64] |= 1 << (63 - bit%64)
+		}
+	}
+	return masks
+}
+
+// segment returns the bucket key of the i-th segment of hash
+func (c *MemoryDetectionCache) segment(hash PerceptualHash, i int) hashSegment {
+	key := hashSegment{index: i, width: hash.Width, height: hash.Height}
+	for w := range key.bits {
+		key.bits[w] = hash.Bits[w] & c.segments[i][w]
+	}
+	return key
+}
+
+// Get returns the cached results of the same upload or the nearest hash unless they expired
+func (c *MemoryDetectionCache) Get(ctx context.Context, key DetectionKey) (CachedDetection, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key.Digest]
+	if !ok && c.nearMatching() && key.Hash != (PerceptualHash{}) {
+		elem = c.nearest(key.Hash)
+	}
+	if elem == nil {
+		return CachedDetection{}, false, nil
+	}
+
+	entry := elem.Value.(*memoryCacheEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.remove(elem)
+		return CachedDetection{}, false, nil
+	}
+	c.order.MoveToFront(elem)
+	return CachedDetection{Results: copyResults(entry.cached.Results), Upright: entry.cached.Upright}, true, nil
+}
+
+// nearMatching reports whether lookups also answer for perceptually near images
+func (c *MemoryDetectionCache) nearMatching() bool {
+	return c.maxDistance > 0
+}
+
+// nearest returns the closest unexpired entry within maxDistance among those sharing a segment with
+// hash, or nil
+func (c *MemoryDetectionCache) nearest(hash PerceptualHash) *list.Element {
+	var best *list.Element
+	bestDistance := c.maxDistance + 1
+	now := c.now()
+	seen := make(map[[sha256.Size]byte]bool)
+	for i := range c.segments {
+		for digest := range c.buckets[c.segment(hash, i)] {
+			if seen[digest] {
+				continue
+			}
+			seen[digest] = true
+
+			elem := c.entries[digest]
+			entry := elem.Value.(*memoryCacheEntry)
+			distance := hash.Distance(entry.key.Hash)
+			if distance >= 0 && distance < bestDistance && now.Before(entry.expiresAt) {
+				best, bestDistance = elem, distance
+			}
+		}
+	}
+	return best
+}
+
+// Set stores cached under key, evicting the least recently used entries when full
+func (c *MemoryDetectionCache) Set(ctx context.Context, key DetectionKey, cached CachedDetection) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached.Results = copyResults(cached.Results)
+	entry := &memoryCacheEntry{key: key, cached: cached, expiresAt: c.now().Add(c.ttl)}
+	if elem, ok := c.entries[key.Digest]; ok {
+		c.remove(elem)
+	}
+
+	c.entries[key.Digest] = c.order.PushFront(entry)
+	if c.nearMatchable(entry) {
+		for i := range c.segments {
+			segment := c.segment(key.Hash, i)
+			if c.buckets[segment] == nil {
+				c.buckets[segment] = make(map[[sha256.Size]byte]struct{})
+			}
+			c.buckets[segment][key.Digest] = struct{}{}
+		}
+	}
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+	return nil
+}
+
+// nearMatchable reports whether entry may answer near lookups: it needs a hash, and boxes in the
+// upright coordinates the hash was taken in
+func (c *MemoryDetectionCache) nearMatchable(entry *memoryCacheEntry) bool {
+	return c.nearMatching() && entry.key.Hash != (PerceptualHash{}) && entry.cached.Upright
+}
+
+// remove drops an entry from the LRU list, the digest map and its near lookup buckets
+func (c *MemoryDetectionCache) remove(elem *list.Element) {
+	entry := elem.Value.(*memoryCacheEntry)
+	c.order.Remove(elem)
+	delete(c.entries, entry.key.Digest)
+	if !c.nearMatchable(entry) {
+		return
+	}
+	for i := range c.segments {
+		segment := c.segment(entry.key.Hash, i)
+		delete(c.buckets[segment], entry.key.Digest)
+		if len(c.buckets[segment]) == 0 {
+			delete(c.buckets, segment)
+		}
+	}
+}
+
+// Len returns the number of cached entries, expired ones included until they are looked up or evicted
+func (c *MemoryDetectionCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// detectionCacheDocument is one cached result in the detection_cache collection
+type detectionCacheDocument struct {
+	Results   []models.DetectionResult `firestore:"results"`
+	Upright   bool                     `firestore:"upright"`
+	ExpiresAt time.Time                `firestore:"expiresAt"` // Configure a Firestore TTL policy on this field to purge expired entries
+}
+
+// FirestoreDetectionCache is a DetectionCache shared by every instance. Documents are keyed by the
+// digest, so only uploads with the same bytes are found. Expired entries are ignored on read; deleting them and bounding
+// the collection is left to a Firestore TTL policy on expiresAt.
+type FirestoreDetectionCache struct {
+	db  *firestore.Client
+	ttl time.Duration
+}
+
+// NewFirestoreDetectionCache returns a cache keeping results for ttl in the detection_cache collection
+func NewFirestoreDetectionCache(db *firestore.Client, ttl time.Duration) *FirestoreDetectionCache {
+	return &FirestoreDetectionCache{db: db, ttl: ttl}
+}
+
+// Get returns the cached results of the upload unless they expired
+func (c *FirestoreDetectionCache) Get(ctx context.Context, key DetectionKey) (CachedDetection, bool, error) {
+	doc, err := c.db.Collection(DetectionCacheCollection).Doc(key.String()).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return CachedDetection{}, false, nil
+	}
+	if err != nil {
+		return CachedDetection{}, false, fmt.Errorf("load cached detection %s: %w", key, err)
+	}
+
+	var cached detectionCacheDocument
+	if err := doc.DataTo(&cached); err != nil {
+		return CachedDetection{}, false, fmt.Errorf("parse cached detection %s: %w", key, err)
+	}
+	if !time.Now().Before(cached.ExpiresAt) {
+		return CachedDetection{}, false, nil
+	}
+	return CachedDetection{Results: cached.Results, Upright: cached.Upright}, true, nil
+}
+
+// Set stores cached under the upload digest
+func (c *FirestoreDetectionCache) Set(ctx context.Context, key DetectionKey, cached CachedDetection) error {
+	document := detectionCacheDocument{Results: cached.Results, Upright: cached.Upright, ExpiresAt: time.Now().Add(c.ttl)}
+	if _, err := c.db.Collection(DetectionCacheCollection).Doc(key.String()).Set(ctx, document); err != nil {
+		return fmt.Errorf("store cached detection %s: %w", key, err)
+	}
+	return nil
+}
+
+// DetectionCacheStats are the hit-rate counters of a CachingDetector since the process started
+type DetectionCacheStats struct {
+	Backend string  `json:"backend"`
+	Hits    int64   `json:"hits"`
+	Misses  int64   `json:"misses"`
+	Skipped int64   `json:"skipped"` // Near matching was on but the image could not be hashed, only its bytes were looked up
+	Errors  int64   `json:"errors"`  // Cache reads or writes that failed
+	HitRate float64 `json:"hit_rate"`
+	Entries *int    `json:"entries,omitempty"` // Only known for the memory backend
+}
+
+// CachingDetector answers repeated images from a DetectionCache and only forwards new ones to next
+type CachingDetector struct {
+	next    Detector
+	cache   DetectionCache
+	backend string
+
+	hits, misses, skipped, errors atomic.Int64
+}
+
+// NewCachingDetector wraps next with cache; backend names the cache in the stats
+func NewCachingDetector(next Detector, cache DetectionCache, backend string) *CachingDetector {
+	return &CachingDetector{next: next, cache: cache, backend: backend}
+}
+
+// Detect returns the cached results for the same upload, or a perceptually near one when the cache
+// opts in, otherwise calls next and caches its answer. Cache failures are logged and never fail the
+// detection.
+func (d *CachingDetector) Detect(ctx context.Context, filename string, upload *Upload) (*models.APIResponse, error) {
+	key := DetectionKey{Digest: sha256.Sum256(upload.Data)}
+	// The hash costs a decode and a shrink, only near lookups need it
+	if memory, ok := d.cache.(*MemoryDetectionCache); ok && memory.nearMatching() {
+		if hash, ok := HashImage(upload); ok {
+			key.Hash = hash
+		} else {
+			d.skipped.Add(1)
+		}
+	}
+
+	cached, hit, err := d.cache.Get(ctx, key)
+	if err != nil {
+		d.errors.Add(1)
+		log.Printf("Error reading detection cache: %v\n", err)
+	}
+	if hit {
+		d.hits.Add(1)
+		return &models.APIResponse{Filename: filename, Results: cached.Results, Status: "success", Cached: true, Upright: cached.Upright}, nil
+	}
+	d.misses.Add(1)
+
+	resp, err := d.next.Detect(ctx, filename, upload)
+	if err != nil {
+		return nil, err
+	}
+	if err := d.cache.Set(ctx, key, CachedDetection{Results: resp.Results, Upright: resp.Upright}); err != nil {
+		d.errors.Add(1)
+		log.Printf("Error writing detection cache: %v\n", err)
+	}
+	return resp, nil
+}
+
+// Stats returns the hit-rate counters
+func (d *CachingDetector) Stats() DetectionCacheStats {
+	stats := DetectionCacheStats{
+		Backend: d.backend,
+		Hits:    d.hits.Load(),
+		Misses:  d.misses.Load(),
+		Skipped: d.skipped.Load(),
+		Errors:  d.errors.Load(),
+	}
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRate = float64(stats.Hits) / float64(lookups)
+	}
+	if memory, ok := d.cache.(*MemoryDetectionCache); ok {
+		entries := memory.Len()
+		stats.Entries = &entries
+	}
+	return stats
+}
+
+// copyResults copies the results so callers cannot modify cached entries
+func copyResults(results []models.DetectionResult) []models.DetectionResult {
+	out := make([]models.DetectionResult, len(results))
+	for i, r := range results {
+		out[i] = r
+		out[i].Box = append([]int(nil), r.Box...)
+	}
+	return out
+}
@@ -0,0 +1,318 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+	"time"
+
+	"go-gin-project/internal/models"
+)
+
+// testHash returns a 64x48 hash with the given bits set
+func testHash(bits ...int) PerceptualHash {
+	hash := PerceptualHash{Width: 64, Height: 48}
+	for _, bit := range bits {
+		hash.Bits[bit/64] |= 1 << (63 - bit%64)
+	}
+	return hash
+}
+
+// testKey returns the key of an upload whose hash has the given bits set, its digest differs per hash
+func testKey(bits ...int) DetectionKey {
+	hash := testHash(bits...)
+	return DetectionKey{Digest: sha256.Sum256([]byte(hash.String())), Hash: hash}
+}
+
+// testResults is a detector answer told apart by its class
+func testResults(class string) []models.DetectionResult {
+	return []models.DetectionResult{{Class: class, Score: 0.8, Box: []int{1, 2, 3, 4}}}
+}
+
+// testCached is an upright cache entry told apart by its class
+func testCached(class string) CachedDetection {
+	return CachedDetection{Results: testResults(class), Upright: true}
+}
+
+// checkCached looks key up and compares the class of the cached result, "" for a miss
+func checkCached(t *testing.T, c *MemoryDetectionCache, key DetectionKey, want string) {
+	t.Helper()
+
+	cached, ok, err := c.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	got := ""
+	if ok {
+		got = cached.Results[0].Class
+	}
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMemoryDetectionCacheLookups(t *testing.T) {
+	stored := testKey(0, 100, 200)
+	otherBytes := stored
+	otherBytes.Digest[0]++
+	otherSize := stored
+	otherSize.Digest[0]++
+	otherSize.Hash.Width = 65
+
+	tests := []struct {
+		name        string
+		maxDistance int
+		stored      CachedDetection
+		lookup      DetectionKey
+		want        string
+	}{
+		{name: "same bytes", lookup: stored, want: "stored"},
+		{name: "same bytes in stored coordinates", stored: CachedDetection{Results: testResults("stored")}, lookup: stored, want: "stored"},
+		{name: "same hash, other bytes", lookup: otherBytes, want: ""},
+		{name: "near matching is opt-in", lookup: testKey(0, 100), want: ""},
+		{name: "same hash near matched", maxDistance: 4, lookup: otherBytes, want: "stored"},
+		{name: "near hit", maxDistance: 4, lookup: testKey(0, 100, 200, 10, 20, 30), want: "stored"},
+		{name: "near hit at the distance", maxDistance: 4, lookup: testKey(100, 200, 1, 2, 255), want: "stored"},
+		{name: "beyond the distance", maxDistance: 4, lookup: testKey(1, 2, 3, 4, 5), want: ""},
+		{name: "other size", maxDistance: 4, lookup: otherSize, want: ""},
+		{name: "nearest of two", maxDistance: 8, lookup: testKey(0, 100, 201, 50), want: "near"},
+		{
+			// The hash is upright, boxes in stored coordinates only fit a copy with the same orientation
+			name:        "stored coordinates are not near matched",
+			maxDistance: 1,
+			stored:      CachedDetection{Results: testResults("stored")},
+			lookup:      otherBytes,
+			want:        "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.stored.Results == nil {
+				tt.stored = testCached("stored")
+			}
+			c := NewMemoryDetectionCache(time.Hour, 10, tt.maxDistance)
+			c.Set(context.Background(), stored, tt.stored)
+			c.Set(context.Background(), testKey(0, 100, 200, 201, 202), testCached("far"))
+			c.Set(context.Background(), testKey(0, 100, 200, 201, 202, 203, 204), testCached("farther"))
+			if tt.want == "near" {
+				c.Set(context.Background(), testKey(0, 100, 201), testCached("near"))
+			}
+			checkCached(t, c, tt.lookup, tt.want)
+		})
+	}
+}
+
+func TestMemoryDetectionCacheEviction(t *testing.T) {
+	c := NewMemoryDetectionCache(time.Hour, 2, 1)
+	first, second, third := testKey(0), testKey(64), testKey(128)
+	c.Set(context.Background(), first, testCached("first"))
+	c.Set(context.Background(), second, testCached("second"))
+
+	// Reading first makes second the least recently used
+	checkCached(t, c, first, "first")
+	c.Set(context.Background(), third, testCached("third"))
+
+	if c.Len() != 2 {
+		t.Errorf("got %d entries, want 2", c.Len())
+	}
+	checkCached(t, c, second, "")
+	checkCached(t, c, first, "first")
+	checkCached(t, c, third, "third")
+
+	// The evicted entry is gone from the near lookup buckets too
+	checkCached(t, c, testKey(64, 65), "")
+	if len(c.buckets) == 0 {
+		t.Fatal("no near lookup buckets")
+	}
+	for key, digests := range c.buckets {
+		for digest := range digests {
+			if digest == second.Digest {
+				t.Errorf("evicted entry still in bucket %d", key.index)
+			}
+		}
+	}
+}
+
+func TestMemoryDetectionCacheExpiry(t *testing.T) {
+	clock := newFakeClock()
+	c := NewMemoryDetectionCache(time.Hour, 10, 2)
+	c.now = clock.Now
+
+	key := testKey(7)
+	c.Set(context.Background(), key, testCached("cached"))
+
+	clock.Advance(time.Hour - time.Second)
+	checkCached(t, c, key, "cached")
+	checkCached(t, c, testKey(7, 8), "cached")
+
+	clock.Advance(time.Second)
+	checkCached(t, c, testKey(7, 8), "")
+	checkCached(t, c, key, "")
+	if c.Len() != 0 {
+		t.Errorf("expired entry kept, %d entries", c.Len())
+	}
+
+	// Setting again refreshes the expiry
+	c.Set(context.Background(), key, testCached("fresh"))
+	clock.Advance(30 * time.Minute)
+	checkCached(t, c, key, "fresh")
+}
+
+// testScreenshot returns a tall screenshot-like image: flat rows of UI with a few darker lines of text
+func testScreenshot(width, height int) *image.Gray {
+	img := image.NewGray(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			shade := uint8(240 - y*40/height)
+			if y%90 < 12 && x > 40 && x < width-40-(y/90%4)*60 {
+				shade = 60
+			}
+			img.SetGray(x, y, color.Gray{Y: shade})
+		}
+	}
+	return img
+}
+
+// withPhoto returns a copy of img with a size x size noisy photo pasted at x, y
+func withPhoto(img *image.Gray, x, y, size int) *image.Gray {
+	out := image.NewGray(img.Bounds())
+	copy(out.Pix, img.Pix)
+	seed := uint32(x*31 + y)
+	for py := y; py < y+size; py++ {
+		for px := x; px < x+size; px++ {
+			seed = seed*1664525 + 1013904223
+			out.SetGray(px, py, color.Gray{Y: uint8(seed >> 24)})
+		}
+	}
+	return out
+}
+
+func TestDHashSeesPastedPhoto(t *testing.T) {
+	screenshot := testScreenshot(540, 1200)
+	hash := DHash(screenshot)
+
+	// A photo of a ninth of the width, anywhere on the page, must change the hash
+	for y := 0; y+60 <= 1200; y += 97 {
+		for x := 0; x+60 <= 540; x += 83 {
+			if distance := hash.Distance(DHash(withPhoto(screenshot, x, y, 60))); distance == 0 {
+				t.Errorf("photo pasted at %d,%d left the hash unchanged", x, y)
+			}
+		}
+	}
+}
+
+func TestCachingDetector(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 40, 30))
+	for x := 0; x < 40; x++ {
+		for y := 0; y < 30; y++ {
+			img.SetGray(x, y, color.Gray{Y: uint8(x * y)})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	fake := NewFakeDetector(testResults("FACE_FEMALE")...)
+	d := NewCachingDetector(NewNormalizingDetector(fake, NormalizeConfig{}), NewMemoryDetectionCache(time.Hour, 10, 0), "memory")
+
+	for i, wantCached := range []bool{false, true} {
+		resp, err := d.Detect(context.Background(), "image.png", NewUpload(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("detect %d: %v", i, err)
+		}
+		if resp.Cached != wantCached || len(resp.Results) != 1 || resp.Results[0].Class != "FACE_FEMALE" {
+			t.Errorf("detect %d: got %+v, cached %v, want cached %v", i, resp.Results, resp.Cached, wantCached)
+		}
+		// A hit keeps the coordinate space of the boxes it was stored with
+		if !resp.Upright {
+			t.Errorf("detect %d: boxes not reported upright", i)
+		}
+	}
+	// Images that cannot be decoded are cached by their bytes
+	for range 2 {
+		if _, err := d.Detect(context.Background(), "broken.png", NewUpload([]byte("not an image"))); err != nil {
+			t.Fatalf("detect undecodable: %v", err)
+		}
+	}
+
+	if got := fake.CallCount(); got != 2 {
+		t.Errorf("detector called %d times, want 2", got)
+	}
+	stats := d.Stats()
+	if stats.Hits != 2 || stats.Misses != 2 || stats.Skipped != 0 || stats.HitRate != 0.5 || stats.Entries == nil || *stats.Entries != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+}
+
+func TestCachingDetectorMissesPastedPhoto(t *testing.T) {
+	encode := func(img image.Image) *Upload {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		return NewUpload(buf.Bytes())
+	}
+	screenshot := testScreenshot(540, 1200)
+
+	fake := NewFakeDetector()
+	fake.Results["chat.png"] = testResults("FACE_FEMALE")
+	fake.Results["chat-with-photo.png"] = testResults("FEMALE_BREAST_EXPOSED")
+	d := NewCachingDetector(fake, NewMemoryDetectionCache(time.Hour, 10, 0), "memory")
+
+	if _, err := d.Detect(context.Background(), "chat.png", encode(screenshot)); err != nil {
+		t.Fatalf("detect: %v", err)
+	}
+	resp, err := d.Detect(context.Background(), "chat-with-photo.png", encode(withPhoto(screenshot, 240, 600, 60)))
+	if err != nil {
+		t.Fatalf("detect: %v", err)
+	}
+	if resp.Cached || resp.Results[0].Class != "FEMALE_BREAST_EXPOSED" {
+		t.Errorf("pasted photo got the screenshot's detections: %+v, cached %v", resp.Results, resp.Cached)
+	}
+}
+
+func TestCachingDetectorOrientation(t *testing.T) {
+	// The same picture stored upright and stored rotated with an EXIF orientation to show it upright
+	upright := testImage(64, 48)
+	encode := func(img image.Image, orientation int) *Upload {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		return NewUpload(withOrientation(buf.Bytes(), orientation, binary.BigEndian))
+	}
+	plain, rotated := encode(upright, 1), encode(applyOrientation(upright, 8), 6)
+
+	// Without normalizing the detector answers in stored coordinates
+	fake := NewFakeDetector(testResults("FACE_FEMALE")...)
+	d := NewCachingDetector(fake, NewMemoryDetectionCache(time.Hour, 10, 32), "memory")
+	for _, upload := range []*Upload{plain, rotated} {
+		resp, err := d.Detect(context.Background(), "image.jpg", upload)
+		if err != nil {
+			t.Fatalf("detect: %v", err)
+		}
+		if resp.Cached {
+			t.Error("boxes in stored coordinates reused for another orientation")
+		}
+	}
+
+	// Upright answers fit every orientation
+	d = NewCachingDetector(NewNormalizingDetector(fake, NormalizeConfig{}), NewMemoryDetectionCache(time.Hour, 10, 32), "memory")
+	for i, upload := range []*Upload{plain, rotated} {
+		resp, err := d.Detect(context.Background(), "image.jpg", upload)
+		if err != nil {
+			t.Fatalf("detect: %v", err)
+		}
+		if resp.Cached != (i == 1) {
+			t.Errorf("detect %d: cached %v", i, resp.Cached)
+		}
+	}
+}
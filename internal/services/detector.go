@@ -0,0 +1,130 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"time"
+
+	"go-gin-project/internal/models"
+)
+
+// Detector forwards an upload to the NSFW detection backend and returns its raw detection results
+type Detector interface {
+	Detect(ctx context.Context, filename string, upload *Upload) (*models.APIResponse, error)
+}
+
+// ErrInvalidResponse is returned when the detector answers 2xx with a body that is not a valid detection result
+var ErrInvalidResponse = errors.New("invalid response from NSFW detector")
+
+// UpstreamStatusError is returned when the detector answers with a non-2xx status code
+type UpstreamStatusError struct {
+	StatusCode int
+	Body       string // First bytes of the response body, for logging
+}
+
+func (e *UpstreamStatusError) Error() string {
+	return fmt.Sprintf("NSFW detector returned status %d: %s", e.StatusCode, e.Body)
+}
+
+// maxErrorBodyLength caps how much of an upstream error page is kept in UpstreamStatusError
+const maxErrorBodyLength = 512
+
+// HTTPDetectorConfig holds the settings used to reach the external detection service
+type HTTPDetectorConfig struct {
+	URL        string        // Full URL of the detect endpoint
+	Timeout    time.Duration // Timeout for the whole upstream call, zero disables it
+	AuthHeader string        // Optional header name sent with every request (e.g. "Authorization")
+	AuthValue  string        // Value for AuthHeader
+	FieldName  string        // Multipart field name the detector reads the image from
+}
+
+// DefaultHTTPDetectorConfig returns the settings matching the local Python detector
+func DefaultHTTPDetectorConfig() HTTPDetectorConfig {
+	return HTTPDetectorConfig{
+		URL:       "http://127.0.0.1:5000/detect",
+		Timeout:   30 * time.Second,
+		FieldName: "image",
+	}
+}
+
+// HTTPDetector is a Detector that posts the image as multipart form data to an HTTP endpoint
+type HTTPDetector struct {
+	config HTTPDetectorConfig
+	client *http.Client
+}
+
+// NewHTTPDetector creates an HTTPDetector, filling empty config fields with defaults
+func NewHTTPDetector(config HTTPDetectorConfig) *HTTPDetector {
+	defaults := DefaultHTTPDetectorConfig()
+	if config.URL == "" {
+		config.URL = defaults.URL
+	}
+	if config.FieldName == "" {
+		config.FieldName = defaults.FieldName
+	}
+
+	return &HTTPDetector{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+}
+
+// Detect sends the upload bytes to the configured endpoint and parses the JSON response
+func (d *HTTPDetector) Detect(ctx context.Context, filename string, upload *Upload) (*models.APIResponse, error) {
+	// Build the multipart body expected by the detector
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile(d.config.FieldName, filename)
+	if err != nil {
+		return nil, fmt.Errorf("create form file: %w", err)
+	}
+	if _, err := part.Write(upload.Data); err != nil {
+		return nil, fmt.Errorf("write form file: %w", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("close multipart writer: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.config.URL, body)
+	if err != nil {
+		return nil, fmt.Errorf("create request: %w", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if d.config.AuthHeader != "" {
+		req.Header.Set(d.config.AuthHeader, d.config.AuthValue)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("forward request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %w", err)
+	}
+
+	// Surface upstream failures instead of trying to parse an error page as JSON
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		snippet := string(respBody)
+		if len(snippet) > maxErrorBodyLength {
+			snippet = snippet[:maxErrorBodyLength]
+		}
+		return nil, &UpstreamStatusError{StatusCode: resp.StatusCode, Body: snippet}
+	}
+
+	var apiResp models.APIResponse
+	if err := json.Unmarshal(respBody, &apiResp); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidResponse, err)
+	}
+
+	return &apiResp, nil
+}
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go-gin-project/internal/models"
+)
+
+// FakeDetector is an in-memory Detector for tests and local development without the Python service
+type FakeDetector struct {
+	mu sync.Mutex
+
+	// Results returned for every call, keyed by filename; Default is used when no entry matches
+	Results map[string][]models.DetectionResult
+	Default []models.DetectionResult
+
+	// Err, when set, is returned instead of a response
+	Err error
+
+	// Errs scripts the outcome of successive calls: call i returns Errs[i], a nil entry answers
+	// normally. Calls past the end of Errs fall back to Err.
+	Errs []error
+
+	// Delay is waited before answering, or until the context is done
+	Delay time.Duration
+
+	// Calls records the filenames passed to Detect in order
+	Calls []string
+}
+
+// NewFakeDetector creates a FakeDetector that answers every call with the given results
+func NewFakeDetector(results ...models.DetectionResult) *FakeDetector {
+	return &FakeDetector{
+		Results: make(map[string][]models.DetectionResult),
+		Default: results,
+	}
+}
+
+// Detect records the call and returns the configured results or error
+func (f *FakeDetector) Detect(ctx context.Context, filename string, upload *Upload) (*models.APIResponse, error) {
+	f.mu.Lock()
+	call := len(f.Calls)
+	f.Calls = append(f.Calls, filename)
+	err := f.Err
+	if call < len(f.Errs) {
+		err = f.Errs[call]
+	}
+	results, ok := f.Results[filename]
+	if !ok {
+		results = f.Default
+	}
+	delay := f.Delay
+	f.mu.Unlock()
+
+	if delay > 0 {
+		if err := sleepContext(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return &models.APIResponse{
+		Filename: filename,
+		Results:  append([]models.DetectionResult(nil), results...),
+		Status:   "success",
+	}, nil
+}
+
+// CallCount returns how many times Detect was called
+func (f *FakeDetector) CallCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.Calls)
+}
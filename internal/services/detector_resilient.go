@@ -0,0 +1,245 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"go-gin-project/internal/models"
+)
+
+// ResilienceConfig controls timeouts, retries and the circuit breaker around a Detector
+type ResilienceConfig struct {
+	AttemptTimeout time.Duration // Deadline for a single upstream call
+	MaxAttempts    int           // Total attempts including the first one
+	BaseBackoff    time.Duration // Backoff cap for the first retry, doubled for each following retry
+	MaxBackoff     time.Duration // Upper bound for the backoff cap
+
+	FailureThreshold int           // Consecutive failed calls that open the breaker
+	OpenDuration     time.Duration // How long the breaker stays open before a probe is allowed
+}
+
+// DefaultResilienceConfig returns conservative settings for the Python detector
+func DefaultResilienceConfig() ResilienceConfig {
+	return ResilienceConfig{
+		AttemptTimeout:   10 * time.Second,
+		MaxAttempts:      3,
+		BaseBackoff:      200 * time.Millisecond,
+		MaxBackoff:       2 * time.Second,
+		FailureThreshold: 5,
+		OpenDuration:     30 * time.Second,
+	}
+}
+
+// CircuitOpenError is returned without calling upstream while the circuit breaker is open
+type CircuitOpenError struct {
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("NSFW detector circuit open, retry after %s", e.RetryAfter)
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// ResilientDetector wraps a Detector with per-attempt timeouts, jittered retries and a circuit breaker
+type ResilientDetector struct {
+	next   Detector
+	config ResilienceConfig
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	now      func() time.Time
+}
+
+// NewResilientDetector wraps next, filling zero config fields with defaults
+func NewResilientDetector(next Detector, config ResilienceConfig) *ResilientDetector {
+	defaults := DefaultResilienceConfig()
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = defaults.MaxAttempts
+	}
+	if config.BaseBackoff <= 0 {
+		config.BaseBackoff = defaults.BaseBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaults.MaxBackoff
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = defaults.FailureThreshold
+	}
+	if config.OpenDuration <= 0 {
+		config.OpenDuration = defaults.OpenDuration
+	}
+
+	return &ResilientDetector{
+		next:   next,
+		config: config,
+		now:    time.Now,
+	}
+}
+
+// Detect calls the wrapped detector, retrying transient failures until the attempts run out
+func (d *ResilientDetector) Detect(ctx context.Context, filename string, upload *Upload) (*models.APIResponse, error) {
+	if err := d.allow(); err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < d.config.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, d.backoff(attempt)); err != nil {
+				break
+			}
+		}
+
+		resp, err := d.attempt(ctx, filename, upload)
+		if err == nil {
+			d.recordSuccess()
+			return resp, nil
+		}
+		lastErr = err
+
+		// Stop early when the caller gave up or retrying cannot help
+		if ctx.Err() != nil || !isRetryable(err) {
+			break
+		}
+		log.Printf("NSFW detector attempt %d/%d failed: %v\n", attempt+1, d.config.MaxAttempts, err)
+	}
+
+	// Only upstream failures count against the breaker, not the caller cancelling or a rejected image
+	switch {
+	case ctx.Err() != nil:
+		d.releaseProbe()
+	case countsAsFailure(lastErr):
+		d.recordFailure()
+	default:
+		d.recordSuccess()
+	}
+	return nil, lastErr
+}
+
+// attempt performs a single upstream call bounded by AttemptTimeout
+func (d *ResilientDetector) attempt(ctx context.Context, filename string, upload *Upload) (*models.APIResponse, error) {
+	if d.config.AttemptTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.config.AttemptTimeout)
+		defer cancel()
+	}
+	return d.next.Detect(ctx, filename, upload)
+}
+
+// backoff returns a full-jitter delay for the given retry number
+func (d *ResilientDetector) backoff(attempt int) time.Duration {
+	ceiling := d.config.BaseBackoff << (attempt - 1)
+	if ceiling <= 0 || ceiling > d.config.MaxBackoff {
+		ceiling = d.config.MaxBackoff
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// allow reports whether a call may go upstream, moving an expired open breaker to half-open
+func (d *ResilientDetector) allow() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	switch d.state {
+	case breakerOpen:
+		elapsed := d.now().Sub(d.openedAt)
+		if elapsed < d.config.OpenDuration {
+			return &CircuitOpenError{RetryAfter: d.config.OpenDuration - elapsed}
+		}
+		// Let a single probe through
+		d.state = breakerHalfOpen
+		return nil
+	case breakerHalfOpen:
+		// A probe is already in flight
+		return &CircuitOpenError{RetryAfter: time.Second}
+	}
+	return nil
+}
+
+func (d *ResilientDetector) recordSuccess() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.state = breakerClosed
+	d.failures = 0
+}
+
+// releaseProbe lets the next call probe again when a half-open probe was abandoned by its caller
+func (d *ResilientDetector) releaseProbe() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.state == breakerHalfOpen {
+		d.state = breakerOpen
+		d.openedAt = d.now().Add(-d.config.OpenDuration)
+	}
+}
+
+func (d *ResilientDetector) recordFailure() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.failures++
+	if d.state == breakerHalfOpen || d.failures >= d.config.FailureThreshold {
+		if d.state != breakerOpen {
+			log.Printf("NSFW detector circuit opened after %d consecutive failures\n", d.failures)
+		}
+		d.state = breakerOpen
+		d.openedAt = d.now()
+	}
+}
+
+// isRetryable reports whether another attempt may succeed where this one failed
+func isRetryable(err error) bool {
+	var statusErr *UpstreamStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, ErrInvalidResponse) {
+		return false
+	}
+	// Timeouts and connection errors
+	return true
+}
+
+// countsAsFailure reports whether err indicates an unhealthy detector rather than a bad request
+func countsAsFailure(err error) bool {
+	var statusErr *UpstreamStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	return err != nil
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
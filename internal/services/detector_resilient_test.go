@@ -0,0 +1,265 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fakeClock is a manually advanced time source for the circuit breaker
+type fakeClock struct {
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2025, 10, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// upstreamStatus returns the error the HTTP detector reports for a non-2xx status
+func upstreamStatus(code int) *UpstreamStatusError {
+	return &UpstreamStatusError{StatusCode: code}
+}
+
+// testResilienceConfig retries quickly so the tests do not sleep for real backoffs
+func testResilienceConfig() ResilienceConfig {
+	return ResilienceConfig{
+		AttemptTimeout:   time.Second,
+		MaxAttempts:      3,
+		BaseBackoff:      time.Millisecond,
+		MaxBackoff:       time.Millisecond,
+		FailureThreshold: 2,
+		OpenDuration:     30 * time.Second,
+	}
+}
+
+func TestResilientDetectorRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		errs      []error
+		delay     time.Duration
+		timeout   time.Duration
+		wantErr   error // nil for success; matched with errors.Is or by status code
+		wantCalls int
+	}{
+		{name: "success", wantCalls: 1},
+		{name: "retries 503 then succeeds", errs: []error{upstreamStatus(503), nil}, wantCalls: 2},
+		{name: "retries connection errors", errs: []error{errors.New("connection refused"), errors.New("connection reset"), nil}, wantCalls: 3},
+		{
+			name:      "gives up after max attempts",
+			errs:      []error{upstreamStatus(502), upstreamStatus(502), upstreamStatus(502), nil},
+			wantErr:   upstreamStatus(502),
+			wantCalls: 3,
+		},
+		{name: "does not retry 400", errs: []error{upstreamStatus(400)}, wantErr: upstreamStatus(400), wantCalls: 1},
+		{name: "does not retry invalid responses", errs: []error{ErrInvalidResponse}, wantErr: ErrInvalidResponse, wantCalls: 1},
+		{
+			name:      "per-attempt timeout",
+			delay:     time.Second,
+			timeout:   10 * time.Millisecond,
+			wantErr:   context.DeadlineExceeded,
+			wantCalls: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := NewFakeDetector()
+			fake.Errs = tt.errs
+			fake.Delay = tt.delay
+
+			config := testResilienceConfig()
+			config.FailureThreshold = 10
+			if tt.timeout > 0 {
+				config.AttemptTimeout = tt.timeout
+			}
+			d := NewResilientDetector(fake, config)
+
+			resp, err := d.Detect(context.Background(), "image.jpg", nil)
+			checkDetectError(t, err, tt.wantErr)
+			if tt.wantErr == nil && resp == nil {
+				t.Fatal("got no response")
+			}
+			if got := fake.CallCount(); got != tt.wantCalls {
+				t.Errorf("got %d upstream calls, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestResilientDetectorStopsWhenCallerCancels(t *testing.T) {
+	fake := NewFakeDetector()
+	fake.Err = upstreamStatus(503)
+	d := NewResilientDetector(fake, testResilienceConfig())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.Detect(ctx, "image.jpg", nil); err == nil {
+		t.Fatal("got success, want the upstream error")
+	}
+	if got := fake.CallCount(); got != 1 {
+		t.Errorf("got %d upstream calls, want 1", got)
+	}
+	if d.state != breakerClosed || d.failures != 0 {
+		t.Errorf("a cancelled call counted against the breaker: state %d, failures %d", d.state, d.failures)
+	}
+}
+
+func TestResilientDetectorCircuitBreaker(t *testing.T) {
+	type step struct {
+		name       string
+		advance    time.Duration
+		err        error // Returned by the upstream for this call
+		wantErr    error
+		wantCalled bool // Whether the call reached the upstream
+		wantState  breakerState
+		retryAfter time.Duration // Expected CircuitOpenError.RetryAfter when the breaker rejects the call
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "opens after consecutive failures and closes after a good probe",
+			steps: []step{
+				{name: "first failure", err: upstreamStatus(503), wantErr: upstreamStatus(503), wantCalled: true, wantState: breakerClosed},
+				{name: "second failure opens", err: upstreamStatus(503), wantErr: upstreamStatus(503), wantCalled: true, wantState: breakerOpen},
+				{name: "rejected while open", wantErr: &CircuitOpenError{}, wantState: breakerOpen, retryAfter: 30 * time.Second},
+				{name: "still open", advance: 29 * time.Second, wantErr: &CircuitOpenError{}, wantState: breakerOpen, retryAfter: time.Second},
+				{name: "probe succeeds", advance: time.Second, wantCalled: true, wantState: breakerClosed},
+				{name: "closed again", wantCalled: true, wantState: breakerClosed},
+			},
+		},
+		{
+			name: "failed probe reopens for a full period",
+			steps: []step{
+				{name: "failure", err: upstreamStatus(500), wantErr: upstreamStatus(500), wantCalled: true, wantState: breakerClosed},
+				{name: "failure opens", err: upstreamStatus(500), wantErr: upstreamStatus(500), wantCalled: true, wantState: breakerOpen},
+				{name: "probe fails", advance: 30 * time.Second, err: upstreamStatus(500), wantErr: upstreamStatus(500), wantCalled: true, wantState: breakerOpen},
+				{name: "open from the failed probe", advance: 10 * time.Second, wantErr: &CircuitOpenError{}, wantState: breakerOpen, retryAfter: 20 * time.Second},
+				{name: "next probe succeeds", advance: 20 * time.Second, wantCalled: true, wantState: breakerClosed},
+			},
+		},
+		{
+			name: "success resets the failure count",
+			steps: []step{
+				{name: "failure", err: upstreamStatus(503), wantErr: upstreamStatus(503), wantCalled: true, wantState: breakerClosed},
+				{name: "success", wantCalled: true, wantState: breakerClosed},
+				{name: "failure", err: upstreamStatus(503), wantErr: upstreamStatus(503), wantCalled: true, wantState: breakerClosed},
+			},
+		},
+		{
+			name: "client errors do not open the breaker",
+			steps: []step{
+				{name: "400", err: upstreamStatus(400), wantErr: upstreamStatus(400), wantCalled: true, wantState: breakerClosed},
+				{name: "422", err: upstreamStatus(422), wantErr: upstreamStatus(422), wantCalled: true, wantState: breakerClosed},
+				{name: "413", err: upstreamStatus(413), wantErr: upstreamStatus(413), wantCalled: true, wantState: breakerClosed},
+			},
+		},
+		{
+			name: "429 counts as a failure",
+			steps: []step{
+				{name: "429", err: upstreamStatus(429), wantErr: upstreamStatus(429), wantCalled: true, wantState: breakerClosed},
+				{name: "429 opens", err: upstreamStatus(429), wantErr: upstreamStatus(429), wantCalled: true, wantState: breakerOpen},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			fake := NewFakeDetector()
+			config := testResilienceConfig()
+			config.MaxAttempts = 1
+			d := NewResilientDetector(fake, config)
+			d.now = clock.Now
+
+			for _, s := range tt.steps {
+				clock.Advance(s.advance)
+				before := fake.CallCount()
+				fake.Errs = append(make([]error, before), s.err)
+
+				_, err := d.Detect(context.Background(), "image.jpg", nil)
+				checkDetectError(t, err, s.wantErr)
+				if called := fake.CallCount() > before; called != s.wantCalled {
+					t.Errorf("%s: upstream called %v, want %v", s.name, called, s.wantCalled)
+				}
+				if d.state != s.wantState {
+					t.Errorf("%s: breaker state %d, want %d", s.name, d.state, s.wantState)
+				}
+				var openErr *CircuitOpenError
+				if s.retryAfter > 0 && errors.As(err, &openErr) && openErr.RetryAfter != s.retryAfter {
+					t.Errorf("%s: retry after %s, want %s", s.name, openErr.RetryAfter, s.retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestResilientDetectorHalfOpenProbe(t *testing.T) {
+	clock := newFakeClock()
+	fake := NewFakeDetector()
+	fake.Err = upstreamStatus(503)
+	config := testResilienceConfig()
+	config.MaxAttempts = 1
+	config.FailureThreshold = 1
+	d := NewResilientDetector(fake, config)
+	d.now = clock.Now
+
+	if _, err := d.Detect(context.Background(), "image.jpg", nil); err == nil {
+		t.Fatal("expected the failure to open the breaker")
+	}
+	clock.Advance(config.OpenDuration)
+
+	// Take the probe slot as an in-flight call would, every other caller is rejected meanwhile
+	if err := d.allow(); err != nil {
+		t.Fatalf("probe not allowed: %v", err)
+	}
+	var openErr *CircuitOpenError
+	if _, err := d.Detect(context.Background(), "image.jpg", nil); !errors.As(err, &openErr) {
+		t.Fatalf("got %v during the probe, want CircuitOpenError", err)
+	}
+
+	// A probe abandoned by its caller hands the slot to the next call
+	d.releaseProbe()
+	fake.Err = nil
+	if _, err := d.Detect(context.Background(), "image.jpg", nil); err != nil {
+		t.Fatalf("got %v after the probe was released, want success", err)
+	}
+	if d.state != breakerClosed {
+		t.Errorf("breaker state %d after a good probe, want closed", d.state)
+	}
+}
+
+// checkDetectError compares err with want: upstream status errors by code, CircuitOpenError by type,
+// everything else with errors.Is
+func checkDetectError(t *testing.T, err, want error) {
+	t.Helper()
+
+	var wantStatus *UpstreamStatusError
+	var wantOpen *CircuitOpenError
+	switch {
+	case want == nil:
+		if err != nil {
+			t.Fatalf("got error %v, want success", err)
+		}
+	case errors.As(want, &wantStatus):
+		var gotStatus *UpstreamStatusError
+		if !errors.As(err, &gotStatus) || gotStatus.StatusCode != wantStatus.StatusCode {
+			t.Fatalf("got %v, want upstream status %d", err, wantStatus.StatusCode)
+		}
+	case errors.As(want, &wantOpen):
+		var gotOpen *CircuitOpenError
+		if !errors.As(err, &gotOpen) {
+			t.Fatalf("got %v, want CircuitOpenError", err)
+		}
+	default:
+		if !errors.Is(err, want) {
+			t.Fatalf("got %v, want %v", err, want)
+		}
+	}
+}
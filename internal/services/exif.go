@@ -0,0 +1,123 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+)
+
+// exifOrientationTag is the TIFF tag holding the EXIF orientation (1-8)
+const exifOrientationTag = 0x0112
+
+// exifOrientation returns the EXIF orientation of a JPEG, 1 (upright) when it has none.
+// Only the APP1 segments before the image data are read.
+func exifOrientation(data []byte) int {
+	if !bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		return 1
+	}
+
+	for pos := 2; pos+4 <= len(data); {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		// Start of scan: no metadata follows
+		if marker == 0xDA {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation tag from the first IFD of a TIFF structure
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		// Entry: tag(2) type(2) count(4) value(4), a SHORT value sits in the first two value bytes
+		entry := ifd + 2 + 12*i
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			orientation := int(order.Uint16(tiff[entry+8:]))
+			if orientation < 1 || orientation > 8 {
+				return 1
+			}
+			return orientation
+		}
+	}
+	return 1
+}
+
+// orientedSize returns the size of the image once the orientation is applied; 5-8 swap the sides
+func orientedSize(size ImageSize, orientation int) ImageSize {
+	if orientation >= 5 {
+		return ImageSize{Width: size.Height, Height: size.Width}
+	}
+	return size
+}
+
+// applyOrientation returns img transformed according to an EXIF orientation value
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	src := image.NewRGBA(img.Bounds())
+	draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	size := orientedSize(ImageSize{Width: w, Height: h}, orientation)
+	dst := image.NewRGBA(image.Rect(0, 0, size.Width, size.Height))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // Rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // Mirrored along the main diagonal
+				dx, dy = y, x
+			case 6: // Rotated 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // Mirrored along the anti-diagonal
+				dx, dy = h-1-y, w-1-x
+			case 8: // Rotated 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			i, j := src.PixOffset(x+src.Rect.Min.X, y+src.Rect.Min.Y), dst.PixOffset(dx, dy)
+			copy(dst.Pix[j:j+4], src.Pix[i:i+4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,103 @@
+package services
+
+import (
+	"encoding/binary"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// withOrientation inserts an EXIF APP1 segment holding orientation right after the SOI marker of a JPEG
+func withOrientation(jpg []byte, orientation int, order binary.AppendByteOrder) []byte {
+	tiff := []byte("MM")
+	if order == binary.LittleEndian {
+		tiff = []byte("II")
+	}
+	tiff = order.AppendUint16(tiff, 42)
+	tiff = order.AppendUint32(tiff, 8) // First IFD right after the header
+	tiff = order.AppendUint16(tiff, 1) // One entry
+	tiff = order.AppendUint16(tiff, exifOrientationTag)
+	tiff = order.AppendUint16(tiff, 3) // SHORT
+	tiff = order.AppendUint32(tiff, 1)
+	tiff = order.AppendUint16(tiff, uint16(orientation))
+	tiff = append(tiff, 0, 0)
+	tiff = order.AppendUint32(tiff, 0) // No next IFD
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(2+len(segment)))
+	app1 = append(app1, segment...)
+
+	out := append([]byte{0xFF, 0xD8}, app1...)
+	return append(out, jpg[2:]...)
+}
+
+func TestExifOrientation(t *testing.T) {
+	jpg := testJPEG(t, 8, 4)
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		for _, order := range []binary.AppendByteOrder{binary.BigEndian, binary.LittleEndian} {
+			if got := exifOrientation(withOrientation(jpg, orientation, order)); got != orientation {
+				t.Errorf("orientation %d (%s): got %d", orientation, order, got)
+			}
+		}
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "no exif", data: jpg},
+		{name: "out of range", data: withOrientation(jpg, 9, binary.BigEndian)},
+		{name: "zero", data: withOrientation(jpg, 0, binary.BigEndian)},
+		{name: "png", data: testPNG(t, 8, 4)},
+		{name: "truncated segment", data: withOrientation(jpg, 6, binary.BigEndian)[:20]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exifOrientation(tt.data); got != 1 {
+				t.Errorf("got %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// Stored pixels, each labelled by its red value:
+	//   A B C
+	//   D E F
+	const A, B, C, D, E, F = 10, 20, 30, 40, 50, 60
+	stored := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	for i, label := range []uint8{A, B, C, D, E, F} {
+		stored.Set(i%3, i/3, color.RGBA{R: label, A: 255})
+	}
+
+	// The image as displayed for each EXIF orientation, row by row
+	tests := []struct {
+		orientation int
+		want        [][]uint8
+	}{
+		{orientation: 1, want: [][]uint8{{A, B, C}, {D, E, F}}},
+		{orientation: 2, want: [][]uint8{{C, B, A}, {F, E, D}}},
+		{orientation: 3, want: [][]uint8{{F, E, D}, {C, B, A}}},
+		{orientation: 4, want: [][]uint8{{D, E, F}, {A, B, C}}},
+		{orientation: 5, want: [][]uint8{{A, D}, {B, E}, {C, F}}},
+		{orientation: 6, want: [][]uint8{{D, A}, {E, B}, {F, C}}},
+		{orientation: 7, want: [][]uint8{{F, C}, {E, B}, {D, A}}},
+		{orientation: 8, want: [][]uint8{{C, F}, {B, E}, {A, D}}},
+	}
+
+	for _, tt := range tests {
+		img := applyOrientation(stored, tt.orientation)
+		if img.Bounds() != image.Rect(0, 0, len(tt.want[0]), len(tt.want)) {
+			t.Errorf("orientation %d: bounds %v", tt.orientation, img.Bounds())
+			continue
+		}
+		for y, row := range tt.want {
+			for x, label := range row {
+				if r, _, _, _ := img.At(x, y).RGBA(); uint8(r>>8) != label {
+					t.Errorf("orientation %d: pixel %d,%d is %d, want %d", tt.orientation, x, y, r>>8, label)
+				}
+			}
+		}
+	}
+}
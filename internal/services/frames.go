@@ -0,0 +1,485 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"time"
+
+	"golang.org/x/image/riff"
+	"golang.org/x/image/vp8"
+	"golang.org/x/image/vp8l"
+	"golang.org/x/image/webp"
+)
+
+// Media kinds recognised by SampleFrames
+const (
+	MediaImage        = "image"
+	MediaAnimatedGIF  = "animated_gif"
+	MediaAnimatedWebP = "animated_webp"
+	MediaVideo        = "video"
+)
+
+const (
+	defaultFrameDelay  = 100 * time.Millisecond // Browsers show frames with a zero delay for about this long
+	frameJPEGQuality   = 90
+	webpANMFHeaderSize = 16 // Position, size, duration and flags before the frame chunks
+)
+
+var (
+	// ErrUnsupportedMedia is returned for uploads that are neither an image, an animation nor a video
+	ErrUnsupportedMedia = errors.New("unsupported media type")
+	// ErrVideoUnsupported is returned for video uploads when no ffmpeg binary is configured
+	ErrVideoUnsupported = errors.New("video decoding is not available")
+	// ErrInvalidMedia is returned when a recognised format fails to decode
+	ErrInvalidMedia = errors.New("invalid media")
+)
+
+// FrameConfig controls how frames are sampled from animations and videos
+type FrameConfig struct {
+	MaxFrames     int           // Frames sent to the detector per upload, spread evenly over the clip
+	FrameInterval time.Duration // Spacing of the frames ffmpeg extracts from a video before sampling
+	MaxDuration   time.Duration // Video beyond this point is not scanned
+	FFmpegPath    string        // ffmpeg binary used for video, empty disables video
+}
+
+// DefaultFrameConfig returns the sampling settings used when no environment override is set
+func DefaultFrameConfig() FrameConfig {
+	return FrameConfig{MaxFrames: 10, FrameInterval: time.Second, MaxDuration: time.Minute}
+}
+
+// Frame is one still sampled from an upload
+type Frame struct {
+	Index  int           // Position of the frame in the source, or the extracted frame number for video
+	Offset time.Duration // Time from the start of the clip the frame is shown
+	Image  *Upload       // Frame encoded for the detector
+}
+
+// MediaKind sniffs the upload and returns one of the Media* kinds, or "" when it is not recognised
+func MediaKind(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		// Counting the image descriptors is enough, the frames are decoded once by sampleGIF
+		if n, err := gifFrameCount(data); err == nil && n > 1 {
+			return MediaAnimatedGIF
+		}
+		return MediaImage
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		if isAnimatedWebP(data) {
+			return MediaAnimatedWebP
+		}
+		return MediaImage
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		// MP4, MOV, 3GP and the HEIF family share the ISO box layout, HEIF stills are images
+		switch string(data[8:12]) {
+		case "heic", "heix", "hevc", "mif1", "msf1", "avif":
+			return MediaImage
+		}
+		return MediaVideo
+	case bytes.HasPrefix(data, []byte{0x1A, 0x45, 0xDF, 0xA3}): // Matroska / WebM
+		return MediaVideo
+	}
+	if _, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		return MediaImage
+	}
+	return ""
+}
+
+// SampleFrames returns up to cfg.MaxFrames frames of the upload. Still images come back as a single
+// frame holding the upload itself; animations and videos are decoded and re-encoded as JPEG. Video
+// frames are shrunk to the image limits, ValidateMedia cannot see their size.
+func SampleFrames(ctx context.Context, upload *Upload, cfg FrameConfig, limits UploadLimits) (string, []Frame, error) {
+	data := upload.Data
+	kind := MediaKind(data)
+	var (
+		frames []Frame
+		err    error
+	)
+	switch kind {
+	case MediaImage:
+		frames = []Frame{{Image: upload}}
+	case MediaAnimatedGIF:
+		frames, err = sampleGIF(data, cfg.MaxFrames)
+	case MediaAnimatedWebP:
+		frames, err = sampleWebP(data, cfg.MaxFrames)
+	case MediaVideo:
+		frames, err = sampleVideo(ctx, data, cfg, limits)
+	default:
+		return "", nil, ErrUnsupportedMedia
+	}
+	return kind, frames, err
+}
+
+// sampleIndices picks at most n frames spread evenly over the timeline given by the frame delays
+func sampleIndices(delays []time.Duration, n int) []int {
+	if len(delays) <= n {
+		all := make([]int, len(delays))
+		for i := range all {
+			all[i] = i
+		}
+		return all
+	}
+
+	var total time.Duration
+	for _, d := range delays {
+		total += d
+	}
+
+	// The frame on screen at each of n evenly spaced instants
+	var picked []int
+	var start time.Duration
+	frame := 0
+	for k := 0; k < n; k++ {
+		at := total * time.Duration(k) / time.Duration(n)
+		for frame < len(delays)-1 && start+delays[frame] <= at {
+			start += delays[frame]
+			frame++
+		}
+		if len(picked) == 0 || picked[len(picked)-1] != frame {
+			picked = append(picked, frame)
+		}
+	}
+	return picked
+}
+
+// sampleGIF composites the GIF frames in order, honouring the disposal methods, and keeps the sampled ones
+func sampleGIF(data []byte, maxFrames int) ([]Frame, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMedia, err)
+	}
+
+	delays := make([]time.Duration, len(g.Image))
+	for i := range g.Image {
+		delays[i] = defaultFrameDelay
+		if i < len(g.Delay) && g.Delay[i] > 1 {
+			delays[i] = time.Duration(g.Delay[i]) * 10 * time.Millisecond
+		}
+	}
+
+	wanted := sampleIndices(delays, maxFrames)
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if bounds.Empty() {
+		bounds = g.Image[0].Bounds()
+	}
+	canvas := image.NewRGBA(bounds)
+
+	var frames []Frame
+	var offset time.Duration
+	for i, src := range g.Image {
+		if len(wanted) == 0 {
+			break
+		}
+
+		var previous *image.RGBA
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(bounds)
+			draw.Draw(previous, bounds, canvas, bounds.Min, draw.Src)
+		}
+
+		draw.Draw(canvas, src.Bounds(), src, src.Bounds().Min, draw.Over)
+		if wanted[0] == i {
+			encoded, err := encodeFrame(canvas)
+			if err != nil {
+				return nil, err
+			}
+			frames = append(frames, Frame{Index: i, Offset: offset, Image: NewUpload(encoded)})
+			wanted = wanted[1:]
+		}
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, src.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+		offset += delays[i]
+	}
+	return frames, nil
+}
+
+// gifFrameCount walks the GIF block structure and counts the image descriptors without decoding
+// any pixel data. A file ending without its trailer is counted up to where it stops.
+func gifFrameCount(data []byte) (int, error) {
+	const (
+		headerSize     = 6 + 7 // Signature, version and logical screen descriptor
+		descriptorSize = 1 + 9 // Separator, position, size and flags
+	)
+	if len(data) < headerSize {
+		return 0, errors.New("short gif header")
+	}
+
+	pos := headerSize
+	if flags := data[10]; flags&0x80 != 0 {
+		pos += 3 << (1 + flags&0x07) // Global color table
+	}
+
+	// skipSubBlocks moves past a chain of length-prefixed data blocks ended by an empty one
+	skipSubBlocks := func() bool {
+		for pos < len(data) {
+			n := int(data[pos])
+			pos += 1 + n
+			if n == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	frames := 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // Extension: introducer, label, sub-blocks
+			pos += 2
+			if !skipSubBlocks() {
+				return frames, nil
+			}
+		case 0x2C: // Image descriptor, optional local color table, LZW code size, sub-blocks
+			if pos+descriptorSize > len(data) {
+				return frames, nil
+			}
+			frames++
+			if flags := data[pos+9]; flags&0x80 != 0 {
+				pos += 3 << (1 + flags&0x07)
+			}
+			pos += descriptorSize + 1
+			if !skipSubBlocks() {
+				return frames, nil
+			}
+		case 0x3B: // Trailer
+			return frames, nil
+		default:
+			return frames, fmt.Errorf("unknown gif block 0x%02x", data[pos])
+		}
+	}
+	return frames, nil
+}
+
+// webpFrame is one ANMF chunk of an animated WebP
+type webpFrame struct {
+	x, y          int
+	width, height int
+	delay         time.Duration
+	dispose       bool // Clear the frame area to transparent before the next frame
+	blend         bool // Alpha-blend onto the canvas instead of replacing it
+	data          []byte
+}
+
+// isAnimatedWebP reports whether the extended header has the animation flag set
+func isAnimatedWebP(data []byte) bool {
+	const animationBit = 1 << 1
+	return len(data) >= 21 && string(data[12:16]) == "VP8X" && data[20]&animationBit != 0
+}
+
+// sampleWebP composites the frames of an animated WebP and keeps the sampled ones. The x/image decoder
+// only reads still images, so each ANMF payload is wrapped into a still WebP of its own first.
+func sampleWebP(data []byte, maxFrames int) ([]Frame, error) {
+	canvasW, canvasH, anim, err := parseAnimatedWebP(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMedia, err)
+	}
+	if len(anim) == 0 {
+		return nil, fmt.Errorf("%w: animated webp has no frames", ErrInvalidMedia)
+	}
+
+	delays := make([]time.Duration, len(anim))
+	for i, f := range anim {
+		delays[i] = f.delay
+	}
+
+	wanted := sampleIndices(delays, maxFrames)
+	canvas := image.NewRGBA(image.Rect(0, 0, canvasW, canvasH))
+
+	var frames []Frame
+	var offset time.Duration
+	for i, f := range anim {
+		if len(wanted) == 0 {
+			break
+		}
+
+		src, err := webp.Decode(bytes.NewReader(wrapWebPFrame(f)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: frame %d: %v", ErrInvalidMedia, i, err)
+		}
+
+		rect := image.Rect(f.x, f.y, f.x+f.width, f.y+f.height)
+		op := draw.Src
+		if f.blend {
+			op = draw.Over
+		}
+		draw.Draw(canvas, rect, src, src.Bounds().Min, op)
+
+		if wanted[0] == i {
+			encoded, err := encodeFrame(canvas)
+			if err != nil {
+				return nil, err
+			}
+			frames = append(frames, Frame{Index: i, Offset: offset, Image: NewUpload(encoded)})
+			wanted = wanted[1:]
+		}
+
+		if f.dispose {
+			draw.Draw(canvas, rect, image.Transparent, image.Point{}, draw.Src)
+		}
+		offset += delays[i]
+	}
+	return frames, nil
+}
+
+// parseAnimatedWebP reads the canvas size and the ANMF frames of an animated WebP
+func parseAnimatedWebP(data []byte) (width, height int, frames []webpFrame, err error) {
+	formType, r, err := riff.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if formType != (riff.FourCC{'W', 'E', 'B', 'P'}) {
+		return 0, 0, nil, errors.New("not a webp file")
+	}
+
+	for {
+		id, _, chunk, err := r.Next()
+		if err == io.EOF {
+			return width, height, frames, nil
+		}
+		if err != nil {
+			return 0, 0, nil, err
+		}
+
+		switch string(id[:]) {
+		case "VP8X":
+			buf := make([]byte, 10)
+			if _, err := io.ReadFull(chunk, buf); err != nil {
+				return 0, 0, nil, err
+			}
+			width, height = int(uint24(buf[4:]))+1, int(uint24(buf[7:]))+1
+		case "ANMF":
+			if width == 0 {
+				return 0, 0, nil, errors.New("ANMF chunk before the VP8X header")
+			}
+			payload, err := io.ReadAll(chunk)
+			if err != nil {
+				return 0, 0, nil, err
+			}
+			if len(payload) < webpANMFHeaderSize {
+				return 0, 0, nil, errors.New("short ANMF chunk")
+			}
+			frame := webpFrame{
+				x:       2 * int(uint24(payload[0:])),
+				y:       2 * int(uint24(payload[3:])),
+				width:   int(uint24(payload[6:])) + 1,
+				height:  int(uint24(payload[9:])) + 1,
+				delay:   time.Duration(uint24(payload[12:])) * time.Millisecond,
+				dispose: payload[15]&0x01 != 0,
+				blend:   payload[15]&0x02 == 0,
+				data:    payload[webpANMFHeaderSize:],
+			}
+			if frame.delay <= 0 {
+				frame.delay = defaultFrameDelay
+			}
+			// The decoder sizes a frame from its bitstream, so both the header and the bitstream must fit
+			if frame.x+frame.width > width || frame.y+frame.height > height {
+				return 0, 0, nil, fmt.Errorf("frame %d at %d,%d of %dx%d exceeds the %dx%d canvas", len(frames), frame.x, frame.y, frame.width, frame.height, width, height)
+			}
+			w, h, err := webpBitstreamSize(frame.data)
+			if err != nil {
+				return 0, 0, nil, fmt.Errorf("frame %d: %w", len(frames), err)
+			}
+			if w != frame.width || h != frame.height {
+				return 0, 0, nil, fmt.Errorf("frame %d announces %dx%d but holds %dx%d", len(frames), frame.width, frame.height, w, h)
+			}
+			frames = append(frames, frame)
+		}
+	}
+}
+
+// webpBitstreamSize reads the dimensions from the VP8 or VP8L chunk of an animation frame, skipping
+// the ALPH chunk that may precede it
+func webpBitstreamSize(data []byte) (width, height int, err error) {
+	for len(data) >= 8 {
+		id := string(data[0:4])
+		size := int(binary.LittleEndian.Uint32(data[4:8]))
+		if size > len(data)-8 {
+			return 0, 0, fmt.Errorf("%s chunk of %d bytes is truncated", id, size)
+		}
+		payload := data[8 : 8+size]
+
+		switch id {
+		case "VP8 ":
+			d := vp8.NewDecoder()
+			d.Init(bytes.NewReader(payload), len(payload))
+			fh, err := d.DecodeFrameHeader()
+			if err != nil {
+				return 0, 0, err
+			}
+			return fh.Width, fh.Height, nil
+		case "VP8L":
+			cfg, err := vp8l.DecodeConfig(bytes.NewReader(payload))
+			if err != nil {
+				return 0, 0, err
+			}
+			return cfg.Width, cfg.Height, nil
+		}
+		data = data[8+size+size%2:] // Chunks are padded to an even size
+	}
+	return 0, 0, errors.New("no VP8 or VP8L chunk")
+}
+
+// wrapWebPFrame builds a still WebP file from the ALPH/VP8/VP8L chunks of an animation frame.
+// Frames with an ALPH chunk need an extended header announcing the alpha channel.
+func wrapWebPFrame(f webpFrame) []byte {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	if bytes.HasPrefix(f.data, []byte("ALPH")) {
+		const alphaBit = 1 << 4
+		header := make([]byte, 10)
+		header[0] = alphaBit
+		putUint24(header[4:], uint32(f.width-1))
+		putUint24(header[7:], uint32(f.height-1))
+		body.WriteString("VP8X")
+		binary.Write(&body, binary.LittleEndian, uint32(len(header)))
+		body.Write(header)
+	}
+	body.Write(f.data)
+
+	var out bytes.Buffer
+	out.WriteString("RIFF")
+	binary.Write(&out, binary.LittleEndian, uint32(body.Len()))
+	out.Write(body.Bytes())
+	return out.Bytes()
+}
+
+// uint24 reads a little-endian 24-bit integer
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
+
+// putUint24 writes v as a little-endian 24-bit integer
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// encodeFrame encodes a composited frame as JPEG for the detector
+func encodeFrame(img image.Image) ([]byte, error) {
+	// JPEG has no alpha, transparent areas are flattened onto white like NormalizeImage does
+	flat := image.NewRGBA(img.Bounds())
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: frameJPEGQuality}); err != nil {
+		return nil, fmt.Errorf("encode frame: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,165 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"slices"
+	"testing"
+)
+
+// testGIF encodes an animation of n frames, every second one with a local color table
+func testGIF(t *testing.T, width, height, n int) []byte {
+	t.Helper()
+
+	g := &gif.GIF{Config: image.Config{Width: width, Height: height, ColorModel: color.Palette(palette.Plan9)}}
+	for i := 0; i < n; i++ {
+		p := color.Palette(palette.Plan9)
+		if i%2 == 1 {
+			p = color.Palette{color.White, color.Black}
+		}
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), p)
+		frame.SetColorIndex(i%width, 0, 1)
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("encode gif: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestGIFFrameCount(t *testing.T) {
+	for _, n := range []int{1, 2, 7} {
+		data := testGIF(t, 16, 8, n)
+		got, err := gifFrameCount(data)
+		if err != nil || got != n {
+			t.Errorf("%d frames: got %d, %v", n, got, err)
+		}
+	}
+
+	// Truncated files count the descriptors present
+	data := testGIF(t, 16, 8, 3)
+	if got, err := gifFrameCount(data[:len(data)-1]); err != nil || got != 3 {
+		t.Errorf("missing trailer: got %d, %v", got, err)
+	}
+
+	if kind := MediaKind(testGIF(t, 16, 8, 1)); kind != MediaImage {
+		t.Errorf("single frame gif is %q, want %q", kind, MediaImage)
+	}
+	if kind := MediaKind(testGIF(t, 16, 8, 2)); kind != MediaAnimatedGIF {
+		t.Errorf("two frame gif is %q, want %q", kind, MediaAnimatedGIF)
+	}
+}
+
+// testWebPFrame is one ANMF chunk of testAnimatedWebP: its position and announced size, and the size
+// written in its VP8L bitstream header
+type testWebPFrame struct {
+	x, y, width, height int
+	bitstreamW          int
+	bitstreamH          int
+}
+
+// testAnimatedWebP builds an animated WebP whose frames only carry a VP8L header, enough for the checks
+// that run before decoding
+func testAnimatedWebP(canvasW, canvasH int, frames ...testWebPFrame) []byte {
+	chunk := func(id string, payload []byte) []byte {
+		out := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+		out = append(out, payload...)
+		if len(payload)%2 == 1 {
+			out = append(out, 0)
+		}
+		return out
+	}
+	uint24 := func(v int) []byte { return []byte{byte(v), byte(v >> 8), byte(v >> 16)} }
+
+	vp8x := make([]byte, 4, 10)
+	vp8x[0] = 1 << 1 // Animation
+	vp8x = append(append(vp8x, uint24(canvasW-1)...), uint24(canvasH-1)...)
+
+	body := append([]byte("WEBP"), chunk("VP8X", vp8x)...)
+	body = append(body, chunk("ANIM", make([]byte, 6))...)
+	for _, f := range frames {
+		// Signature, then 14 bits width-1, 14 bits height-1, alpha and version
+		bits := uint32(f.bitstreamW-1) | uint32(f.bitstreamH-1)<<14
+		vp8l := append([]byte{0x2f}, binary.LittleEndian.AppendUint32(nil, bits)...)
+
+		anmf := append(uint24(f.x/2), uint24(f.y/2)...)
+		anmf = append(anmf, uint24(f.width-1)...)
+		anmf = append(anmf, uint24(f.height-1)...)
+		anmf = append(anmf, uint24(100)...)
+		anmf = append(anmf, 0)
+		anmf = append(anmf, chunk("VP8L", vp8l)...)
+		body = append(body, chunk("ANMF", anmf)...)
+	}
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+func TestValidateMediaAnimations(t *testing.T) {
+	limits := DefaultUploadLimits()
+	limits.MaxAnimationPixels = 10 * 100 * 100
+
+	frame := func(x, y, w, h int) testWebPFrame {
+		return testWebPFrame{x: x, y: y, width: w, height: h, bitstreamW: w, bitstreamH: h}
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{name: "gif within budget", data: testGIF(t, 100, 100, 10)},
+		{name: "gif over budget", data: testGIF(t, 100, 100, 11), wantErr: ErrImageDimensions},
+		{name: "webp within budget", data: testAnimatedWebP(100, 100, frame(0, 0, 100, 100), frame(20, 20, 50, 50))},
+		{
+			name: "webp over budget",
+			// Small frames still composite onto the whole canvas
+			data:    testAnimatedWebP(100, 100, slices.Repeat([]testWebPFrame{frame(0, 0, 10, 10)}, 11)...),
+			wantErr: ErrImageDimensions,
+		},
+		{name: "webp frame wider than the canvas", data: testAnimatedWebP(100, 100, frame(0, 0, 16384, 16384)), wantErr: ErrCorruptImage},
+		{name: "webp frame past the canvas edge", data: testAnimatedWebP(100, 100, frame(60, 0, 50, 50)), wantErr: ErrCorruptImage},
+		{
+			name:    "webp bitstream larger than its frame",
+			data:    testAnimatedWebP(100, 100, testWebPFrame{width: 10, height: 10, bitstreamW: 16384, bitstreamH: 16384}),
+			wantErr: ErrCorruptImage,
+		},
+		{name: "webp canvas over the side limit", data: testAnimatedWebP(9000, 100, frame(0, 0, 10, 10)), wantErr: ErrImageDimensions},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateMedia(tt.data, limits)
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncodeFrameFlattensOntoWhite(t *testing.T) {
+	canvas := image.NewRGBA(image.Rect(0, 0, 8, 8)) // Fully transparent, as before the first GIF frame
+	canvas.Set(0, 0, color.RGBA{R: 255, A: 255})
+
+	encoded, err := encodeFrame(canvas)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if r, g, b, _ := img.At(7, 7).RGBA(); r>>8 < 250 || g>>8 < 250 || b>>8 < 250 {
+		t.Errorf("transparent pixel encoded as %d,%d,%d, want white", r>>8, g>>8, b>>8)
+	}
+}
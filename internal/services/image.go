@@ -0,0 +1,108 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"  // Register GIF for Upload
+	_ "image/jpeg" // Register JPEG for Upload
+	_ "image/png"  // Register PNG for Upload
+	"math"
+	"sync"
+
+	"go-gin-project/internal/models"
+
+	_ "golang.org/x/image/webp" // Register WebP for Upload
+)
+
+// Upload is an image on its way to the detector. The header is read on creation; the pixels are
+// decoded at most once, by ValidateImage or the first Pixels or Image call, and then shared by the
+// detection cache, the normalizer and redaction.
+type Upload struct {
+	Data        []byte
+	Format      string    // One of the Format* values, "" when not recognised
+	Size        ImageSize // Size of the stored pixels, zero when the header cannot be read
+	Orientation int       // EXIF orientation, 1 when there is none
+
+	headerErr  error // Why Size could not be read
+	decodeOnce sync.Once
+	pixels     image.Image
+	decodeErr  error
+
+	orientOnce sync.Once
+	upright    image.Image
+}
+
+// NewUpload reads the format, size and orientation of data without decoding its pixels
+func NewUpload(data []byte) *Upload {
+	u := &Upload{Data: data, Format: SniffImageFormat(data), Orientation: exifOrientation(data)}
+	if u.Format == FormatHEIC {
+		if size, ok := heicSize(data); ok {
+			u.Size = size
+		} else {
+			u.headerErr = errors.New("heic image has no size property")
+		}
+		return u
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		u.headerErr = err
+		return u
+	}
+	u.Size = ImageSize{Width: cfg.Width, Height: cfg.Height}
+	return u
+}
+
+// UprightSize returns the size of the image as displayed: sides are swapped when the EXIF orientation
+// rotates it by 90°
+func (u *Upload) UprightSize() ImageSize {
+	return orientedSize(u.Size, u.Orientation)
+}
+
+// Pixels returns the stored pixels, decoding them on the first call
+func (u *Upload) Pixels() (image.Image, error) {
+	u.decodeOnce.Do(func() {
+		u.pixels, _, u.decodeErr = image.Decode(bytes.NewReader(u.Data))
+	})
+	return u.pixels, u.decodeErr
+}
+
+// Image returns the pixels with the EXIF orientation applied, so upright as displayed
+func (u *Upload) Image() (image.Image, error) {
+	pixels, err := u.Pixels()
+	if err != nil {
+		return nil, err
+	}
+	u.orientOnce.Do(func() {
+		u.upright = applyOrientation(pixels, u.Orientation)
+	})
+	return u.upright, nil
+}
+
+// NormalizeBoxes returns a copy of results with NormalizedBox set from the pixel boxes.
+// Results are returned unchanged when the size is unknown or a box is malformed.
+func NormalizeBoxes(results []models.DetectionResult, size ImageSize) []models.DetectionResult {
+	out := make([]models.DetectionResult, len(results))
+	copy(out, results)
+	if size.Width <= 0 || size.Height <= 0 {
+		return out
+	}
+
+	w, h := float64(size.Width), float64(size.Height)
+	for i, r := range out {
+		if len(r.Box) != 4 || r.Box[2] <= 0 || r.Box[3] <= 0 {
+			continue
+		}
+		// Clip to the image, detectors may return boxes slightly past the edges
+		x0, y0 := clamp01(float64(r.Box[0])/w), clamp01(float64(r.Box[1])/h)
+		x1, y1 := clamp01(float64(r.Box[0]+r.Box[2])/w), clamp01(float64(r.Box[1]+r.Box[3])/h)
+		out[i].NormalizedBox = &models.NormalizedBox{X: x0, Y: y0, Width: x1 - x0, Height: y1 - y0}
+	}
+	return out
+}
+
+// clamp01 limits v to [0, 1]
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
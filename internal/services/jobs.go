@@ -0,0 +1,279 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Job states
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// ErrQueueFull is returned by Submit when every queue slot is taken
+var ErrQueueFull = errors.New("job queue is full")
+
+// Job is an asynchronous detection and its outcome
+type Job struct {
+	ID          string     `json:"id"`
+	UserID      string     `json:"user_id"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	Result      any        `json:"result,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	ErrorStatus int        `json:"error_status,omitempty"` // HTTP status the synchronous endpoint would have returned
+	CallbackURL string     `json:"callback_url,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+// JobFunc does the work of a job. The returned error is reported with the status code from ErrorStatus.
+type JobFunc func(ctx context.Context) (result any, err error)
+
+// JobStore keeps jobs so they can be polled
+type JobStore interface {
+	Save(job Job)
+	Get(id string) (Job, bool)
+}
+
+// MemoryJobStore keeps jobs in process memory and forgets them Retention after they finish.
+// Jobs are lost on restart and not shared between instances.
+type MemoryJobStore struct {
+	Retention time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]Job
+	now  func() time.Time
+}
+
+// NewMemoryJobStore returns an empty store that keeps finished jobs for retention
+func NewMemoryJobStore(retention time.Duration) *MemoryJobStore {
+	return &MemoryJobStore{Retention: retention, jobs: make(map[string]Job), now: time.Now}
+}
+
+// Save stores the job and drops expired ones
+func (s *MemoryJobStore) Save(job Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for id, j := range s.jobs {
+		if j.FinishedAt != nil && now.Sub(*j.FinishedAt) > s.Retention {
+			delete(s.jobs, id)
+		}
+	}
+	s.jobs[job.ID] = job
+}
+
+// Get returns the job with the given ID
+func (s *MemoryJobStore) Get(id string) (Job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, ok := s.jobs[id]
+	if ok && job.FinishedAt != nil && s.now().Sub(*job.FinishedAt) > s.Retention {
+		return Job{}, false
+	}
+	return job, ok
+}
+
+// JobConfig controls the worker pool
+type JobConfig struct {
+	Workers   int           // Jobs processed at the same time
+	QueueSize int           // Jobs waiting for a worker before Submit fails with ErrQueueFull
+	Timeout   time.Duration // Deadline of a single job
+
+	CallbackWorkers   int // Callbacks delivered at the same time, apart from the job workers
+	CallbackQueueSize int // Finished jobs waiting for delivery before their callback is dropped
+}
+
+// DefaultJobConfig returns the worker pool settings used when no environment override is set
+func DefaultJobConfig() JobConfig {
+	return JobConfig{Workers: 4, QueueSize: 100, Timeout: 60 * time.Second, CallbackWorkers: 2, CallbackQueueSize: 100}
+}
+
+// jobTask is a queued job with its work
+type jobTask struct {
+	job Job
+	fn  JobFunc
+}
+
+// JobRunner runs submitted jobs on a fixed pool of workers from a bounded in-memory queue.
+// Callbacks are delivered by their own workers, so a slow receiver never holds up detections.
+// Both need a long-lived process: on serverless runtimes the goroutines stop with the response.
+type JobRunner struct {
+	cfg        JobConfig
+	store      JobStore
+	notifier   *WebhookNotifier
+	tasks      chan jobTask
+	callbacks  chan Job
+	wg         sync.WaitGroup
+	callbackWG sync.WaitGroup
+}
+
+// NewJobRunner starts cfg.Workers workers, plus cfg.CallbackWorkers when notifier is set.
+// notifier may be nil when callbacks are disabled.
+func NewJobRunner(cfg JobConfig, store JobStore, notifier *WebhookNotifier) *JobRunner {
+	r := &JobRunner{
+		cfg:      cfg,
+		store:    store,
+		notifier: notifier,
+		tasks:    make(chan jobTask, cfg.QueueSize),
+	}
+	for i := 0; i < cfg.Workers; i++ {
+		r.wg.Add(1)
+		go r.work()
+	}
+	if notifier != nil {
+		r.callbacks = make(chan Job, cfg.CallbackQueueSize)
+		for i := 0; i < max(cfg.CallbackWorkers, 1); i++ {
+			r.callbackWG.Add(1)
+			go r.deliver()
+		}
+	}
+	return r
+}
+
+// ValidateCallbackURL checks a callback URL before a job is submitted with it
+func (r *JobRunner) ValidateCallbackURL(ctx context.Context, raw string) error {
+	if r.notifier == nil {
+		return fmt.Errorf("%w: callbacks are not configured", ErrInvalidCallbackURL)
+	}
+	return r.notifier.ValidateCallbackURL(ctx, raw)
+}
+
+// Submit queues fn as a new job of the user and returns it in the queued state
+func (r *JobRunner) Submit(uid, callbackURL string, fn JobFunc) (Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now()
+	job := Job{ID: id, UserID: uid, Status: JobQueued, CreatedAt: now, UpdatedAt: now, CallbackURL: callbackURL}
+
+	// Store before queueing so a worker never updates an unknown job
+	r.store.Save(job)
+	select {
+	case r.tasks <- jobTask{job: job, fn: fn}:
+		return job, nil
+	default:
+		finished := time.Now()
+		job.Status, job.Error, job.UpdatedAt, job.FinishedAt = JobFailed, ErrQueueFull.Error(), finished, &finished
+		r.store.Save(job)
+		return Job{}, ErrQueueFull
+	}
+}
+
+// Get returns a job of the user; jobs of other users are reported as missing
+func (r *JobRunner) Get(uid, id string) (Job, bool) {
+	job, ok := r.store.Get(id)
+	if !ok || job.UserID != uid {
+		return Job{}, false
+	}
+	return job, true
+}
+
+// Close stops accepting jobs and waits for the queued ones to finish and their callbacks to be sent
+func (r *JobRunner) Close() {
+	close(r.tasks)
+	r.wg.Wait()
+	if r.callbacks != nil {
+		close(r.callbacks)
+		r.callbackWG.Wait()
+	}
+}
+
+// work processes queued jobs until the queue is closed
+func (r *JobRunner) work() {
+	defer r.wg.Done()
+	for task := range r.tasks {
+		r.run(task)
+	}
+}
+
+// run executes one job, stores its outcome and queues the callback
+func (r *JobRunner) run(task jobTask) {
+	job := task.job
+	job.Status, job.UpdatedAt = JobRunning, time.Now()
+	r.store.Save(job)
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.cfg.Timeout)
+	result, err := runJobFunc(ctx, task.fn)
+	cancel()
+
+	finished := time.Now()
+	job.UpdatedAt, job.FinishedAt = finished, &finished
+	if err != nil {
+		job.Status, job.Error = JobFailed, err.Error()
+		var statusErr *JobError
+		if errors.As(err, &statusErr) {
+			job.Error, job.ErrorStatus = statusErr.Message, statusErr.Status
+		}
+	} else {
+		job.Status, job.Result = JobSucceeded, result
+	}
+	r.store.Save(job)
+
+	if job.CallbackURL != "" && r.callbacks != nil {
+		select {
+		case r.callbacks <- job:
+		default:
+			// The job stays available for polling
+			log.Printf("Dropped callback for job %s: callback queue is full\n", job.ID)
+		}
+	}
+}
+
+// deliver sends queued callbacks until the queue is closed
+func (r *JobRunner) deliver() {
+	defer r.callbackWG.Done()
+	for job := range r.callbacks {
+		if err := r.notifier.Notify(context.Background(), job.CallbackURL, job); err != nil {
+			log.Printf("Error sending callback for job %s: %v\n", job.ID, err)
+		}
+	}
+}
+
+// runJobFunc calls fn and turns a panic into a failed job instead of a dead worker
+func runJobFunc(ctx context.Context, fn JobFunc) (result any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	return fn(ctx)
+}
+
+// JobError is a job failure with the HTTP status and message the synchronous endpoint would return
+type JobError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+func (e *JobError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Message, e.Err)
+}
+
+func (e *JobError) Unwrap() error {
+	return e.Err
+}
+
+// newJobID returns a random 128-bit hex ID
+func newJobID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate job id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,223 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go-gin-project/internal/models"
+)
+
+// waitForJob polls the runner until the job reaches a final state
+func waitForJob(t *testing.T, r *JobRunner, uid, id string) Job {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, ok := r.Get(uid, id)
+		if !ok {
+			t.Fatalf("job %s not found", id)
+		}
+		if job.Status == JobSucceeded || job.Status == JobFailed {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return Job{}
+}
+
+// detectJob is the work the detect handler queues, reduced to the detector call
+func detectJob(detector Detector, filename string) JobFunc {
+	return func(ctx context.Context) (any, error) {
+		resp, err := detector.Detect(ctx, filename, nil)
+		if err != nil {
+			return nil, &JobError{Status: http.StatusBadGateway, Message: "Failed to process image", Err: err}
+		}
+		return resp, nil
+	}
+}
+
+func TestJobRunnerLifecycle(t *testing.T) {
+	fake := NewFakeDetector(models.DetectionResult{Class: "BELLY_EXPOSED", Score: 0.7, Box: []int{1, 2, 3, 4}})
+	runner := NewJobRunner(JobConfig{Workers: 2, QueueSize: 10, Timeout: time.Second}, NewMemoryJobStore(time.Hour), nil)
+	defer runner.Close()
+
+	queued, err := runner.Submit("alice", "", detectJob(fake, "photo.jpg"))
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	if queued.Status != JobQueued || queued.ID == "" || queued.UserID != "alice" {
+		t.Fatalf("submitted job = %+v, want a queued job of alice", queued)
+	}
+
+	job := waitForJob(t, runner, "alice", queued.ID)
+	if job.Status != JobSucceeded || job.FinishedAt == nil || job.Error != "" {
+		t.Fatalf("finished job = %+v, want succeeded", job)
+	}
+	resp, ok := job.Result.(*models.APIResponse)
+	if !ok || len(resp.Results) != 1 || resp.Results[0].Class != "BELLY_EXPOSED" {
+		t.Errorf("result = %#v, want the detector response", job.Result)
+	}
+	if got := fake.CallCount(); got != 1 {
+		t.Errorf("detector called %d times, want 1", got)
+	}
+
+	if _, ok := runner.Get("bob", queued.ID); ok {
+		t.Error("another user can read the job")
+	}
+	if _, ok := runner.Get("alice", "unknown"); ok {
+		t.Error("unknown job found")
+	}
+}
+
+func TestJobRunnerFailures(t *testing.T) {
+	tests := []struct {
+		name       string
+		fn         JobFunc
+		wantError  string
+		wantStatus int
+	}{
+		{
+			name:       "detector error keeps the synchronous status",
+			fn:         detectJob(&FakeDetector{Err: upstreamStatus(503)}, "photo.jpg"),
+			wantError:  "Failed to process image",
+			wantStatus: http.StatusBadGateway,
+		},
+		{
+			name:      "plain error",
+			fn:        func(context.Context) (any, error) { return nil, errors.New("boom") },
+			wantError: "boom",
+		},
+		{
+			name:      "panic fails the job, not the worker",
+			fn:        func(context.Context) (any, error) { panic("broken") },
+			wantError: "job panicked: broken",
+		},
+		{
+			name: "timeout",
+			fn: func(ctx context.Context) (any, error) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			},
+			wantError: context.DeadlineExceeded.Error(),
+		},
+	}
+
+	runner := NewJobRunner(JobConfig{Workers: 1, QueueSize: 10, Timeout: 20 * time.Millisecond}, NewMemoryJobStore(time.Hour), nil)
+	defer runner.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queued, err := runner.Submit("alice", "", tt.fn)
+			if err != nil {
+				t.Fatalf("submit: %v", err)
+			}
+			job := waitForJob(t, runner, "alice", queued.ID)
+			if job.Status != JobFailed || job.Error != tt.wantError || job.ErrorStatus != tt.wantStatus {
+				t.Errorf("job = %s %q (status %d), want failed %q (status %d)", job.Status, job.Error, job.ErrorStatus, tt.wantError, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestJobRunnerQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	blocking := func(context.Context) (any, error) {
+		<-release
+		return "done", nil
+	}
+
+	runner := NewJobRunner(JobConfig{Workers: 1, QueueSize: 1, Timeout: 5 * time.Second}, NewMemoryJobStore(time.Hour), nil)
+	defer runner.Close()
+	defer close(release)
+
+	running, err := runner.Submit("alice", "", blocking)
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	// Wait until the only worker holds the first job, so the second one fills the queue
+	for job, _ := runner.Get("alice", running.ID); job.Status != JobRunning; job, _ = runner.Get("alice", running.ID) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := runner.Submit("alice", "", blocking); err != nil {
+		t.Fatalf("submit to the queue: %v", err)
+	}
+
+	if _, err := runner.Submit("alice", "", blocking); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("got %v, want ErrQueueFull", err)
+	}
+}
+
+func TestMemoryJobStoreRetention(t *testing.T) {
+	clock := newFakeClock()
+	store := NewMemoryJobStore(time.Hour)
+	store.now = clock.Now
+
+	finished := clock.Now()
+	store.Save(Job{ID: "done", Status: JobSucceeded, FinishedAt: &finished})
+	store.Save(Job{ID: "queued", Status: JobQueued})
+
+	clock.Advance(time.Hour)
+	if _, ok := store.Get("done"); !ok {
+		t.Fatal("finished job expired at the end of its retention")
+	}
+
+	clock.Advance(time.Second)
+	if _, ok := store.Get("done"); ok {
+		t.Error("finished job still returned after its retention")
+	}
+	if _, ok := store.Get("queued"); !ok {
+		t.Error("unfinished job expired")
+	}
+
+	// Saving drops expired jobs from memory
+	store.Save(Job{ID: "new", Status: JobQueued})
+	if _, ok := store.jobs["done"]; ok {
+		t.Error("expired job kept in memory")
+	}
+}
+
+func TestJobRunnerSlowCallbackDoesNotBlockJobs(t *testing.T) {
+	release := make(chan struct{})
+	delivered := make(chan Job, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var job Job
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &job)
+		<-release
+		delivered <- job
+	}))
+	defer server.Close()
+
+	notifier := testNotifier()
+	runner := NewJobRunner(JobConfig{Workers: 1, QueueSize: 10, Timeout: time.Second, CallbackWorkers: 1, CallbackQueueSize: 10}, NewMemoryJobStore(time.Hour), notifier)
+
+	fake := NewFakeDetector()
+	first, _ := runner.Submit("alice", server.URL, detectJob(fake, "first.jpg"))
+	second, _ := runner.Submit("alice", server.URL, detectJob(fake, "second.jpg"))
+
+	// Both jobs finish on the single worker while the first callback is still held by the receiver
+	waitForJob(t, runner, "alice", first.ID)
+	waitForJob(t, runner, "alice", second.ID)
+
+	close(release)
+	runner.Close()
+	close(delivered)
+
+	var ids []string
+	for job := range delivered {
+		if job.Status != JobSucceeded {
+			t.Errorf("callback for %s has status %s", job.ID, job.Status)
+		}
+		ids = append(ids, job.ID)
+	}
+	if len(ids) != 2 {
+		t.Errorf("got %d callbacks, want 2", len(ids))
+	}
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+
+	"go-gin-project/internal/models"
+)
+
+// NormalizeConfig controls how uploads are prepared before they are sent to the detector
+type NormalizeConfig struct {
+	MaxEdge     int // Longest side of the forwarded image in pixels
+	JPEGQuality int // Quality of the re-encoded image
+}
+
+// DefaultNormalizeConfig returns the settings used when no environment override is set
+func DefaultNormalizeConfig() NormalizeConfig {
+	return NormalizeConfig{MaxEdge: 1280, JPEGQuality: 85}
+}
+
+// NormalizedImage is an upload prepared for the detector
+type NormalizedImage struct {
+	Data     []byte
+	Original ImageSize // Upright size of the upload, the coordinates boxes are reported in
+	Scaled   ImageSize // Size of Data
+}
+
+// NormalizeImage takes the upright upload, shrinks it so the longest side is at most cfg.MaxEdge and
+// re-encodes it as JPEG, which also drops every metadata block. ok is false when the format cannot be
+// decoded here (HEIC); such uploads are forwarded unchanged.
+func NormalizeImage(upload *Upload, cfg NormalizeConfig) (normalized NormalizedImage, ok bool, err error) {
+	img, err := upload.Image()
+	if err != nil {
+		return NormalizedImage{}, false, nil
+	}
+
+	bounds := img.Bounds()
+	original := ImageSize{Width: bounds.Dx(), Height: bounds.Dy()}
+	scaled := original
+	if longest := max(original.Width, original.Height); longest > cfg.MaxEdge {
+		ratio := float64(cfg.MaxEdge) / float64(longest)
+		scaled = ImageSize{
+			Width:  max(1, int(math.Round(float64(original.Width)*ratio))),
+			Height: max(1, int(math.Round(float64(original.Height)*ratio))),
+		}
+	}
+
+	// JPEG has no alpha, transparent areas are flattened onto white instead of black
+	dst := image.NewRGBA(image.Rect(0, 0, scaled.Width, scaled.Height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: cfg.JPEGQuality}); err != nil {
+		return NormalizedImage{}, false, fmt.Errorf("encode normalized image: %w", err)
+	}
+	return NormalizedImage{Data: buf.Bytes(), Original: original, Scaled: scaled}, true, nil
+}
+
+// ScaleBoxes returns a copy of results with the pixel boxes mapped from the from size to the to size
+func ScaleBoxes(results []models.DetectionResult, from, to ImageSize) []models.DetectionResult {
+	out := make([]models.DetectionResult, len(results))
+	copy(out, results)
+	if from == to || from.Width <= 0 || from.Height <= 0 {
+		return out
+	}
+
+	sx := float64(to.Width) / float64(from.Width)
+	sy := float64(to.Height) / float64(from.Height)
+	for i, r := range out {
+		if len(r.Box) != 4 {
+			continue
+		}
+		out[i].Box = []int{
+			int(math.Round(float64(r.Box[0]) * sx)),
+			int(math.Round(float64(r.Box[1]) * sy)),
+			int(math.Round(float64(r.Box[2]) * sx)),
+			int(math.Round(float64(r.Box[3]) * sy)),
+		}
+	}
+	return out
+}
+
+// NormalizingDetector sends normalized uploads to next and maps the returned boxes back to the
+// upright, full-resolution coordinates of the upload
+type NormalizingDetector struct {
+	next   Detector
+	config NormalizeConfig
+}
+
+// NewNormalizingDetector wraps next, filling zero config fields with defaults
+func NewNormalizingDetector(next Detector, config NormalizeConfig) *NormalizingDetector {
+	defaults := DefaultNormalizeConfig()
+	if config.MaxEdge <= 0 {
+		config.MaxEdge = defaults.MaxEdge
+	}
+	if config.JPEGQuality <= 0 || config.JPEGQuality > 100 {
+		config.JPEGQuality = defaults.JPEGQuality
+	}
+	return &NormalizingDetector{next: next, config: config}
+}
+
+// Detect normalizes the image, calls next and rescales its boxes. The detector sees a .jpg filename
+// matching the re-encoded content; the response keeps the uploaded name.
+func (d *NormalizingDetector) Detect(ctx context.Context, filename string, upload *Upload) (*models.APIResponse, error) {
+	normalized, ok, err := NormalizeImage(upload, d.config)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return d.next.Detect(ctx, filename, upload)
+	}
+
+	resp, err := d.next.Detect(ctx, strings.TrimSuffix(filename, filepath.Ext(filename))+".jpg", &Upload{Data: normalized.Data, Format: FormatJPEG, Size: normalized.Scaled, Orientation: 1})
+	if err != nil {
+		return nil, err
+	}
+	scaled := *resp
+	scaled.Filename = filename
+	scaled.Results = ScaleBoxes(resp.Results, normalized.Scaled, normalized.Original)
+	scaled.Upright = true
+	return &scaled, nil
+}
@@ -0,0 +1,139 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image/jpeg"
+	"slices"
+	"testing"
+
+	"go-gin-project/internal/models"
+)
+
+func TestScaleBoxes(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to ImageSize
+		box      []int
+		want     []int
+	}{
+		{name: "same size", from: ImageSize{Width: 640, Height: 480}, to: ImageSize{Width: 640, Height: 480}, box: []int{10, 20, 30, 40}, want: []int{10, 20, 30, 40}},
+		{name: "upscale", from: ImageSize{Width: 1280, Height: 960}, to: ImageSize{Width: 4032, Height: 3024}, box: []int{100, 200, 300, 400}, want: []int{315, 630, 945, 1260}},
+		{name: "rounds", from: ImageSize{Width: 3, Height: 3}, to: ImageSize{Width: 10, Height: 10}, box: []int{1, 1, 1, 2}, want: []int{3, 3, 3, 7}},
+		{name: "unknown source size", from: ImageSize{}, to: ImageSize{Width: 10, Height: 10}, box: []int{1, 2, 3, 4}, want: []int{1, 2, 3, 4}},
+		{name: "malformed box kept", from: ImageSize{Width: 10, Height: 10}, to: ImageSize{Width: 20, Height: 20}, box: []int{1, 2}, want: []int{1, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := []models.DetectionResult{{Class: "FACE_FEMALE", Box: tt.box}}
+			got := ScaleBoxes(results, tt.from, tt.to)
+			if !slices.Equal(got[0].Box, tt.want) {
+				t.Errorf("got %v, want %v", got[0].Box, tt.want)
+			}
+			if &got[0] == &results[0] || !slices.Equal(results[0].Box, tt.box) {
+				t.Error("input results modified")
+			}
+		})
+	}
+}
+
+func TestScaleBoxesRoundTrip(t *testing.T) {
+	sizes := [][2]ImageSize{
+		{{Width: 4032, Height: 3024}, {Width: 1280, Height: 960}},
+		{{Width: 1080, Height: 1920}, {Width: 720, Height: 1280}},
+		{{Width: 1001, Height: 333}, {Width: 1280, Height: 426}},
+	}
+	box := []int{101, 57, 333, 129}
+
+	for _, s := range sizes {
+		original, scaled := s[0], s[1]
+		results := []models.DetectionResult{{Box: box}}
+		back := ScaleBoxes(ScaleBoxes(results, original, scaled), scaled, original)
+
+		// One pixel of the scaled image spans this many original pixels, rounding moves a side by half of it twice
+		tolerance := (original.Width + scaled.Width - 1) / scaled.Width
+		for i := range box {
+			if diff := back[0].Box[i] - box[i]; diff < -tolerance || diff > tolerance {
+				t.Errorf("%v -> %v: box %v came back as %v", original, scaled, box, back[0].Box)
+				break
+			}
+		}
+	}
+}
+
+func TestUploadSize(t *testing.T) {
+	jpg := testJPEG(t, 40, 20)
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		upload := NewUpload(withOrientation(jpg, orientation, binary.BigEndian))
+
+		if upload.Size != (ImageSize{Width: 40, Height: 20}) {
+			t.Errorf("orientation %d, stored: got %+v", orientation, upload.Size)
+		}
+		want := ImageSize{Width: 40, Height: 20}
+		if orientation >= 5 {
+			want = ImageSize{Width: 20, Height: 40}
+		}
+		if got := upload.UprightSize(); got != want {
+			t.Errorf("orientation %d, upright: got %+v, want %+v", orientation, got, want)
+		}
+		img, err := upload.Image()
+		if err != nil || img.Bounds().Dx() != want.Width || img.Bounds().Dy() != want.Height {
+			t.Errorf("orientation %d: decoded %v, %v", orientation, img.Bounds(), err)
+		}
+	}
+	if got := NewUpload([]byte("not an image")); got.Size != (ImageSize{}) || got.UprightSize() != (ImageSize{}) {
+		t.Errorf("undecodable: got %+v", got.Size)
+	}
+}
+
+func TestNormalizingDetector(t *testing.T) {
+	// Stored 40x20 and rotated 90° for display: upright it is 20x40, shrunk to 5x10 for the detector
+	upload := NewUpload(withOrientation(testJPEG(t, 40, 20), 6, binary.BigEndian))
+	fake := NewFakeDetector(models.DetectionResult{Class: "FACE_FEMALE", Score: 0.9, Box: []int{1, 2, 2, 4}})
+	d := NewNormalizingDetector(fake, NormalizeConfig{MaxEdge: 10, JPEGQuality: 90})
+
+	resp, err := d.Detect(context.Background(), "photo.png", upload)
+	if err != nil {
+		t.Fatalf("detect: %v", err)
+	}
+	if !resp.Upright || resp.Filename != "photo.png" {
+		t.Errorf("got filename %q, upright %v", resp.Filename, resp.Upright)
+	}
+	if want := []int{4, 8, 8, 16}; !slices.Equal(resp.Results[0].Box, want) {
+		t.Errorf("box %v, want %v in upright upload coordinates", resp.Results[0].Box, want)
+	}
+	if fake.Calls[0] != "photo.jpg" {
+		t.Errorf("detector got filename %q", fake.Calls[0])
+	}
+
+	// Formats without a decoder here are forwarded unchanged, their boxes stay in stored coordinates
+	resp, err = d.Detect(context.Background(), "photo.heic", NewUpload(testHEIC("heic", [2]uint32{40, 20})))
+	if err != nil {
+		t.Fatalf("detect heic: %v", err)
+	}
+	if resp.Upright || !slices.Equal(resp.Results[0].Box, []int{1, 2, 2, 4}) {
+		t.Errorf("heic: upright %v, box %v", resp.Upright, resp.Results[0].Box)
+	}
+}
+
+func TestNormalizeImage(t *testing.T) {
+	upload := NewUpload(withOrientation(testJPEG(t, 400, 100), 8, binary.LittleEndian))
+
+	normalized, ok, err := NormalizeImage(upload, NormalizeConfig{MaxEdge: 200, JPEGQuality: 80})
+	if err != nil || !ok {
+		t.Fatalf("normalize: ok %v, %v", ok, err)
+	}
+	if normalized.Original != (ImageSize{Width: 100, Height: 400}) || normalized.Scaled != (ImageSize{Width: 50, Height: 200}) {
+		t.Errorf("original %+v, scaled %+v", normalized.Original, normalized.Scaled)
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(normalized.Data))
+	if err != nil || cfg.Width != 50 || cfg.Height != 200 {
+		t.Errorf("encoded %dx%d, %v", cfg.Width, cfg.Height, err)
+	}
+	if exifOrientation(normalized.Data) != 1 {
+		t.Error("orientation kept in the re-encoded image")
+	}
+}
@@ -1,106 +1,416 @@
 package services
 
-import "go-gin-project/internal/models"
+import (
+	"math"
+	"sort"
 
-// ClassifyNSFW classifies the NSFW level based on detection results using updated standards
-func ClassifyNSFW(results []models.DetectionResult) int {
-	// Initialize counters for exposed areas
-	exposedCount := 0
-	hasHighExposed := false
-
-	femaleBreastExposed := 0.0
-	femaleGenitaliaExposed := 0.0
-	maleGenitaliaExposed := 0.0
-	anusExposed := 0.0
-	bellyExposed := 0.0
-	buttocksExposed := 0.0
-	armpitsExposed := 0.0
-	feetExposed := 0.0
-	femaleBreastCovered := 1.0 // Default high if not detected
+	"go-gin-project/internal/models"
+)
+
+// DefaultRuleName is reported as the rule of a decision when no policy rule matched
+const DefaultRuleName = "default"
+
+// defaultNearMissMargin is used when the policy does not set near_miss_margin
+const defaultNearMissMargin = 0.1
+
+// Decision is the explained outcome of classifying one image
+type Decision struct {
+	Level         int        `json:"level"`
+	Rule          string     `json:"rule"` // Name of the matching rule, or DefaultRuleName
+	PolicyVersion string     `json:"policy_version"`
+	Profile       string     `json:"profile,omitempty"`     // Sensitivity profile the thresholds were scaled with
+	AppPolicy     string     `json:"app_policy,omitempty"`  // Application whose override was applied
+	Escalated     int        `json:"escalated,omitempty"`   // Levels added by the application override
+	Contributing  []Evidence `json:"contributing"`          // Conditions of the matching rule that held
+	NearMisses    []NearMiss `json:"near_misses,omitempty"` // Higher level rules that only narrowly failed
+
+	// Classes are the measures of every detected class, ignored ones included, stored on the event
+	// so it can be reclassified with ReclassifyNSFW
+	Classes []models.ClassMeasures `json:"-"`
+}
+
+// Evidence is one evaluated rule condition with the observed value
+type Evidence struct {
+	Class     string  `json:"class,omitempty"`
+	Measure   string  `json:"measure,omitempty"`
+	Metric    string  `json:"metric,omitempty"`
+	Observed  float64 `json:"observed"`
+	Op        string  `json:"op"`
+	Threshold float64 `json:"threshold"`
+}
+
+// NearMiss is a rule above the decided level whose failing conditions were all within the margin
+type NearMiss struct {
+	Rule   string     `json:"rule"`
+	Level  int        `json:"level"`
+	Failed []Evidence `json:"failed"`
+}
+
+// ImageSize is the pixel size of the classified image, zero when unknown
+type ImageSize struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// ClassifyNSFW classifies the NSFW level of detection results using the given policy
+// and explains which rule decided it. Geometry measures use the results' NormalizedBox,
+// see NormalizeBoxes; results without one only contribute scores and counts.
+// The sensitivity scales the lower score bounds of each rule by the rule's level, on scalable classes.
+// appPolicy is the application's override (may be nil): it drops ignored classes,
+// scales thresholds on top of the sensitivity and escalates flagged levels.
+func ClassifyNSFW(policy *Policy, results []models.DetectionResult, sensitivity Sensitivity, appPolicy *models.AppPolicy) Decision {
+	classes := aggregateDetections(policy, results)
+	decision := classify(policy, classes, sensitivity, newAppOverride(appPolicy))
+	decision.Classes = classMeasures(classes)
+	return decision
+}
+
+// ReclassifyNSFW classifies the class measures stored on an event like ClassifyNSFW classified its
+// detections. Boxes the event's policy dropped for min_area stay dropped; a policy with a lower
+// min_area cannot bring them back.
+func ReclassifyNSFW(policy *Policy, measures []models.ClassMeasures, sensitivity Sensitivity, appPolicy *models.AppPolicy) Decision {
+	classes := make(map[string]*classAggregate, len(measures))
+	for _, m := range measures {
+		classes[m.Class] = &classAggregate{
+			maxScore:     m.MaxScore,
+			minScore:     m.MinScore,
+			count:        m.Count,
+			area:         m.Area,
+			maxArea:      m.MaxArea,
+			centerOffset: m.CenterOffset,
+			hasBox:       m.HasBox,
+		}
+	}
+	decision := classify(policy, classes, sensitivity, newAppOverride(appPolicy))
+	decision.Classes = measures
+	return decision
+}
+
+// classify decides the level of the aggregated detections
+func classify(policy *Policy, classes map[string]*classAggregate, sensitivity Sensitivity, app *appOverride) Decision {
+	features := extractFeatures(policy, app.filter(classes))
+	scale := func(level int) float64 {
+		return sensitivity.scale(level) * app.scale(level)
+	}
+
+	decision := Decision{
+		Level:         policy.DefaultLevel,
+		Rule:          DefaultRuleName,
+		PolicyVersion: policy.Version,
+		Profile:       sensitivity.Profile,
+		Contributing:  []Evidence{},
+	}
+
+	var skipped []Rule
+	for _, rule := range policy.Rules {
+		if held, ok := rule.evaluate(features, scale(rule.Level)); ok {
+			decision.Level = rule.Level
+			decision.Rule = rule.Name
+			decision.Contributing = held
+			break
+		}
+		skipped = append(skipped, rule)
+	}
+
+	// Rules checked before the match that would have given a higher level
+	margin := policy.nearMissMargin()
+	for _, rule := range skipped {
+		if rule.Level <= decision.Level {
+			continue
+		}
+		if failed, near := rule.nearMiss(features, scale(rule.Level), margin); near {
+			decision.NearMisses = append(decision.NearMisses, NearMiss{Rule: rule.Name, Level: rule.Level, Failed: failed})
+		}
+	}
 
+	if app != nil {
+		decision.AppPolicy = app.name
+		// Escalation only raises flagged images, safe stays safe
+		if app.escalate > 0 && decision.Level > 0 {
+			escalated := min(decision.Level+app.escalate, 3)
+			decision.Escalated = escalated - decision.Level
+			decision.Level = escalated
+		}
+	}
+
+	return decision
+}
+
+// classAggregate combines every detection of one class
+type classAggregate struct {
+	maxScore     float64
+	minScore     float64
+	count        int
+	area         float64 // Summed box area as a fraction of the image
+	maxArea      float64 // Largest single box as a fraction of the image
+	centerOffset float64 // Distance of the most central box from the image centre, 0 = centre, 1 = corner
+	hasBox       bool
+}
+
+// aggregateDetections groups detections by class, dropping boxes smaller than the class min_area
+func aggregateDetections(policy *Policy, results []models.DetectionResult) map[string]*classAggregate {
+	classes := make(map[string]*classAggregate)
 	for _, r := range results {
-		switch r.Class {
-		case "FEMALE_BREAST_EXPOSED":
-			femaleBreastExposed = r.Score
-			if r.Score >= 0.5 {
-				hasHighExposed = true
-			}
-			if r.Score >= 0.2 {
-				exposedCount++
-			}
-		case "FEMALE_GENITALIA_EXPOSED":
-			femaleGenitaliaExposed = r.Score
-			if r.Score >= 0.5 {
-				hasHighExposed = true
-			}
-			if r.Score >= 0.2 {
-				exposedCount++
-			}
-		case "MALE_GENITALIA_EXPOSED":
-			maleGenitaliaExposed = r.Score
-			if r.Score >= 0.5 {
-				hasHighExposed = true
-			}
-			if r.Score >= 0.2 {
-				exposedCount++
-			}
-		case "ANUS_EXPOSED":
-			anusExposed = r.Score
-			if r.Score >= 0.5 {
-				hasHighExposed = true
-			}
-			if r.Score >= 0.2 {
-				exposedCount++
-			}
-		case "BELLY_EXPOSED":
-			bellyExposed = r.Score
-			if r.Score >= 0.3 {
-				exposedCount++
+		box := r.NormalizedBox
+		if box != nil && box.Area() < policy.Classes[r.Class].MinArea {
+			continue
+		}
+
+		agg, ok := classes[r.Class]
+		if !ok {
+			agg = &classAggregate{centerOffset: 1}
+			classes[r.Class] = agg
+		}
+		if agg.count == 0 || r.Score > agg.maxScore {
+			agg.maxScore = r.Score
+		}
+		if agg.count == 0 || r.Score < agg.minScore {
+			agg.minScore = r.Score
+		}
+		agg.count++
+		if box == nil {
+			continue
+		}
+
+		agg.hasBox = true
+		agg.area += box.Area()
+		agg.maxArea = math.Max(agg.maxArea, box.Area())
+		agg.centerOffset = math.Min(agg.centerOffset, centerOffset(*box))
+	}
+
+	// Overlapping boxes can add up past the whole image
+	for _, agg := range classes {
+		agg.area = math.Min(agg.area, 1)
+	}
+	return classes
+}
+
+// classMeasures returns the aggregates for an event, highest scoring class first
+func classMeasures(classes map[string]*classAggregate) []models.ClassMeasures {
+	measures := make([]models.ClassMeasures, 0, len(classes))
+	for class, agg := range classes {
+		measures = append(measures, models.ClassMeasures{
+			Class:        class,
+			MaxScore:     agg.maxScore,
+			MinScore:     agg.minScore,
+			Count:        agg.count,
+			Area:         agg.area,
+			MaxArea:      agg.maxArea,
+			CenterOffset: agg.centerOffset,
+			HasBox:       agg.hasBox,
+		})
+	}
+	sort.Slice(measures, func(i, j int) bool {
+		if measures[i].MaxScore != measures[j].MaxScore {
+			return measures[i].MaxScore > measures[j].MaxScore
+		}
+		return measures[i].Class < measures[j].Class
+	})
+	return measures
+}
+
+// score combines the detection scores of the class with the policy aggregate mode
+func (agg *classAggregate) score(mode string) float64 {
+	if mode == AggregateMin {
+		return agg.minScore
+	}
+	return agg.maxScore
+}
+
+// centerOffset returns how far the box centre is from the image centre, scaled so a corner is 1
+func centerOffset(box models.NormalizedBox) float64 {
+	dx := box.X + box.Width/2 - 0.5
+	dy := box.Y + box.Height/2 - 0.5
+	return math.Hypot(dx, dy) / math.Sqrt2 * 2
+}
+
+// classFeatures holds the per-class measures and metrics the policy rules are evaluated against
+type classFeatures struct {
+	scores   map[string]float64
+	classes  map[string]*classAggregate
+	metrics  map[string]float64
+	unscaled map[string]bool // Classes whose score bounds sensitivity does not scale
+}
+
+// extractFeatures scores the declared classes and computes the policy metrics
+func extractFeatures(policy *Policy, classes map[string]*classAggregate) classFeatures {
+	features := classFeatures{
+		scores:   make(map[string]float64, len(policy.Classes)),
+		classes:  classes,
+		metrics:  make(map[string]float64, len(policyMetrics)),
+		unscaled: make(map[string]bool),
+	}
+
+	exposedCount := 0
+	for class, cp := range policy.Classes {
+		// Classes that are not detected use their missing score
+		score := cp.Missing
+		if agg, ok := classes[class]; ok {
+			score = agg.score(cp.Aggregate)
+		}
+		features.scores[class] = score
+		if !cp.scalable() {
+			features.unscaled[class] = true
+		}
+
+		if cp.ExposedThreshold > 0 && score >= cp.ExposedThreshold {
+			exposedCount++
+		}
+	}
+	features.metrics[MetricExposedCount] = float64(exposedCount)
+
+	return features
+}
+
+// evaluate reports whether the rule holds for the features and returns the conditions that held
+func (r Rule) evaluate(f classFeatures, scale float64) ([]Evidence, bool) {
+	var held []Evidence
+
+	if len(r.Any) > 0 {
+		for _, cond := range r.Any {
+			if cond.holds(f, scale) {
+				held = append(held, cond.evidence(f, scale))
 			}
-		case "BUTTOCKS_EXPOSED":
-			buttocksExposed = r.Score
-			if r.Score >= 0.3 {
-				exposedCount++
+		}
+		if len(held) == 0 {
+			return nil, false
+		}
+	}
+
+	for _, cond := range r.All {
+		if !cond.holds(f, scale) {
+			return nil, false
+		}
+		held = append(held, cond.evidence(f, scale))
+	}
+	return held, true
+}
+
+// nearMiss returns the failing conditions of the rule and whether each is within margin of holding.
+// For the any group only its closest condition has to come near.
+func (r Rule) nearMiss(f classFeatures, scale, margin float64) ([]Evidence, bool) {
+	var failed []Evidence
+
+	if len(r.Any) > 0 {
+		anyHeld := false
+		var closest *Condition
+		for i, cond := range r.Any {
+			if cond.holds(f, scale) {
+				anyHeld = true
+				break
 			}
-		case "ARMPITS_EXPOSED":
-			armpitsExposed = r.Score
-			if r.Score >= 0.3 {
-				exposedCount++
+			if closest == nil || cond.gap(f, scale) < closest.gap(f, scale) {
+				closest = &r.Any[i]
 			}
-		case "FEET_EXPOSED":
-			feetExposed = r.Score
-		case "FEMALE_BREAST_COVERED":
-			if r.Score < femaleBreastCovered {
-				femaleBreastCovered = r.Score
+		}
+		if !anyHeld {
+			if closest.gap(f, scale) > closest.margin(margin) {
+				return nil, false
 			}
+			failed = append(failed, closest.evidence(f, scale))
 		}
 	}
 
-	// Check for category 4: high NSFW (explicit)
-	if hasHighExposed || exposedCount > 2 {
-		return 3
+	for _, cond := range r.All {
+		if cond.holds(f, scale) {
+			continue
+		}
+		if cond.gap(f, scale) > cond.margin(margin) {
+			return nil, false
+		}
+		failed = append(failed, cond.evidence(f, scale))
 	}
 
-	// Check for category 3: moderate NSFW (minimal clothing)
-	if buttocksExposed >= 0.5 || (bellyExposed >= 0.5 && femaleBreastCovered < 0.4) {
-		if femaleBreastExposed < 0.5 && femaleGenitaliaExposed < 0.3 && maleGenitaliaExposed < 0.3 && anusExposed < 0.3 {
-			return 2
-		}
+	return failed, len(failed) > 0
+}
+
+// holds evaluates the condition against the features
+func (c Condition) holds(f classFeatures, scale float64) bool {
+	return compare(c.observed(f), c.Op, c.threshold(f, scale))
+}
+
+// threshold returns the value compared against. Only lower bounds on scalable class scores are
+// scaled: the upper bounds of a rule exclude higher levels and must keep matching those rules, and
+// a score that is no risk (how covered a region is) would move levels the wrong way.
+func (c Condition) threshold(f classFeatures, scale float64) float64 {
+	if c.Metric != "" || (c.Measure != "" && c.Measure != MeasureScore) || f.unscaled[c.Class] {
+		return c.Value
 	}
+	if c.Op != ">=" && c.Op != ">" {
+		return c.Value
+	}
+	return math.Min(c.Value*scale, 1)
+}
 
-	// Check for category 2: mild NSFW (casual sensual)
-	if (bellyExposed >= 0.5 || armpitsExposed >= 0.5 || feetExposed >= 0.5) && femaleBreastCovered >= 0.4 {
-		if femaleBreastExposed < 0.3 && femaleGenitaliaExposed < 0.3 && maleGenitaliaExposed < 0.3 && anusExposed < 0.3 {
-			return 1
-		}
+// observed returns the class measure or metric value the condition compares
+func (c Condition) observed(f classFeatures) float64 {
+	if c.Metric != "" {
+		return f.metrics[c.Metric]
 	}
 
-	// Check for category 1: not NSFW (safe)
-	if femaleBreastExposed < 0.2 && femaleGenitaliaExposed < 0.2 && maleGenitaliaExposed < 0.2 && anusExposed < 0.2 &&
-		bellyExposed < 0.3 && buttocksExposed < 0.3 && armpitsExposed < 0.3 {
+	agg, detected := f.classes[c.Class]
+	switch c.Measure {
+	case MeasureCount:
+		if detected {
+			return float64(agg.count)
+		}
+		return 0
+	case MeasureArea:
+		if detected {
+			return agg.area
+		}
+		return 0
+	case MeasureMaxArea:
+		if detected {
+			return agg.maxArea
+		}
 		return 0
+	case MeasureCenterOffset:
+		// Undetected classes or missing boxes are as far from the centre as possible
+		if detected && agg.hasBox {
+			return agg.centerOffset
+		}
+		return 1
+	}
+	return f.scores[c.Class]
+}
+
+// gap returns how far the observed value is from the condition's threshold
+func (c Condition) gap(f classFeatures, scale float64) float64 {
+	return math.Abs(c.observed(f) - c.threshold(f, scale))
+}
+
+// margin returns the near-miss margin for the condition; counts are near within one
+func (c Condition) margin(scoreMargin float64) float64 {
+	if c.Metric == MetricExposedCount || c.Measure == MeasureCount {
+		return 1
 	}
+	return scoreMargin
+}
 
-	// Default to mild if no clear category
-	return 1
+// evidence records the condition with the observed value
+func (c Condition) evidence(f classFeatures, scale float64) Evidence {
+	return Evidence{
+		Class:     c.Class,
+		Measure:   c.Measure,
+		Metric:    c.Metric,
+		Observed:  c.observed(f),
+		Op:        c.Op,
+		Threshold: c.threshold(f, scale),
+	}
+}
+
+// compare applies a policy comparison operator
+func compare(observed float64, op string, value float64) bool {
+	switch op {
+	case ">=":
+		return observed >= value
+	case ">":
+		return observed > value
+	case "<":
+		return observed < value
+	case "<=":
+		return observed <= value
+	}
+	return false
 }
@@ -0,0 +1,400 @@
+package services
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"go-gin-project/internal/models"
+)
+
+// The golden corpus holds recorded detector outputs (models.APIResponse JSON) in testdata/golden
+// and the expected decision of each fixture per sensitivity profile in expected.json. A fixture may
+// add the "image_size" of the upload, its boxes are then normalized like the handler does so the
+// geometry measures (min_area, area, max_area, center_offset) take part in the decision.
+//
+// Re-record the expectations after an intended policy change:
+//
+//	go test ./internal/services -run TestClassifyNSFWGolden -update
+//
+// Check a candidate policy against the recorded expectations without changing them:
+//
+//	go test ./internal/services -run TestClassifyNSFWGolden -golden.policy path/to/candidate.yaml
+var (
+	updateGolden = flag.Bool("update", false, "re-record testdata/golden/expected.json from the current policy")
+	goldenPolicy = flag.String("golden.policy", "", "classify the golden corpus with this policy file instead of the built-in one")
+)
+
+const (
+	goldenDir          = "testdata/golden"
+	goldenExpectations = "expected.json"
+)
+
+// goldenDecision is the recorded outcome of one fixture under one profile
+type goldenDecision struct {
+	Level int    `json:"level"`
+	Rule  string `json:"rule"`
+}
+
+// goldenFixture is one recorded detector response, with the upload size when it was recorded
+type goldenFixture struct {
+	models.APIResponse
+	ImageSize ImageSize `json:"image_size"`
+}
+
+// goldenFile is the expectations document: fixture name -> profile -> decision
+type goldenFile struct {
+	PolicyVersion string                               `json:"policy_version"`
+	Fixtures      map[string]map[string]goldenDecision `json:"fixtures"`
+}
+
+func TestClassifyNSFWGolden(t *testing.T) {
+	policy := DefaultPolicy()
+	if *goldenPolicy != "" {
+		var err error
+		if policy, err = LoadPolicyFile(*goldenPolicy); err != nil {
+			t.Fatalf("load policy: %v", err)
+		}
+	}
+
+	fixtures := loadGoldenFixtures(t)
+	profiles := make([]string, 0, len(policy.Profiles))
+	for name := range policy.Profiles {
+		profiles = append(profiles, name)
+	}
+	sort.Strings(profiles)
+
+	got := goldenFile{PolicyVersion: policy.Version, Fixtures: make(map[string]map[string]goldenDecision, len(fixtures))}
+	for name, fixture := range fixtures {
+		results := NormalizeBoxes(fixture.Results, fixture.ImageSize)
+		got.Fixtures[name] = make(map[string]goldenDecision, len(profiles))
+		for _, profile := range profiles {
+			sensitivity, err := policy.Sensitivity(profile, nil)
+			if err != nil {
+				t.Fatalf("profile %s: %v", profile, err)
+			}
+			decision := ClassifyNSFW(policy, results, sensitivity, nil)
+			got.Fixtures[name][profile] = goldenDecision{Level: decision.Level, Rule: decision.Rule}
+		}
+	}
+
+	path := filepath.Join(goldenDir, goldenExpectations)
+	if *updateGolden {
+		data, err := json.MarshalIndent(got, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+			t.Fatalf("write expectations: %v", err)
+		}
+		t.Logf("recorded %d fixtures for policy %s", len(got.Fixtures), policy.Version)
+		return
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read expectations (run with -update to record them): %v", err)
+	}
+	var want goldenFile
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatalf("parse expectations: %v", err)
+	}
+
+	// Report every changed fixture, not just the first, so a policy change can be reviewed as a whole
+	var changes []string
+	for _, name := range sortedKeys(got.Fixtures) {
+		wantProfiles, ok := want.Fixtures[name]
+		if !ok {
+			changes = append(changes, name+": no expectation recorded")
+			continue
+		}
+		for _, profile := range profiles {
+			w, ok := wantProfiles[profile]
+			if !ok {
+				changes = append(changes, name+" ["+profile+"]: no expectation recorded")
+				continue
+			}
+			g := got.Fixtures[name][profile]
+			if g.Level != w.Level {
+				changes = append(changes, fmt.Sprintf("%s [%s]: level %d (%s) -> %d (%s)", name, profile, w.Level, w.Rule, g.Level, g.Rule))
+			} else if g.Rule != w.Rule {
+				t.Logf("%s [%s]: same level %d, rule %s -> %s", name, profile, g.Level, w.Rule, g.Rule)
+			}
+		}
+	}
+	for _, name := range sortedKeys(want.Fixtures) {
+		if _, ok := got.Fixtures[name]; !ok {
+			changes = append(changes, name+": fixture missing from "+goldenDir)
+		}
+	}
+
+	if len(changes) > 0 {
+		t.Errorf("policy %s changed %d golden decisions (recorded with %s):\n  %s\nre-record with -update if the change is intended",
+			policy.Version, len(changes), want.PolicyVersion, strings.Join(changes, "\n  "))
+	}
+}
+
+// geometryPolicy only decides on box geometry, the default policy has no geometry conditions
+const geometryPolicy = `
+version: test-geometry
+classes:
+  BELLY_EXPOSED: { min_area: 0.01 }
+  FEMALE_BREAST_EXPOSED: {}
+rules:
+  - name: central_breast
+    level: 3
+    all:
+      - { class: FEMALE_BREAST_EXPOSED, op: ">=", value: 0.5 }
+      - { class: FEMALE_BREAST_EXPOSED, measure: center_offset, op: "<=", value: 0.3 }
+  - name: large_belly
+    level: 2
+    all:
+      - { class: BELLY_EXPOSED, op: ">=", value: 0.5 }
+      - { class: BELLY_EXPOSED, measure: max_area, op: ">=", value: 0.1 }
+  - name: belly
+    level: 1
+    all:
+      - { class: BELLY_EXPOSED, op: ">=", value: 0.5 }
+default_level: 0
+profiles: { standard: {} }
+default_profile: standard
+`
+
+func TestClassifyNSFWGeometry(t *testing.T) {
+	policy, err := ParsePolicy([]byte(geometryPolicy))
+	if err != nil {
+		t.Fatalf("parse policy: %v", err)
+	}
+
+	size := ImageSize{Width: 1000, Height: 1000}
+	tests := []struct {
+		name    string
+		size    ImageSize
+		results []models.DetectionResult
+		level   int
+		rule    string
+	}{
+		{
+			name:    "central breast",
+			size:    size,
+			results: []models.DetectionResult{{Class: "FEMALE_BREAST_EXPOSED", Score: 0.6, Box: []int{400, 400, 200, 200}}},
+			level:   3, rule: "central_breast",
+		},
+		{
+			name:    "breast in the corner",
+			size:    size,
+			results: []models.DetectionResult{{Class: "FEMALE_BREAST_EXPOSED", Score: 0.6, Box: []int{0, 0, 100, 100}}},
+			level:   0, rule: DefaultRuleName,
+		},
+		{
+			name: "most central of two breast boxes counts",
+			size: size,
+			results: []models.DetectionResult{
+				{Class: "FEMALE_BREAST_EXPOSED", Score: 0.6, Box: []int{0, 0, 100, 100}},
+				{Class: "FEMALE_BREAST_EXPOSED", Score: 0.3, Box: []int{450, 450, 100, 100}},
+			},
+			level: 3, rule: "central_breast",
+		},
+		{
+			name:    "unknown size puts every box in the corner",
+			results: []models.DetectionResult{{Class: "FEMALE_BREAST_EXPOSED", Score: 0.6, Box: []int{400, 400, 200, 200}}},
+			level:   0, rule: DefaultRuleName,
+		},
+		{
+			name:    "large belly",
+			size:    size,
+			results: []models.DetectionResult{{Class: "BELLY_EXPOSED", Score: 0.6, Box: []int{300, 300, 400, 300}}},
+			level:   2, rule: "large_belly",
+		},
+		{
+			name:    "belly box clipped to the image",
+			size:    size,
+			results: []models.DetectionResult{{Class: "BELLY_EXPOSED", Score: 0.6, Box: []int{850, 850, 400, 400}}},
+			level:   1, rule: "belly",
+		},
+		{
+			name:    "belly below min_area is dropped",
+			size:    size,
+			results: []models.DetectionResult{{Class: "BELLY_EXPOSED", Score: 0.9, Box: []int{10, 10, 50, 50}}},
+			level:   0, rule: DefaultRuleName,
+		},
+		{
+			name:    "min_area needs the image size",
+			results: []models.DetectionResult{{Class: "BELLY_EXPOSED", Score: 0.9, Box: []int{10, 10, 50, 50}}},
+			level:   1, rule: "belly",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := ClassifyNSFW(policy, NormalizeBoxes(tt.results, tt.size), Sensitivity{}, nil)
+			if decision.Level != tt.level || decision.Rule != tt.rule {
+				t.Errorf("got level %d (%s), want %d (%s)", decision.Level, decision.Rule, tt.level, tt.rule)
+			}
+		})
+	}
+}
+
+func TestClassifyNSFWScaling(t *testing.T) {
+	policy := DefaultPolicy()
+	profile := func(name string) Sensitivity {
+		sensitivity, err := policy.Sensitivity(name, nil)
+		if err != nil {
+			t.Fatalf("profile %s: %v", name, err)
+		}
+		return sensitivity
+	}
+	app := func(mild float64) *models.AppPolicy {
+		return &models.AppPolicy{Application: "chat", Scales: &models.SensitivityScales{Mild: mild}}
+	}
+
+	// Casual sensual is level 1: belly is a scaled risk bound, the covered breast is not scalable
+	// and the exposed breast is an upper bound, both keep their policy values. Images it misses
+	// fall back to the default rule.
+	tests := []struct {
+		name        string
+		sensitivity Sensitivity
+		appPolicy   *models.AppPolicy
+		belly       float64
+		covered     float64
+		level       int
+		rule        string
+		threshold   float64 // Of the belly condition when casual sensual matched
+	}{
+		{name: "standard", sensitivity: profile("standard"), belly: 0.5, covered: 0.4, level: 1, rule: "casual_sensual", threshold: 0.5},
+		{name: "strict lowers risk bounds", sensitivity: profile("strict"), belly: 0.3, covered: 0.4, level: 1, rule: "casual_sensual", threshold: 0.3},
+		{name: "strict keeps the covered bound", sensitivity: profile("strict"), belly: 0.3, covered: 0.3, level: 1, rule: DefaultRuleName},
+		{name: "relaxed raises risk bounds", sensitivity: profile("relaxed"), belly: 0.6, covered: 0.45, level: 1, rule: DefaultRuleName},
+		{name: "relaxed keeps the covered bound", sensitivity: profile("relaxed"), belly: 0.7, covered: 0.45, level: 1, rule: "casual_sensual", threshold: 0.65},
+		{name: "app scales on top of standard", sensitivity: profile("standard"), appPolicy: app(0.5), belly: 0.25, covered: 0.4, level: 1, rule: "casual_sensual", threshold: 0.25},
+		{name: "app scales on top of strict", sensitivity: profile("strict"), appPolicy: app(0.5), belly: 0.15, covered: 0.4, level: 1, rule: "casual_sensual", threshold: 0.15},
+		{name: "app keeps the covered bound", sensitivity: profile("standard"), appPolicy: app(0.5), belly: 0.3, covered: 0.2, level: 1, rule: DefaultRuleName},
+		{name: "scaled bounds stop at 1", sensitivity: profile("relaxed"), appPolicy: app(2), belly: 0.99, covered: 0.45, level: 1, rule: DefaultRuleName},
+		{name: "unset app scales keep the sensitivity", sensitivity: profile("strict"), appPolicy: app(0), belly: 0.3, covered: 0.4, level: 1, rule: "casual_sensual", threshold: 0.3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := []models.DetectionResult{
+				{Class: "BELLY_EXPOSED", Score: tt.belly},
+				{Class: "FEMALE_BREAST_COVERED", Score: tt.covered},
+			}
+			decision := ClassifyNSFW(policy, results, tt.sensitivity, tt.appPolicy)
+			if decision.Level != tt.level || decision.Rule != tt.rule {
+				t.Fatalf("got level %d (%s), want %d (%s)", decision.Level, decision.Rule, tt.level, tt.rule)
+			}
+			if tt.rule != "casual_sensual" {
+				return
+			}
+
+			want := map[string]float64{"BELLY_EXPOSED": tt.threshold, "FEMALE_BREAST_COVERED": 0.4, "FEMALE_BREAST_EXPOSED": 0.3}
+			for _, evidence := range decision.Contributing {
+				threshold, ok := want[evidence.Class]
+				if !ok {
+					continue
+				}
+				if math.Abs(evidence.Threshold-threshold) > 1e-9 {
+					t.Errorf("%s %s threshold %v, want %v", evidence.Class, evidence.Op, evidence.Threshold, threshold)
+				}
+				delete(want, evidence.Class)
+			}
+			if len(want) > 0 {
+				t.Errorf("no evidence for %v in %+v", sortedKeys(want), decision.Contributing)
+			}
+		})
+	}
+}
+
+func TestReclassifyNSFW(t *testing.T) {
+	policy := DefaultPolicy()
+	strict, err := policy.Sensitivity("strict", nil)
+	if err != nil {
+		t.Fatalf("profile: %v", err)
+	}
+	gallery := &models.AppPolicy{Application: "gallery", IgnoredClasses: []string{"BELLY_EXPOSED"}}
+
+	// The stored measures classify every golden fixture like its detections did
+	for name, fixture := range loadGoldenFixtures(t) {
+		results := NormalizeBoxes(fixture.Results, fixture.ImageSize)
+		for _, sensitivity := range []Sensitivity{{}, strict} {
+			for _, appPolicy := range []*models.AppPolicy{nil, gallery} {
+				live := ClassifyNSFW(policy, results, sensitivity, appPolicy)
+				stored := ClassifyNSFW(policy, results, Sensitivity{}, nil).Classes
+				again := ReclassifyNSFW(policy, stored, sensitivity, appPolicy)
+				if again.Level != live.Level || again.Rule != live.Rule {
+					t.Errorf("%s [%s, app %v]: reclassified %d (%s), live %d (%s)",
+						name, sensitivity.Profile, appPolicy != nil, again.Level, again.Rule, live.Level, live.Rule)
+				}
+			}
+		}
+	}
+
+	// Covered breasts aggregate to the lowest score, a second stronger box must not hide the weak one
+	results := []models.DetectionResult{
+		{Class: "BELLY_EXPOSED", Score: 0.7},
+		{Class: "FEMALE_BREAST_COVERED", Score: 0.3},
+		{Class: "FEMALE_BREAST_COVERED", Score: 0.9},
+	}
+	live := ClassifyNSFW(policy, results, Sensitivity{}, nil)
+	if live.Rule != "minimal_clothing_belly" {
+		t.Fatalf("live rule %s", live.Rule)
+	}
+	if again := ReclassifyNSFW(policy, live.Classes, Sensitivity{}, nil); again.Rule != live.Rule {
+		t.Errorf("reclassified as %s, live %s", again.Rule, live.Rule)
+	}
+
+	// Ignored classes are measured too, so a later application override can change its mind
+	ignored := ClassifyNSFW(policy, results, Sensitivity{}, gallery)
+	if len(ignored.Classes) != 2 || ignored.Classes[0].Class != "FEMALE_BREAST_COVERED" || ignored.Classes[0].Count != 2 || ignored.Classes[0].MinScore != 0.3 {
+		t.Errorf("classes %+v", ignored.Classes)
+	}
+	if again := ReclassifyNSFW(policy, ignored.Classes, Sensitivity{}, nil); again.Rule != "minimal_clothing_belly" {
+		t.Errorf("without the override reclassified as %s", again.Rule)
+	}
+}
+
+// loadGoldenFixtures reads every recorded detector response in the golden directory
+func loadGoldenFixtures(t *testing.T) map[string]goldenFixture {
+	t.Helper()
+
+	paths, err := filepath.Glob(filepath.Join(goldenDir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fixtures := make(map[string]goldenFixture, len(paths))
+	for _, path := range paths {
+		if filepath.Base(path) == goldenExpectations {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fixture goldenFixture
+		if err := json.Unmarshal(data, &fixture); err != nil {
+			t.Fatalf("parse %s: %v", path, err)
+		}
+		fixtures[strings.TrimSuffix(filepath.Base(path), ".json")] = fixture
+	}
+	if len(fixtures) == 0 {
+		t.Fatalf("no fixtures in %s", goldenDir)
+	}
+	return fixtures
+}
+
+// sortedKeys returns the map keys in order so reports are stable
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"math/bits"
+
+	"golang.org/x/image/draw"
+)
+
+// dHashSize is the side of the difference hash grid. 16x16 gives a 256-bit hash: a 64-bit dHash is
+// coarse enough that screenshots differing only in a small region (one flagged photo in a chat)
+// collide, and a collision here would reuse another image's detections.
+const dHashSize = 16
+
+// PerceptualHash identifies an image by its difference hash and pixel size. The size is part of the
+// identity because the detector's boxes are only valid for the resolution they were found at.
+type PerceptualHash struct {
+	Bits          [dHashSize * dHashSize / 64]uint64
+	Width, Height int
+}
+
+// String returns the hash as hex followed by the size, usable as a document ID
+func (h PerceptualHash) String() string {
+	buf := make([]byte, 8*len(h.Bits))
+	for i, word := range h.Bits {
+		binary.BigEndian.PutUint64(buf[8*i:], word)
+	}
+	return fmt.Sprintf("%s-%dx%d", hex.EncodeToString(buf), h.Width, h.Height)
+}
+
+// Distance returns the number of differing hash bits, or -1 when the sizes differ
+func (h PerceptualHash) Distance(other PerceptualHash) int {
+	if h.Width != other.Width || h.Height != other.Height {
+		return -1
+	}
+	distance := 0
+	for i := range h.Bits {
+		distance += bits.OnesCount64(h.Bits[i] ^ other.Bits[i])
+	}
+	return distance
+}
+
+// HashImage returns the perceptual hash of the upright upload, ok is false when it cannot be decoded.
+// Orientation matters because cached boxes are in upright coordinates.
+func HashImage(upload *Upload) (hash PerceptualHash, ok bool) {
+	img, err := upload.Image()
+	if err != nil {
+		return PerceptualHash{}, false
+	}
+	hash = DHash(img)
+	hash.Width, hash.Height = img.Bounds().Dx(), img.Bounds().Dy()
+	return hash, true
+}
+
+// DHash computes the difference hash of an image: it is shrunk to a (dHashSize+1) x dHashSize
+// grayscale grid and each bit records whether a pixel is brighter than its right neighbour.
+// Re-encoding flips a few bits at most, different content changes about half of them. The shrink
+// averages every source pixel into its cell: sampling a few pixels per cell misses a small pasted region.
+func DHash(img image.Image) PerceptualHash {
+	small := image.NewGray(image.Rect(0, 0, dHashSize+1, dHashSize))
+	draw.BiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	var hash PerceptualHash
+	bit := 0
+	for y := 0; y < dHashSize; y++ {
+		for x := 0; x < dHashSize; x++ {
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				hash.Bits[bit/64] |= 1 << (63 - bit%64)
+			}
+			bit++
+		}
+	}
+	return hash
+}
@@ -0,0 +1,240 @@
+package services
+
+import (
+	"bytes"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+
+	"go-gin-project/internal/models"
+)
+
+//go:embed policies/default.yaml
+var defaultPolicyDocument []byte
+
+// Policy is a declarative, versioned NSFW classification policy.
+// Rules are evaluated in order and the first matching rule decides the level.
+type Policy struct {
+	Version      string                 `yaml:"version"`
+	Classes      map[string]ClassPolicy `yaml:"classes"`
+	Rules        []Rule                 `yaml:"rules"`
+	DefaultLevel int                    `yaml:"default_level"` // Level when no rule matches
+
+	// NearMissMargin is how close a failing score condition must come to be reported as a near miss
+	NearMissMargin float64 `yaml:"near_miss_margin"`
+
+	// Sensitivity profiles users can choose, and the profile used when they have not chosen one
+	Profiles       map[string]models.SensitivityScales `yaml:"profiles"`
+	DefaultProfile string                              `yaml:"default_profile"`
+	AgeProfiles    []AgeProfile                        `yaml:"age_profiles"` // First band containing the user's age wins
+}
+
+// AgeProfile assigns a sensitivity profile to users up to MaxAge (inclusive)
+type AgeProfile struct {
+	MaxAge  int    `yaml:"max_age"`
+	Profile string `yaml:"profile"`
+}
+
+// ClassPolicy describes how detections of one class are scored. Repeated detections
+// of a class are combined first, by Aggregate.
+type ClassPolicy struct {
+	ExposedThreshold float64 `yaml:"exposed_threshold"` // Score from which the class counts toward exposed_count, 0 = never
+	Missing          float64 `yaml:"missing"`           // Score used when the class is not detected
+	MinArea          float64 `yaml:"min_area"`          // Boxes covering less of the image are ignored, 0 = keep all
+	Aggregate        string  `yaml:"aggregate"`         // How repeated detection scores combine: "max" (default) or "min"
+	Scalable         *bool   `yaml:"scalable"`          // Whether sensitivity scales score bounds on the class, default true; false for scores that are no risk (how covered)
+}
+
+// scalable reports whether sensitivity scales score bounds on the class
+func (cp ClassPolicy) scalable() bool {
+	return cp.Scalable == nil || *cp.Scalable
+}
+
+// Rule assigns Level when at least one Any condition (or Any is empty) and every All condition hold
+type Rule struct {
+	Name  string      `yaml:"name"`
+	Level int         `yaml:"level"`
+	Any   []Condition `yaml:"any"`
+	All   []Condition `yaml:"all"`
+}
+
+// Condition compares a class measure or a metric against Value
+type Condition struct {
+	Class   string  `yaml:"class,omitempty"`   // Class whose measure is compared
+	Measure string  `yaml:"measure,omitempty"` // Class measure, "score" by default, see policyMeasures
+	Metric  string  `yaml:"metric,omitempty"`  // Metric compared instead of a class measure, see policyMetrics
+	Op      string  `yaml:"op"`                // One of >=, >, <, <=
+	Value   float64 `yaml:"value"`
+}
+
+// Aggregation modes for repeated detections of a class
+const (
+	AggregateMax = "max"
+	AggregateMin = "min" // For "covered" classes, where the least covered detection decides
+)
+
+// Class measures a condition can compare
+const (
+	MeasureScore = "score" // Aggregated detection score, or the class missing score when not detected
+	MeasureCount = "count" // Number of detections of the class
+	MeasureArea  = "area"  // Summed box area as a fraction of the image, 0 when the image size is unknown
+
+	MeasureMaxArea      = "max_area"      // Largest single box as a fraction of the image
+	MeasureCenterOffset = "center_offset" // Distance of the most central box from the image centre, 0 = centre, 1 = corner or unknown
+)
+
+// MetricExposedCount counts classes whose score is at or above their exposed_threshold
+const MetricExposedCount = "exposed_count"
+
+var (
+	policyMeasures = map[string]bool{
+		MeasureScore: true, MeasureCount: true, MeasureArea: true,
+		MeasureMaxArea: true, MeasureCenterOffset: true,
+	}
+	policyMetrics = map[string]bool{MetricExposedCount: true}
+	policyOps     = map[string]bool{">=": true, ">": true, "<": true, "<=": true}
+)
+
+// ErrInvalidPolicy is returned when a policy document fails validation
+var ErrInvalidPolicy = errors.New("invalid classification policy")
+
+// DefaultPolicy returns the built-in policy embedded from policies/default.yaml
+func DefaultPolicy() *Policy {
+	policy, err := ParsePolicy(defaultPolicyDocument)
+	if err != nil {
+		// The embedded document is part of the build, failing here is a programming error
+		panic(fmt.Sprintf("built-in classification policy: %v", err))
+	}
+	return policy
+}
+
+// LoadPolicyFile reads and validates a YAML or JSON policy document from path
+func LoadPolicyFile(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read policy %s: %w", path, err)
+	}
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("policy %s: %w", path, err)
+	}
+	return policy, nil
+}
+
+// ParsePolicy decodes and validates a YAML or JSON policy document. Unknown fields are rejected.
+func ParsePolicy(data []byte) (*Policy, error) {
+	var policy Policy
+
+	// JSON is valid YAML, so a single decoder handles both formats
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPolicy, err)
+	}
+
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// Validate checks that the policy is complete and internally consistent
+func (p *Policy) Validate() error {
+	if p.Version == "" {
+		return fmt.Errorf("%w: version is required", ErrInvalidPolicy)
+	}
+	if len(p.Rules) == 0 {
+		return fmt.Errorf("%w: at least one rule is required", ErrInvalidPolicy)
+	}
+	if !validLevel(p.DefaultLevel) {
+		return fmt.Errorf("%w: default_level %d must be between 0 and 3", ErrInvalidPolicy, p.DefaultLevel)
+	}
+
+	if p.NearMissMargin < 0 || p.NearMissMargin > 1 {
+		return fmt.Errorf("%w: near_miss_margin must be between 0 and 1", ErrInvalidPolicy)
+	}
+
+	for class, cp := range p.Classes {
+		switch cp.Aggregate {
+		case "", AggregateMax, AggregateMin:
+		default:
+			return fmt.Errorf("%w: class %s: unknown aggregate %q", ErrInvalidPolicy, class, cp.Aggregate)
+		}
+		if cp.ExposedThreshold < 0 || cp.ExposedThreshold > 1 || cp.Missing < 0 || cp.Missing > 1 || cp.MinArea < 0 || cp.MinArea > 1 {
+			return fmt.Errorf("%w: class %s: scores must be between 0 and 1", ErrInvalidPolicy, class)
+		}
+	}
+
+	if err := p.validateProfiles(); err != nil {
+		return err
+	}
+
+	names := make(map[string]bool)
+	for i, rule := range p.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("%w: rule %d has no name", ErrInvalidPolicy, i)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("%w: duplicate rule name %q", ErrInvalidPolicy, rule.Name)
+		}
+		names[rule.Name] = true
+
+		if !validLevel(rule.Level) {
+			return fmt.Errorf("%w: rule %s: level %d must be between 0 and 3", ErrInvalidPolicy, rule.Name, rule.Level)
+		}
+		if len(rule.Any) == 0 && len(rule.All) == 0 {
+			return fmt.Errorf("%w: rule %s has no conditions", ErrInvalidPolicy, rule.Name)
+		}
+		for _, cond := range append(append([]Condition(nil), rule.Any...), rule.All...) {
+			if err := p.validateCondition(cond); err != nil {
+				return fmt.Errorf("%w: rule %s: %v", ErrInvalidPolicy, rule.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// nearMissMargin returns the configured near-miss margin or the default
+func (p *Policy) nearMissMargin() float64 {
+	if p.NearMissMargin > 0 {
+		return p.NearMissMargin
+	}
+	return defaultNearMissMargin
+}
+
+// validateCondition checks a single rule condition against the declared classes and metrics
+func (p *Policy) validateCondition(cond Condition) error {
+	if !policyOps[cond.Op] {
+		return fmt.Errorf("unknown op %q", cond.Op)
+	}
+	switch {
+	case cond.Class != "" && cond.Metric != "":
+		return fmt.Errorf("condition on %s sets both class and metric", cond.Class)
+	case cond.Class != "":
+		if _, ok := p.Classes[cond.Class]; !ok {
+			return fmt.Errorf("class %s is not declared under classes", cond.Class)
+		}
+		if cond.Measure != "" && !policyMeasures[cond.Measure] {
+			return fmt.Errorf("condition on %s: unknown measure %q", cond.Class, cond.Measure)
+		}
+	case cond.Metric != "":
+		if cond.Measure != "" {
+			return fmt.Errorf("metric %s does not take a measure", cond.Metric)
+		}
+		if !policyMetrics[cond.Metric] {
+			return fmt.Errorf("unknown metric %q", cond.Metric)
+		}
+	default:
+		return errors.New("condition needs a class or a metric")
+	}
+	return nil
+}
+
+// validLevel reports whether level is one of the NSFW levels 0-3
+func validLevel(level int) bool {
+	return level >= 0 && level <= 3
+}
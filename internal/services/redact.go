@@ -0,0 +1,190 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+
+	"go-gin-project/internal/models"
+)
+
+// Redaction modes
+const (
+	RedactPixelate = "pixelate"
+	RedactBlur     = "blur"
+)
+
+// ErrInvalidRedactMode is returned for a redaction mode other than pixelate or blur
+var ErrInvalidRedactMode = errors.New("invalid redaction mode")
+
+// RedactConfig selects which detections are hidden in a redacted preview
+type RedactConfig struct {
+	MinScore    float64  // Detections scoring lower are left visible
+	Classes     []string // Classes hidden when they reach MinScore
+	Padding     float64  // Margin added around each box as a fraction of its size, detector boxes are tight
+	JPEGQuality int
+}
+
+// DefaultRedactConfig hides the exposed intimate classes of the default policy
+func DefaultRedactConfig() RedactConfig {
+	return RedactConfig{
+		MinScore: 0.4,
+		Classes: []string{
+			"FEMALE_BREAST_EXPOSED", "FEMALE_GENITALIA_EXPOSED", "MALE_GENITALIA_EXPOSED",
+			"ANUS_EXPOSED", "BUTTOCKS_EXPOSED",
+		},
+		Padding:     0.1,
+		JPEGQuality: 85,
+	}
+}
+
+// ValidRedactMode reports whether mode is one of the redaction modes
+func ValidRedactMode(mode string) bool {
+	return mode == RedactPixelate || mode == RedactBlur
+}
+
+// RedactImage returns the upload as JPEG with every box of results matching cfg pixelated or blurred,
+// and the number of regions hidden. With upright the boxes are in the EXIF-oriented coordinates of the
+// upload and the output is upright too, otherwise both stay in the stored pixels; pass the Upright
+// flag of the detector response. The output carries no metadata.
+func RedactImage(upload *Upload, results []models.DetectionResult, upright bool, mode string, cfg RedactConfig) ([]byte, int, error) {
+	if !ValidRedactMode(mode) {
+		return nil, 0, fmt.Errorf("%w: %q", ErrInvalidRedactMode, mode)
+	}
+
+	src, err := upload.Pixels()
+	if upright {
+		src, err = upload.Image()
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: %v", ErrCorruptImage, err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Over)
+
+	classes := make(map[string]bool, len(cfg.Classes))
+	for _, class := range cfg.Classes {
+		classes[class] = true
+	}
+
+	// Strength scales with the image so a preview stays unrecognisable at any resolution
+	longest := max(img.Bounds().Dx(), img.Bounds().Dy())
+	block := max(8, longest/40)
+	radius := max(6, longest/60)
+
+	regions := 0
+	for _, r := range results {
+		if !classes[r.Class] || r.Score < cfg.MinScore || len(r.Box) != 4 {
+			continue
+		}
+		rect := paddedRect(r.Box, cfg.Padding).Intersect(img.Bounds())
+		if rect.Empty() {
+			continue
+		}
+
+		if mode == RedactPixelate {
+			pixelate(img, rect, block)
+		} else {
+			blur(img, rect, radius)
+		}
+		regions++
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: cfg.JPEGQuality}); err != nil {
+		return nil, 0, fmt.Errorf("encode redacted image: %w", err)
+	}
+	return buf.Bytes(), regions, nil
+}
+
+// paddedRect turns an [x, y, width, height] box into a rectangle grown by padding on every side
+func paddedRect(box []int, padding float64) image.Rectangle {
+	padX := int(math.Ceil(float64(box[2]) * padding))
+	padY := int(math.Ceil(float64(box[3]) * padding))
+	return image.Rect(box[0]-padX, box[1]-padY, box[0]+box[2]+padX, box[1]+box[3]+padY)
+}
+
+// pixelate replaces each block x block cell of rect with its average colour
+func pixelate(img *image.RGBA, rect image.Rectangle, block int) {
+	for y0 := rect.Min.Y; y0 < rect.Max.Y; y0 += block {
+		for x0 := rect.Min.X; x0 < rect.Max.X; x0 += block {
+			cell := image.Rect(x0, y0, x0+block, y0+block).Intersect(rect)
+
+			var sum [4]int
+			for y := cell.Min.Y; y < cell.Max.Y; y++ {
+				for x := cell.Min.X; x < cell.Max.X; x++ {
+					i := img.PixOffset(x, y)
+					for c := 0; c < 4; c++ {
+						sum[c] += int(img.Pix[i+c])
+					}
+				}
+			}
+
+			n := cell.Dx() * cell.Dy()
+			avg := color.RGBA{uint8(sum[0] / n), uint8(sum[1] / n), uint8(sum[2] / n), uint8(sum[3] / n)}
+			draw.Draw(img, cell, image.NewUniform(avg), image.Point{}, draw.Src)
+		}
+	}
+}
+
+// blur applies three passes of a box blur of the given radius inside rect, which approximates a
+// Gaussian blur. Pixels outside rect are neither changed nor sampled, so nothing leaks across the edge.
+func blur(img *image.RGBA, rect image.Rectangle, radius int) {
+	for pass := 0; pass < 3; pass++ {
+		for y := rect.Min.Y; y < rect.Max.Y; y++ {
+			boxBlurLine(img, rect.Min.X, rect.Max.X, radius, func(x int) int { return img.PixOffset(x, y) })
+		}
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			boxBlurLine(img, rect.Min.Y, rect.Max.Y, radius, func(y int) int { return img.PixOffset(x, y) })
+		}
+	}
+}
+
+// boxBlurLine averages each pixel of one row or column over a window of 2*radius+1 pixels, using a
+// running sum. offset maps a position in [from, to) to its index in img.Pix.
+func boxBlurLine(img *image.RGBA, from, to, radius int, offset func(int) int) {
+	n := to - from
+	line := make([][4]int, n)
+	for i := 0; i < n; i++ {
+		p := offset(from + i)
+		for c := 0; c < 4; c++ {
+			line[i][c] = int(img.Pix[p+c])
+		}
+	}
+
+	var sum [4]int
+	count := 0
+	// Window of the first pixel
+	for i := 0; i <= radius && i < n; i++ {
+		for c := 0; c < 4; c++ {
+			sum[c] += line[i][c]
+		}
+		count++
+	}
+	for i := 0; i < n; i++ {
+		p := offset(from + i)
+		for c := 0; c < 4; c++ {
+			img.Pix[p+c] = uint8(sum[c] / count)
+		}
+
+		// Slide the window one pixel to the right
+		if add := i + radius + 1; add < n {
+			for c := 0; c < 4; c++ {
+				sum[c] += line[add][c]
+			}
+			count++
+		}
+		if remove := i - radius; remove >= 0 {
+			for c := 0; c < 4; c++ {
+				sum[c] -= line[remove][c]
+			}
+			count--
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand/v2"
+	"testing"
+
+	"go-gin-project/internal/models"
+)
+
+// noiseImage returns random pixels, which pixelating or blurring any region visibly changes
+func noiseImage(width, height int) image.Image {
+	rng := rand.New(rand.NewPCG(1, 2))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(rng.IntN(256))
+		if i%4 == 3 {
+			img.Pix[i] = 255
+		}
+	}
+	return img
+}
+
+func TestRedactImage(t *testing.T) {
+	var pngBuf, jpegBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, noiseImage(64, 64)); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	if err := jpeg.Encode(&jpegBuf, noiseImage(64, 32), &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatalf("encode jpeg: %v", err)
+	}
+	square := pngBuf.Bytes()
+	rotated := withOrientation(jpegBuf.Bytes(), 6, binary.BigEndian) // 64x32 stored, 32x64 upright
+
+	cfg := RedactConfig{MinScore: 0.5, Classes: []string{"A", "B"}, JPEGQuality: 90}
+	padded := cfg
+	padded.Padding = 0.5
+
+	tests := []struct {
+		name    string
+		data    []byte
+		upright bool
+		cfg     RedactConfig
+		results []models.DetectionResult
+		size    image.Point
+		regions []image.Rectangle // Expected hidden regions, after padding and clipping
+	}{
+		{
+			name: "class and score filter",
+			data: square,
+			cfg:  cfg,
+			results: []models.DetectionResult{
+				{Class: "A", Score: 0.6, Box: []int{0, 0, 16, 16}},
+				{Class: "B", Score: 0.4, Box: []int{32, 32, 16, 16}},
+				{Class: "C", Score: 0.9, Box: []int{32, 0, 16, 16}},
+				{Class: "B", Score: 0.5, Box: []int{48, 48, 16, 16}},
+			},
+			size:    image.Pt(64, 64),
+			regions: []image.Rectangle{image.Rect(0, 0, 16, 16), image.Rect(48, 48, 64, 64)},
+		},
+		{
+			name:    "malformed box",
+			data:    square,
+			cfg:     cfg,
+			results: []models.DetectionResult{{Class: "A", Score: 0.9, Box: []int{1, 2, 3}}},
+			size:    image.Pt(64, 64),
+		},
+		{
+			name:    "padding grows the box",
+			data:    square,
+			cfg:     padded,
+			results: []models.DetectionResult{{Class: "A", Score: 0.9, Box: []int{24, 24, 16, 16}}},
+			size:    image.Pt(64, 64),
+			regions: []image.Rectangle{image.Rect(16, 16, 48, 48)},
+		},
+		{
+			name:    "padding is clipped at the image edges",
+			data:    square,
+			cfg:     padded,
+			results: []models.DetectionResult{{Class: "A", Score: 0.9, Box: []int{52, -4, 12, 12}}},
+			size:    image.Pt(64, 64),
+			regions: []image.Rectangle{image.Rect(46, 0, 64, 14)},
+		},
+		{
+			name:    "box outside the image",
+			data:    square,
+			cfg:     padded,
+			results: []models.DetectionResult{{Class: "A", Score: 0.9, Box: []int{70, 70, 10, 10}}},
+			size:    image.Pt(64, 64),
+		},
+		{
+			name:    "upright boxes",
+			data:    rotated,
+			upright: true,
+			cfg:     cfg,
+			results: []models.DetectionResult{{Class: "A", Score: 0.9, Box: []int{0, 48, 16, 16}}},
+			size:    image.Pt(32, 64),
+			regions: []image.Rectangle{image.Rect(0, 48, 16, 64)},
+		},
+		{
+			name:    "stored coordinate boxes",
+			data:    rotated,
+			cfg:     cfg,
+			results: []models.DetectionResult{{Class: "A", Score: 0.9, Box: []int{48, 0, 16, 16}}},
+			size:    image.Pt(64, 32),
+			regions: []image.Rectangle{image.Rect(48, 0, 64, 16)},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, mode := range []string{RedactPixelate, RedactBlur} {
+			t.Run(tt.name+"/"+mode, func(t *testing.T) {
+				upload := NewUpload(tt.data)
+				out, regions, err := RedactImage(upload, tt.results, tt.upright, mode, tt.cfg)
+				if err != nil {
+					t.Fatalf("redact: %v", err)
+				}
+				if regions != len(tt.regions) {
+					t.Errorf("got %d regions, want %d", regions, len(tt.regions))
+				}
+				// The same image with nothing hidden, it went through the same JPEG encoding
+				plain, _, err := RedactImage(upload, nil, tt.upright, mode, tt.cfg)
+				if err != nil {
+					t.Fatalf("redact nothing: %v", err)
+				}
+				checkRedacted(t, decodeJPEG(t, out), decodeJPEG(t, plain), tt.size, tt.regions)
+			})
+		}
+	}
+}
+
+func TestRedactImageInvalid(t *testing.T) {
+	if _, _, err := RedactImage(NewUpload(testPNG(t, 8, 8)), nil, false, "erase", DefaultRedactConfig()); !errors.Is(err, ErrInvalidRedactMode) {
+		t.Errorf("mode: got %v, want %v", err, ErrInvalidRedactMode)
+	}
+	if _, _, err := RedactImage(NewUpload([]byte("not an image")), nil, false, RedactBlur, DefaultRedactConfig()); !errors.Is(err, ErrCorruptImage) {
+		t.Errorf("data: got %v, want %v", err, ErrCorruptImage)
+	}
+}
+
+func decodeJPEG(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("decode output: %v", err)
+	}
+	return img
+}
+
+// checkRedacted compares the redacted output with the plain one. The JPEG encoder works in 16x16
+// blocks, so blocks clear of every region must come out identical. Inside a region, its edges
+// included, the pixels must have changed.
+func checkRedacted(t *testing.T, got, plain image.Image, size image.Point, regions []image.Rectangle) {
+	t.Helper()
+	if got.Bounds().Size() != size {
+		t.Fatalf("output size %v, want %v", got.Bounds().Size(), size)
+	}
+
+	for y0 := 0; y0 < size.Y; y0 += 16 {
+		for x0 := 0; x0 < size.X; x0 += 16 {
+			block := image.Rect(x0, y0, x0+16, y0+16).Intersect(got.Bounds())
+			touched := false
+			for _, region := range regions {
+				touched = touched || block.Overlaps(region)
+			}
+			if !touched && meanDiff(got, plain, block) != 0 {
+				t.Errorf("block %v outside the regions changed", block)
+			}
+		}
+	}
+
+	for _, region := range regions {
+		edges := []image.Rectangle{
+			region,
+			image.Rect(region.Min.X, region.Min.Y, region.Max.X, region.Min.Y+2),
+			image.Rect(region.Min.X, region.Max.Y-2, region.Max.X, region.Max.Y),
+			image.Rect(region.Min.X, region.Min.Y, region.Min.X+2, region.Max.Y),
+			image.Rect(region.Max.X-2, region.Min.Y, region.Max.X, region.Max.Y),
+		}
+		for _, rect := range edges {
+			if diff := meanDiff(got, plain, rect); diff < 16 {
+				t.Errorf("%v of region %v barely changed, mean difference %.1f", rect, region, diff)
+			}
+		}
+	}
+}
+
+// meanDiff is the mean absolute difference of the colour channels of a and b over rect, in 8-bit steps
+func meanDiff(a, b image.Image, rect image.Rectangle) float64 {
+	var sum, n float64
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			ca := color.RGBAModel.Convert(a.At(x, y)).(color.RGBA)
+			cb := color.RGBAModel.Convert(b.At(x, y)).(color.RGBA)
+			for _, d := range []int{int(ca.R) - int(cb.R), int(ca.G) - int(cb.G), int(ca.B) - int(cb.B)} {
+				sum += float64(max(d, -d))
+			}
+			n += 3
+		}
+	}
+	return sum / n
+}
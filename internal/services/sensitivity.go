@@ -0,0 +1,179 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"go-gin-project/internal/models"
+)
+
+// CustomProfile is the profile name for user supplied scales
+const CustomProfile = "custom"
+
+// ErrInvalidSensitivity is returned for an unknown profile or out of range custom scales
+var ErrInvalidSensitivity = errors.New("invalid sensitivity profile")
+
+// maxSensitivityScale bounds scales so a custom profile cannot switch rules off entirely
+const maxSensitivityScale = 2.0
+
+// Sensitivity is a resolved sensitivity profile applied by ClassifyNSFW. The zero value applies no scaling.
+type Sensitivity struct {
+	Profile string                   `json:"profile"`
+	Scales  models.SensitivityScales `json:"scales"`
+}
+
+// scale returns the threshold multiplier for rules of the given level
+func (s Sensitivity) scale(level int) float64 {
+	return levelScale(s.Scales, level)
+}
+
+// levelScale returns the multiplier in scales for a level, unset scales are 1
+func levelScale(scales models.SensitivityScales, level int) float64 {
+	var scale float64
+	switch level {
+	case 1:
+		scale = scales.Mild
+	case 2:
+		scale = scales.Moderate
+	case 3:
+		scale = scales.High
+	}
+	if scale == 0 {
+		return 1
+	}
+	return scale
+}
+
+// Sensitivity resolves a profile name; custom uses the given scales
+func (p *Policy) Sensitivity(profile string, custom *models.SensitivityScales) (Sensitivity, error) {
+	if profile == CustomProfile {
+		if custom == nil {
+			return Sensitivity{}, fmt.Errorf("%w: custom profile needs scales", ErrInvalidSensitivity)
+		}
+		if err := validateScales(*custom); err != nil {
+			return Sensitivity{}, err
+		}
+		return Sensitivity{Profile: CustomProfile, Scales: *custom}, nil
+	}
+
+	scales, ok := p.Profiles[profile]
+	if !ok {
+		return Sensitivity{}, fmt.Errorf("%w: %q", ErrInvalidSensitivity, profile)
+	}
+	return Sensitivity{Profile: profile, Scales: scales}, nil
+}
+
+// SensitivityFor returns the profile for a user: the stored choice, otherwise the age band, otherwise the default.
+// Without a confirmed parent account, a user in an age band cannot end up with a profile laxer than the band's.
+func (p *Policy) SensitivityFor(user models.UserDetails) Sensitivity {
+	band, inBand := p.AgeSensitivity(user.Age)
+	if user.Sensitivity != "" {
+		sensitivity, err := p.Sensitivity(user.Sensitivity, user.CustomSensitivity)
+		if err == nil && (!inBand || user.HasParent() || sensitivity.AtLeastAsStrictAs(band)) {
+			return sensitivity
+		}
+		// A profile removed from the policy or laxer than the age band falls back like an unset choice
+	}
+	if inBand {
+		return band
+	}
+
+	sensitivity, _ := p.Sensitivity(p.DefaultProfile, nil) // Validate guarantees the profile exists
+	return sensitivity
+}
+
+// AgeSensitivity returns the profile of the first age band containing age, ok is false when none does
+func (p *Policy) AgeSensitivity(age int) (sensitivity Sensitivity, ok bool) {
+	if age <= 0 {
+		return Sensitivity{}, false
+	}
+	for _, band := range p.AgeProfiles {
+		if age <= band.MaxAge {
+			sensitivity, _ = p.Sensitivity(band.Profile, nil) // Validate guarantees the profile exists
+			return sensitivity, true
+		}
+	}
+	return Sensitivity{}, false
+}
+
+// AtLeastAsStrictAs reports whether s flags images at every level no later than other does,
+// that is no level is scaled higher
+func (s Sensitivity) AtLeastAsStrictAs(other Sensitivity) bool {
+	for level := 1; level <= 3; level++ {
+		if s.scale(level) > other.scale(level) {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveSensitivity loads the user's profile document and returns the sensitivity to classify with
+func ResolveSensitivity(ctx context.Context, db *firestore.Client, policy *Policy, uid string) (Sensitivity, error) {
+	userDetails, err := LoadUserDetails(ctx, db, uid)
+	if err != nil {
+		return Sensitivity{}, err
+	}
+	return policy.SensitivityFor(userDetails), nil
+}
+
+// LoadUserDetails reads the users/{uid} profile document, a user without one has an empty profile
+func LoadUserDetails(ctx context.Context, db *firestore.Client, uid string) (models.UserDetails, error) {
+	doc, err := db.Collection("users").Doc(uid).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return models.UserDetails{}, nil
+	}
+	if err != nil {
+		return models.UserDetails{}, fmt.Errorf("load user profile: %w", err)
+	}
+
+	var userDetails models.UserDetails
+	if err := doc.DataTo(&userDetails); err != nil {
+		return models.UserDetails{}, fmt.Errorf("parse user profile: %w", err)
+	}
+	return userDetails, nil
+}
+
+// validateProfiles checks the profiles, the default profile and the age bands
+func (p *Policy) validateProfiles() error {
+	if len(p.Profiles) == 0 {
+		return fmt.Errorf("%w: at least one sensitivity profile is required", ErrInvalidPolicy)
+	}
+	if _, ok := p.Profiles[CustomProfile]; ok {
+		return fmt.Errorf("%w: profile name %q is reserved", ErrInvalidPolicy, CustomProfile)
+	}
+	for name, scales := range p.Profiles {
+		if err := validateScales(scales); err != nil {
+			return fmt.Errorf("%w: profile %s: %v", ErrInvalidPolicy, name, err)
+		}
+	}
+	if _, ok := p.Profiles[p.DefaultProfile]; !ok {
+		return fmt.Errorf("%w: default_profile %q is not declared under profiles", ErrInvalidPolicy, p.DefaultProfile)
+	}
+
+	lastAge := -1
+	for _, band := range p.AgeProfiles {
+		if band.MaxAge <= lastAge {
+			return fmt.Errorf("%w: age_profiles must be sorted by increasing max_age", ErrInvalidPolicy)
+		}
+		lastAge = band.MaxAge
+		if _, ok := p.Profiles[band.Profile]; !ok {
+			return fmt.Errorf("%w: age profile %q is not declared under profiles", ErrInvalidPolicy, band.Profile)
+		}
+	}
+	return nil
+}
+
+// validateScales checks every scale is unset or within (0, maxSensitivityScale]
+func validateScales(scales models.SensitivityScales) error {
+	for _, scale := range []float64{scales.Mild, scales.Moderate, scales.High} {
+		if scale < 0 || scale > maxSensitivityScale {
+			return fmt.Errorf("%w: scales must be between 0 and %.0f", ErrInvalidSensitivity, maxSensitivityScale)
+		}
+	}
+	return nil
+}
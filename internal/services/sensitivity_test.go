@@ -0,0 +1,42 @@
+package services
+
+import (
+	"testing"
+
+	"go-gin-project/internal/models"
+)
+
+func TestSensitivityFor(t *testing.T) {
+	policy := DefaultPolicy()
+
+	tests := []struct {
+		name string
+		user models.UserDetails
+		want string
+	}{
+		{name: "no profile", user: models.UserDetails{}, want: "standard"},
+		{name: "adult choice", user: models.UserDetails{Age: 30, Sensitivity: "relaxed"}, want: "relaxed"},
+		{name: "age band", user: models.UserDetails{Age: 10}, want: "strict"},
+		{name: "child cannot relax", user: models.UserDetails{Age: 10, Sensitivity: "relaxed"}, want: "strict"},
+		{name: "child may tighten", user: models.UserDetails{Age: 10, Sensitivity: "strict"}, want: "strict"},
+		{
+			name: "unconfirmed parent keeps the band",
+			user: models.UserDetails{Age: 10, Sensitivity: "relaxed", ParentUID: "other-account"},
+			want: "strict",
+		},
+		{
+			name: "confirmed parent may relax",
+			user: models.UserDetails{Age: 10, Sensitivity: "relaxed", ParentUID: "parent", ParentConfirmed: true},
+			want: "relaxed",
+		},
+		{name: "unknown profile falls back", user: models.UserDetails{Age: 30, Sensitivity: "lenient"}, want: "standard"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.SensitivityFor(tt.user).Profile; got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+
+	"go-gin-project/internal/models"
+)
+
+// ShadowStatCollection is the Firestore collection holding the active-vs-candidate disagreement counters
+const ShadowStatCollection = "policy_shadow_stats"
+
+// shadowShards spreads the counters of one policy pair over several documents, every
+// detection increments one of them and a single document only takes about one write per second
+const shadowShards = 10
+
+// ClassifyShadows classifies the results with every candidate policy and returns the level per
+// candidate version. The user's sensitivity is applied by profile name; a candidate that does not
+// declare the profile uses its default profile.
+func ClassifyShadows(shadows []*Policy, results []models.DetectionResult, sensitivity Sensitivity, appPolicy *models.AppPolicy) map[string]int {
+	if len(shadows) == 0 {
+		return nil
+	}
+
+	levels := make(map[string]int, len(shadows))
+	for _, shadow := range shadows {
+		shadowSensitivity, err := shadow.Sensitivity(sensitivity.Profile, &sensitivity.Scales)
+		if err != nil {
+			shadowSensitivity = shadow.SensitivityFor(models.UserDetails{})
+		}
+		levels[shadow.Version] = ClassifyNSFW(shadow, results, shadowSensitivity, appPolicy).Level
+	}
+	return levels
+}
+
+// RecordShadowComparisons adds the events' active and shadow levels to the disagreement counters.
+// It runs outside the detection transaction so contention on the shared counters never delays or
+// retries the event log.
+func RecordShadowComparisons(ctx context.Context, db *firestore.Client, events ...models.DetectionEvent) error {
+	// Count per policy pair first so each shard document is written once
+	pairs := make(map[string]*models.ShadowStatDocument)
+	for _, event := range events {
+		for candidate, level := range event.ShadowLevels {
+			key := shadowPairID(event.ClassifierVersion, candidate)
+			pair, ok := pairs[key]
+			if !ok {
+				pair = &models.ShadowStatDocument{
+					ActiveVersion:    event.ClassifierVersion,
+					CandidateVersion: candidate,
+					Matrix:           make(map[string]map[string]int),
+				}
+				pairs[key] = pair
+			}
+			pair.Total++
+			if level == event.Level {
+				pair.Agree++
+			}
+			active, shadow := fmt.Sprint(event.Level), fmt.Sprint(level)
+			if pair.Matrix[active] == nil {
+				pair.Matrix[active] = make(map[string]int)
+			}
+			pair.Matrix[active][shadow]++
+		}
+	}
+
+	for key, pair := range pairs {
+		update := map[string]interface{}{
+			"activeVersion":    pair.ActiveVersion,
+			"candidateVersion": pair.CandidateVersion,
+			"total":            firestore.Increment(pair.Total),
+			"agree":            firestore.Increment(pair.Agree),
+			"matrix":           counterIncrements(pair.Matrix),
+		}
+
+		id := fmt.Sprintf("%s_%d", key, rand.Intn(shadowShards))
+		if _, err := db.Collection(ShadowStatCollection).Doc(id).Set(ctx, update, firestore.MergeAll); err != nil {
+			return fmt.Errorf("record shadow comparison %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// shadowPairID returns the document ID prefix for a policy pair; '/' is not allowed in IDs
+func shadowPairID(activeVersion, candidateVersion string) string {
+	return strings.ReplaceAll(activeVersion+"__"+candidateVersion, "/", "-")
+}
+
+// ShadowMatrix is the disagreement between an active and a candidate policy.
+// Matrix[a][c] counts detections the active policy put at level a and the candidate at level c.
+type ShadowMatrix struct {
+	ActiveVersion    string    `json:"active_version"`
+	CandidateVersion string    `json:"candidate_version"`
+	Total            int       `json:"total"`
+	Agree            int       `json:"agree"`
+	AgreementRate    float64   `json:"agreement_rate"`
+	Stricter         int       `json:"stricter"` // Candidate level above the active level
+	Looser           int       `json:"looser"`   // Candidate level below the active level
+	Matrix           [4][4]int `json:"matrix"`
+}
+
+// ShadowReport sums the disagreement counters per policy pair, optionally for one candidate version
+func ShadowReport(ctx context.Context, db *firestore.Client, candidateVersion string) ([]ShadowMatrix, error) {
+	query := db.Collection(ShadowStatCollection).Query
+	if candidateVersion != "" {
+		query = query.Where("candidateVersion", "==", candidateVersion)
+	}
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+
+	byPair := make(map[string]*ShadowMatrix)
+	for {
+		snap, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list shadow counters: %w", err)
+		}
+
+		var doc models.ShadowStatDocument
+		if err := snap.DataTo(&doc); err != nil {
+			return nil, fmt.Errorf("parse shadow counter %s: %w", snap.Ref.ID, err)
+		}
+
+		key := shadowPairID(doc.ActiveVersion, doc.CandidateVersion)
+		matrix, ok := byPair[key]
+		if !ok {
+			matrix = &ShadowMatrix{ActiveVersion: doc.ActiveVersion, CandidateVersion: doc.CandidateVersion}
+			byPair[key] = matrix
+		}
+		matrix.Total += doc.Total
+		matrix.Agree += doc.Agree
+		for activeKey, row := range doc.Matrix {
+			for candidateKey, n := range row {
+				var active, candidate int
+				if _, err := fmt.Sscan(activeKey, &active); err != nil || !validLevel(active) {
+					continue
+				}
+				if _, err := fmt.Sscan(candidateKey, &candidate); err != nil || !validLevel(candidate) {
+					continue
+				}
+				matrix.Matrix[active][candidate] += n
+				switch {
+				case candidate > active:
+					matrix.Stricter += n
+				case candidate < active:
+					matrix.Looser += n
+				}
+			}
+		}
+	}
+
+	report := make([]ShadowMatrix, 0, len(byPair))
+	for _, matrix := range byPair {
+		if matrix.Total > 0 {
+			matrix.AgreementRate = float64(matrix.Agree) / float64(matrix.Total)
+		}
+		report = append(report, *matrix)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].CandidateVersion != report[j].CandidateVersion {
+			return report[i].CandidateVersion < report[j].CandidateVersion
+		}
+		return report[i].ActiveVersion < report[j].ActiveVersion
+	})
+	return report, nil
+}
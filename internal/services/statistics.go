@@ -0,0 +1,362 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+
+	"go-gin-project/internal/models"
+)
+
+// StatisticCollection is the Firestore collection holding the daily NSFW statistic documents
+const StatisticCollection = "nsfw_stats"
+
+// EventCollection is the Firestore collection holding one document per classified detection
+const EventCollection = "nsfw_events"
+
+// maxEventClasses caps how many classes are kept on an event
+const maxEventClasses = 10
+
+// StatisticDocID returns the ID of a user's daily statistic document in format: uid_YYYY-MM-DD
+func StatisticDocID(uid string, day time.Time) string {
+	return fmt.Sprintf("%s_%04d-%02d-%02d", uid, day.Year(), int(day.Month()), day.Day())
+}
+
+// NewDetectionEvent builds the event for a classified detection; now must be in the user's timezone
+func NewDetectionEvent(uid, application, device string, decision Decision, results []models.DetectionResult, now time.Time) models.DetectionEvent {
+	return models.DetectionEvent{
+		UserID:            uid,
+		Timestamp:         now,
+		Day:               now.Format("2006-01-02"),
+		Timezone:          now.Location().String(),
+		Application:       strings.ToLower(application),
+		Level:             decision.Level,
+		TopClasses:        topClasses(results),
+		Classes:           decision.Classes,
+		ClassifierVersion: decision.PolicyVersion,
+		Rule:              decision.Rule,
+		Profile:           decision.Profile,
+		Device:            device,
+	}
+}
+
+// topClasses returns the highest score per class, best first
+func topClasses(results []models.DetectionResult) []models.ClassScore {
+	best := make(map[string]float64)
+	for _, r := range results {
+		if score, ok := best[r.Class]; !ok || r.Score > score {
+			best[r.Class] = r.Score
+		}
+	}
+
+	classes := make([]models.ClassScore, 0, len(best))
+	for class, score := range best {
+		classes = append(classes, models.ClassScore{Class: class, Score: score})
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		if classes[i].Score != classes[j].Score {
+			return classes[i].Score > classes[j].Score
+		}
+		return classes[i].Class < classes[j].Class
+	})
+
+	if len(classes) > maxEventClasses {
+		classes = classes[:maxEventClasses]
+	}
+	return classes
+}
+
+// maxTransactionWrites is the number of document writes Firestore accepts in one transaction
+const maxTransactionWrites = 500
+
+// RecordDetections appends the events to the log and applies them to the daily rollups. Events are
+// written in transactions of at most maxTransactionWrites documents, each holding the events together
+// with their rollup increments, so the log and the counters never disagree. When a later transaction
+// fails the events of the earlier ones stay recorded. Rollup counters use server-side increments and
+// only count events with a level above 0.
+func RecordDetections(ctx context.Context, db *firestore.Client, events ...models.DetectionEvent) error {
+	for _, chunk := range transactionChunks(events) {
+		if err := recordChunk(ctx, db, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordChunk writes events and their rollup increments in a single transaction
+func recordChunk(ctx context.Context, db *firestore.Client, events []models.DetectionEvent) error {
+	byDoc := rollupGroups(events)
+	return db.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		for _, event := range events {
+			if err := tx.Create(db.Collection(EventCollection).NewDoc(), event); err != nil {
+				return err
+			}
+		}
+		for id, dayEvents := range byDoc {
+			update, err := rollupIncrements(dayEvents)
+			if err != nil {
+				return err
+			}
+			if err := tx.Set(db.Collection(StatisticCollection).Doc(id), update, firestore.MergeAll); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// rollupGroups groups the flagged events by rollup document so each document is written once
+func rollupGroups(events []models.DetectionEvent) map[string][]models.DetectionEvent {
+	byDoc := make(map[string][]models.DetectionEvent)
+	for _, event := range events {
+		if event.Level > 0 {
+			id := rollupDocID(event)
+			byDoc[id] = append(byDoc[id], event)
+		}
+	}
+	return byDoc
+}
+
+// transactionChunks splits events so that each chunk writes at most maxTransactionWrites documents:
+// one per event plus one per distinct rollup document of its flagged events
+func transactionChunks(events []models.DetectionEvent) [][]models.DetectionEvent {
+	var chunks [][]models.DetectionEvent
+	var chunk []models.DetectionEvent
+	rollups := make(map[string]bool)
+	writes := 0
+
+	for _, event := range events {
+		cost := 1
+		id := rollupDocID(event)
+		if event.Level > 0 && !rollups[id] {
+			cost++
+		}
+		if writes+cost > maxTransactionWrites {
+			chunks = append(chunks, chunk)
+			chunk, writes = nil, 0
+			rollups = make(map[string]bool)
+			cost = 1
+			if event.Level > 0 {
+				cost++
+			}
+		}
+
+		chunk = append(chunk, event)
+		writes += cost
+		if event.Level > 0 {
+			rollups[id] = true
+		}
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// rollupDocID returns the daily statistic document an event counts toward, in the StatisticDocID format
+func rollupDocID(event models.DetectionEvent) string {
+	return event.UserID + "_" + event.Day
+}
+
+// levelFields returns the counter names for a level on the document and inside each app counter
+func levelFields(level int) (totalField, appField string, err error) {
+	switch level {
+	case 1:
+		return "totalLow", "low", nil
+	case 2:
+		return "totalMedium", "medium", nil
+	case 3:
+		return "totalHigh", "high", nil
+	}
+	return "", "", fmt.Errorf("unsupported NSFW level %d", level)
+}
+
+// rollupIncrements builds the merge update adding events of one user and day onto their rollup document
+func rollupIncrements(events []models.DetectionEvent) (map[string]interface{}, error) {
+	totals := make(map[string]int)
+	apps := make(map[string]map[string]int)
+	hours := make(map[string]map[string]int)
+
+	for _, event := range events {
+		totalField, appField, err := levelFields(event.Level)
+		if err != nil {
+			return nil, err
+		}
+		totals["grandTotal"]++
+		totals[totalField]++
+
+		if apps[event.Application] == nil {
+			apps[event.Application] = make(map[string]int)
+		}
+		apps[event.Application]["total"]++
+		apps[event.Application][appField]++
+
+		hour := HourKey(event.Timestamp)
+		if hours[hour] == nil {
+			hours[hour] = make(map[string]int)
+		}
+		hours[hour]["total"]++
+		hours[hour][appField]++
+	}
+
+	first := events[0]
+	update := map[string]interface{}{
+		"userId": first.UserID,
+		"day":    first.Day,
+		// Format date as "September 19, 2025" (no time)
+		"date": first.Timestamp.Format("January 2, 2006"),
+	}
+	for field, n := range totals {
+		update[field] = firestore.Increment(n)
+	}
+
+	update["appCounts"] = counterIncrements(apps)
+	update["hourCounts"] = counterIncrements(hours)
+
+	return update, nil
+}
+
+// counterIncrements converts nested counts into nested increment transforms
+func counterIncrements(counts map[string]map[string]int) map[string]interface{} {
+	out := make(map[string]interface{}, len(counts))
+	for key, counters := range counts {
+		fields := make(map[string]interface{}, len(counters))
+		for field, n := range counters {
+			fields[field] = firestore.Increment(n)
+		}
+		out[key] = fields
+	}
+	return out
+}
+
+// HourKey returns the hourCounts key ("00".."23") for t in t's location
+func HourKey(t time.Time) string {
+	return fmt.Sprintf("%02d", t.Hour())
+}
+
+// RebuildRollups recomputes a user's daily statistic documents for the inclusive day range
+// (YYYY-MM-DD) from the event log, overwriting the stored counters. Only days with logged events
+// are rewritten, those without flagged events lose their document; days without any event keep
+// theirs, they may predate the log or have been migrated from legacy documents. Requires a
+// composite index on userId and day.
+func RebuildRollups(ctx context.Context, db *firestore.Client, uid, fromDay, toDay string) (int, error) {
+	start, err := time.Parse("2006-01-02", fromDay)
+	if err != nil {
+		return 0, fmt.Errorf("parse from day: %w", err)
+	}
+	end, err := time.Parse("2006-01-02", toDay)
+	if err != nil {
+		return 0, fmt.Errorf("parse to day: %w", err)
+	}
+
+	rollups := make(map[string]*models.StatisticDocument)
+	logged := make(map[string]bool)
+	iter := db.Collection(EventCollection).
+		Where("userId", "==", uid).
+		Where("day", ">=", fromDay).
+		Where("day", "<=", toDay).
+		Documents(ctx)
+	defer iter.Stop()
+
+	for {
+		snap, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("list events: %w", err)
+		}
+
+		var event models.DetectionEvent
+		if err := snap.DataTo(&event); err != nil {
+			return 0, fmt.Errorf("parse event %s: %w", snap.Ref.ID, err)
+		}
+		logged[event.Day] = true
+		if event.Level <= 0 {
+			continue
+		}
+		if err := addToRollup(rollups, event); err != nil {
+			return 0, fmt.Errorf("event %s: %w", snap.Ref.ID, err)
+		}
+	}
+
+	written := 0
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		key := day.Format("2006-01-02")
+		if !logged[key] {
+			continue
+		}
+		ref := db.Collection(StatisticCollection).Doc(StatisticDocID(uid, day))
+		rollup, ok := rollups[key]
+		if !ok {
+			if _, err := ref.Delete(ctx); err != nil {
+				return written, fmt.Errorf("delete %s: %w", ref.ID, err)
+			}
+			continue
+		}
+		if _, err := ref.Set(ctx, rollup); err != nil {
+			return written, fmt.Errorf("write %s: %w", ref.ID, err)
+		}
+		written++
+	}
+
+	return written, nil
+}
+
+// addToRollup counts a flagged event into the in-memory rollup of its day
+func addToRollup(rollups map[string]*models.StatisticDocument, event models.DetectionEvent) error {
+	rollup, ok := rollups[event.Day]
+	if !ok {
+		rollup = &models.StatisticDocument{
+			UserID:     event.UserID,
+			Day:        event.Day,
+			AppCounts:  make(map[string]models.AppStatCounter),
+			HourCounts: make(map[string]models.AppStatCounter),
+		}
+		rollups[event.Day] = rollup
+	}
+
+	// Date in the same "September 19, 2025" format the live rollups use
+	if day, err := time.Parse("2006-01-02", event.Day); err == nil {
+		rollup.Date = day.Format("January 2, 2006")
+	}
+
+	// Stored timestamps come back in UTC, the hour bucket uses the zone the event was recorded in
+	timestamp := event.Timestamp
+	if loc, err := time.LoadLocation(event.Timezone); err == nil {
+		timestamp = timestamp.In(loc)
+	}
+	hourKey := HourKey(timestamp)
+
+	app := rollup.AppCounts[event.Application]
+	hour := rollup.HourCounts[hourKey]
+	app.Total++
+	hour.Total++
+	rollup.GrandTotal++
+	switch event.Level {
+	case 1:
+		app.Low++
+		hour.Low++
+		rollup.TotalLow++
+	case 2:
+		app.Medium++
+		hour.Medium++
+		rollup.TotalMedium++
+	case 3:
+		app.High++
+		hour.High++
+		rollup.TotalHigh++
+	default:
+		return fmt.Errorf("unsupported NSFW level %d", event.Level)
+	}
+	rollup.AppCounts[event.Application] = app
+	rollup.HourCounts[hourKey] = hour
+
+	return nil
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+
+	"go-gin-project/internal/models"
+)
+
+// testEvent returns an event of uid on day 2025-10-<day> at 10:00 UTC
+func testEvent(uid string, day, level int) models.DetectionEvent {
+	now := time.Date(2025, 10, day, 10, 0, 0, 0, time.UTC)
+	return NewDetectionEvent(uid, "Chat", "", Decision{Level: level}, nil, now)
+}
+
+// repeatEvents returns n events, event(i) giving the i-th
+func repeatEvents(n int, event func(i int) models.DetectionEvent) []models.DetectionEvent {
+	events := make([]models.DetectionEvent, n)
+	for i := range events {
+		events[i] = event(i)
+	}
+	return events
+}
+
+func TestRollupGroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []models.DetectionEvent
+		want   map[string]int // Rollup document -> number of events counted on it
+	}{
+		{
+			name:   "level 0 writes no rollup",
+			events: []models.DetectionEvent{testEvent("u1", 1, 0), testEvent("u1", 2, 0)},
+			want:   map[string]int{},
+		},
+		{
+			name:   "events of one day share the rollup",
+			events: []models.DetectionEvent{testEvent("u1", 1, 1), testEvent("u1", 1, 0), testEvent("u1", 1, 3), testEvent("u1", 1, 3)},
+			want:   map[string]int{"u1_2025-10-01": 3},
+		},
+		{
+			name:   "days and users have their own rollups",
+			events: []models.DetectionEvent{testEvent("u1", 1, 2), testEvent("u1", 2, 2), testEvent("u2", 1, 2)},
+			want:   map[string]int{"u1_2025-10-01": 1, "u1_2025-10-02": 1, "u2_2025-10-01": 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups := rollupGroups(tt.events)
+			got := make(map[string]int, len(groups))
+			for id, events := range groups {
+				got[id] = len(events)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRollupIncrements(t *testing.T) {
+	events := []models.DetectionEvent{testEvent("u1", 1, 1), testEvent("u1", 1, 3), testEvent("u1", 1, 3)}
+	got, err := rollupIncrements(events)
+	if err != nil {
+		t.Fatalf("increments: %v", err)
+	}
+
+	want := map[string]interface{}{
+		"userId":     "u1",
+		"day":        "2025-10-01",
+		"date":       "October 1, 2025",
+		"grandTotal": firestore.Increment(3),
+		"totalLow":   firestore.Increment(1),
+		"totalHigh":  firestore.Increment(2),
+		"appCounts":  map[string]interface{}{"chat": map[string]interface{}{"total": firestore.Increment(3), "low": firestore.Increment(1), "high": firestore.Increment(2)}},
+		"hourCounts": map[string]interface{}{"10": map[string]interface{}{"total": firestore.Increment(3), "low": firestore.Increment(1), "high": firestore.Increment(2)}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v\nwant %v", got, want)
+	}
+
+	if _, err := rollupIncrements([]models.DetectionEvent{testEvent("u1", 1, 4)}); err == nil {
+		t.Error("level 4 was counted")
+	}
+}
+
+func TestTransactionChunks(t *testing.T) {
+	safe := func(int) models.DetectionEvent { return testEvent("u1", 1, 0) }
+	sameDay := func(int) models.DetectionEvent { return testEvent("u1", 1, 2) }
+	ownDay := func(i int) models.DetectionEvent { return testEvent(fmt.Sprintf("u%d", i), 1, 2) }
+
+	tests := []struct {
+		name   string
+		events []models.DetectionEvent
+		want   []int // Events per chunk
+	}{
+		{name: "empty", events: nil, want: nil},
+		{name: "level 0 only", events: repeatEvents(maxTransactionWrites, safe), want: []int{500}},
+		{name: "level 0 past the limit", events: repeatEvents(maxTransactionWrites+1, safe), want: []int{500, 1}},
+		{name: "one rollup fills the chunk", events: repeatEvents(maxTransactionWrites-1, sameDay), want: []int{499}},
+		{name: "one rollup past the limit", events: repeatEvents(maxTransactionWrites, sameDay), want: []int{499, 1}},
+		{name: "rollup per event", events: repeatEvents(maxTransactionWrites/2, ownDay), want: []int{250}},
+		{name: "rollup per event past the limit", events: repeatEvents(maxTransactionWrites/2+1, ownDay), want: []int{250, 1}},
+		{name: "rollup is counted again in the next chunk", events: repeatEvents(2*maxTransactionWrites-1, sameDay), want: []int{499, 499, 1}},
+		{
+			name:   "rollup already in the chunk costs no write",
+			events: append(repeatEvents(maxTransactionWrites/2-1, ownDay), safe(0), ownDay(0)),
+			want:   []int{251},
+		},
+		{
+			name:   "level 0 event crosses the boundary",
+			events: append(repeatEvents(maxTransactionWrites/2-1, ownDay), safe(0), ownDay(0), safe(0)),
+			want:   []int{251, 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := transactionChunks(tt.events)
+
+			var got []int
+			var joined []models.DetectionEvent
+			for _, chunk := range chunks {
+				got = append(got, len(chunk))
+				joined = append(joined, chunk...)
+				if writes := len(chunk) + len(rollupGroups(chunk)); writes > maxTransactionWrites {
+					t.Errorf("chunk of %d events writes %d documents", len(chunk), writes)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got chunks %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(joined, tt.events) {
+				t.Error("chunks lost or reordered events")
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+
+	"go-gin-project/internal/models"
+)
+
+// ErrInvalidTimezone is returned when a timezone is not a known IANA name
+var ErrInvalidTimezone = errors.New("invalid timezone")
+
+// LoadTimezone parses an IANA timezone name such as "Asia/Jakarta"
+func LoadTimezone(name string) (*time.Location, error) {
+	// time.LoadLocation treats "" as UTC and "Local" as the server zone, neither is a user choice
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidTimezone, name)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidTimezone, name)
+	}
+	return loc, nil
+}
+
+// ResolveLocation returns the timezone used for a user's daily buckets: the override when given,
+// otherwise the timezone stored in the user's profile, otherwise the server's local zone
+func ResolveLocation(ctx context.Context, db *firestore.Client, uid, override string) (*time.Location, error) {
+	if override != "" {
+		return LoadTimezone(override)
+	}
+
+	userDetails, err := LoadUserDetails(ctx, db, uid)
+	if err != nil {
+		return nil, err
+	}
+	return UserLocation(userDetails, "")
+}
+
+// UserLocation is ResolveLocation for an already loaded profile
+func UserLocation(userDetails models.UserDetails, override string) (*time.Location, error) {
+	if override != "" {
+		return LoadTimezone(override)
+	}
+	if userDetails.Timezone == "" {
+		return time.Local, nil
+	}
+
+	loc, err := LoadTimezone(userDetails.Timezone)
+	if err != nil {
+		// A bad stored value should not block detections, fall back like an unset profile
+		return time.Local, nil
+	}
+	return loc, nil
+}
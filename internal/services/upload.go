@@ -0,0 +1,194 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/gif"
+)
+
+// Image formats recognised by SniffImageFormat
+const (
+	FormatJPEG = "jpeg"
+	FormatPNG  = "png"
+	FormatGIF  = "gif"
+	FormatWebP = "webp"
+	FormatHEIC = "heic"
+)
+
+var (
+	// ErrEmptyUpload is returned for an upload without content
+	ErrEmptyUpload = errors.New("empty upload")
+	// ErrUploadTooLarge is returned when an upload exceeds UploadLimits.MaxBytes
+	ErrUploadTooLarge = errors.New("upload too large")
+	// ErrUnsupportedImageType is returned when the content is not one of the accepted image formats,
+	// whatever the filename or Content-Type claim
+	ErrUnsupportedImageType = errors.New("unsupported image type")
+	// ErrImageDimensions is returned when the image is wider, taller or has more pixels than allowed
+	ErrImageDimensions = errors.New("image dimensions exceed limits")
+	// ErrCorruptImage is returned when the image header or pixel data fails to decode
+	ErrCorruptImage = errors.New("image cannot be decoded")
+)
+
+// UploadLimits bound what an upload may cost before it reaches the detector
+type UploadLimits struct {
+	MaxBytes  int64 // Size of one uploaded file
+	MaxWidth  int   // Pixels
+	MaxHeight int   // Pixels
+	MaxPixels int64 // Width x height, stops decompression bombs that stay within each side limit
+
+	// Frames x canvas pixels of an animation, bounds the decoding work of SampleFrames
+	MaxAnimationPixels int64
+}
+
+// DefaultUploadLimits returns the limits used when no environment override is set
+func DefaultUploadLimits() UploadLimits {
+	return UploadLimits{MaxBytes: 10 << 20, MaxWidth: 8192, MaxHeight: 8192, MaxPixels: 40_000_000, MaxAnimationPixels: 100_000_000}
+}
+
+// SniffImageFormat returns the image format from the magic bytes at the start of data, or "" when it
+// is not one of the accepted formats
+func SniffImageFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xD8, 0xFF}):
+		return FormatJPEG
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return FormatPNG
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return FormatGIF
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return FormatWebP
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		switch string(data[8:12]) {
+		case "heic", "heix", "hevc", "heim", "heis", "mif1", "msf1":
+			return FormatHEIC
+		}
+	}
+	return ""
+}
+
+// ValidateImage checks an uploaded image against limits: size in bytes, format by content sniffing,
+// dimensions from the header, then a full decode so truncated or corrupt files never reach the
+// detector. The decoded pixels stay with the returned Upload. HEIC has no Go decoder here, its
+// dimensions are read from the ispe property instead.
+func ValidateImage(data []byte, limits UploadLimits) (*Upload, error) {
+	if len(data) == 0 {
+		return nil, ErrEmptyUpload
+	}
+	if int64(len(data)) > limits.MaxBytes {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d allowed", ErrUploadTooLarge, len(data), limits.MaxBytes)
+	}
+	if SniffImageFormat(data) == "" {
+		return nil, ErrUnsupportedImageType
+	}
+
+	// The header is checked before decoding so a bomb is rejected without allocating its pixels
+	upload := NewUpload(data)
+	if upload.headerErr != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptImage, upload.headerErr)
+	}
+	if err := CheckImageDimensions(upload.Size, limits); err != nil {
+		return nil, err
+	}
+	if upload.Format == FormatHEIC {
+		return upload, nil
+	}
+
+	if _, err := upload.Pixels(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorruptImage, err)
+	}
+	return upload, nil
+}
+
+// CheckImageDimensions returns ErrImageDimensions when size exceeds limits, ErrCorruptImage when it is empty
+func CheckImageDimensions(size ImageSize, limits UploadLimits) error {
+	switch {
+	case size.Width <= 0 || size.Height <= 0:
+		return fmt.Errorf("%w: image is %dx%d", ErrCorruptImage, size.Width, size.Height)
+	case size.Width > limits.MaxWidth || size.Height > limits.MaxHeight:
+		return fmt.Errorf("%w: %dx%d, at most %dx%d allowed", ErrImageDimensions, size.Width, size.Height, limits.MaxWidth, limits.MaxHeight)
+	case int64(size.Width)*int64(size.Height) > limits.MaxPixels:
+		return fmt.Errorf("%w: %d pixels, at most %d allowed", ErrImageDimensions, int64(size.Width)*int64(size.Height), limits.MaxPixels)
+	}
+	return nil
+}
+
+// heicSize returns the largest size announced by an ispe (image spatial extents) property. HEIC files
+// carry one per image item, the largest belongs to the primary image rather than a thumbnail.
+func heicSize(data []byte) (ImageSize, bool) {
+	var size ImageSize
+	for rest := data; ; {
+		i := bytes.Index(rest, []byte("ispe"))
+		// Box: size(4) "ispe"(4) version and flags(4) width(4) height(4)
+		if i < 4 || i+16 > len(rest) {
+			break
+		}
+		w := binary.BigEndian.Uint32(rest[i+8:])
+		h := binary.BigEndian.Uint32(rest[i+12:])
+		// The areas are compared as uint64: the product of two uint32 fits there, not in an int
+		if uint64(w)*uint64(h) > uint64(size.Width)*uint64(size.Height) {
+			size = ImageSize{Width: int(w), Height: int(h)}
+		}
+		rest = rest[i+4:]
+	}
+	return size, size.Width > 0 && size.Height > 0
+}
+
+// ValidateMedia checks an upload of the media endpoint and returns it for SampleFrames. Still images
+// are validated like ValidateImage. Animations are not decoded here, that would double the work of
+// SampleFrames: their canvas is checked like a still image and the frame count times the canvas must
+// stay within MaxAnimationPixels. Video frames are only known once ffmpeg extracted them, SampleFrames
+// shrinks them to the image limits.
+func ValidateMedia(data []byte, limits UploadLimits) (*Upload, error) {
+	if len(data) == 0 {
+		return nil, ErrEmptyUpload
+	}
+	if int64(len(data)) > limits.MaxBytes {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d allowed", ErrUploadTooLarge, len(data), limits.MaxBytes)
+	}
+
+	var (
+		canvas ImageSize
+		frames int
+	)
+	switch SniffImageFormat(data) {
+	case "":
+		if MediaKind(data) == MediaVideo {
+			return NewUpload(data), nil
+		}
+		return nil, ErrUnsupportedImageType
+	case FormatGIF:
+		// The GIF decoder rejects frames outside the canvas itself
+		cfg, err := gif.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptImage, err)
+		}
+		if frames, err = gifFrameCount(data); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptImage, err)
+		}
+		if frames <= 1 {
+			return ValidateImage(data, limits)
+		}
+		canvas = ImageSize{Width: cfg.Width, Height: cfg.Height}
+	case FormatWebP:
+		if !isAnimatedWebP(data) {
+			return ValidateImage(data, limits)
+		}
+		width, height, anim, err := parseAnimatedWebP(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCorruptImage, err)
+		}
+		canvas, frames = ImageSize{Width: width, Height: height}, len(anim)
+	default:
+		return ValidateImage(data, limits)
+	}
+
+	if err := CheckImageDimensions(canvas, limits); err != nil {
+		return nil, err
+	}
+	if pixels := int64(frames) * int64(canvas.Width) * int64(canvas.Height); pixels > limits.MaxAnimationPixels {
+		return nil, fmt.Errorf("%w: %d frames of %dx%d, at most %d pixels allowed", ErrImageDimensions, frames, canvas.Width, canvas.Height, limits.MaxAnimationPixels)
+	}
+	return NewUpload(data), nil
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// testImage returns a width x height gradient
+func testImage(width, height int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+func testJPEG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(width, height), nil); err != nil {
+		t.Fatalf("encode jpeg: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(width, height)); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// pngWithHeaderSize rewrites the IHDR chunk of a PNG to announce another size, keeping its CRC valid.
+// The pixel data no longer matches, which is what a decompression bomb header looks like.
+func pngWithHeaderSize(data []byte, width, height uint32) []byte {
+	out := append([]byte(nil), data...)
+	const ihdr = 8 // Chunk length, then "IHDR" and the width and height
+	binary.BigEndian.PutUint32(out[ihdr+8:], width)
+	binary.BigEndian.PutUint32(out[ihdr+12:], height)
+	binary.BigEndian.PutUint32(out[ihdr+8+13:], crc32.ChecksumIEEE(out[ihdr+4:ihdr+8+13]))
+	return out
+}
+
+// testHEIC builds the start of a HEIC file: the ftyp box and one ispe property per size
+func testHEIC(brand string, sizes ...[2]uint32) []byte {
+	data := append([]byte{0, 0, 0, 16}, "ftyp"+brand+"\x00\x00\x00\x00"...)
+	for _, size := range sizes {
+		data = binary.BigEndian.AppendUint32(data, 20)
+		data = append(data, "ispe\x00\x00\x00\x00"...)
+		data = binary.BigEndian.AppendUint32(data, size[0])
+		data = binary.BigEndian.AppendUint32(data, size[1])
+	}
+	return data
+}
+
+func TestSniffImageFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "jpeg", data: testJPEG(t, 4, 4), want: FormatJPEG},
+		{name: "png", data: testPNG(t, 4, 4), want: FormatPNG},
+		{name: "gif", data: testGIF(t, 4, 4, 1), want: FormatGIF},
+		{name: "webp", data: testAnimatedWebP(4, 4), want: FormatWebP},
+		{name: "heic", data: testHEIC("heic"), want: FormatHEIC},
+		{name: "heif still", data: testHEIC("mif1"), want: FormatHEIC},
+		{name: "mp4", data: testHEIC("isom")},
+		{name: "html named photo.jpg", data: []byte("<!DOCTYPE html><script>alert(1)</script>")},
+		{name: "pdf", data: []byte("%PDF-1.7\n")},
+		{name: "svg", data: []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`)},
+		{name: "too short for riff", data: []byte("RIFF")},
+		{name: "empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SniffImageFormat(tt.data); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateImage(t *testing.T) {
+	limits := UploadLimits{MaxBytes: 1 << 20, MaxWidth: 1000, MaxHeight: 1000, MaxPixels: 500_000}
+	jpg := testJPEG(t, 64, 48)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantFormat string
+		wantSize   ImageSize
+		wantErr    error
+	}{
+		{name: "jpeg", data: jpg, wantFormat: FormatJPEG, wantSize: ImageSize{Width: 64, Height: 48}},
+		{name: "png", data: testPNG(t, 30, 20), wantFormat: FormatPNG, wantSize: ImageSize{Width: 30, Height: 20}},
+		{name: "empty", data: nil, wantErr: ErrEmptyUpload},
+		{name: "over max bytes", data: make([]byte, limits.MaxBytes+1), wantErr: ErrUploadTooLarge},
+		{name: "mislabelled text", data: []byte("just some text, not an image"), wantErr: ErrUnsupportedImageType},
+		{name: "png signature with jpeg body", data: append([]byte("\x89PNG\r\n\x1a\n"), jpg[2:]...), wantErr: ErrCorruptImage},
+		{name: "truncated jpeg", data: jpg[:len(jpg)/2], wantErr: ErrCorruptImage},
+		{name: "jpeg header only", data: jpg[:20], wantErr: ErrCorruptImage},
+		{name: "too wide", data: testPNG(t, 1001, 10), wantErr: ErrImageDimensions},
+		{name: "too many pixels", data: testPNG(t, 1000, 501), wantErr: ErrImageDimensions},
+		{
+			name:       "oversized header is rejected before decoding",
+			data:       pngWithHeaderSize(testPNG(t, 8, 8), 60000, 60000),
+			wantFormat: FormatPNG,
+			wantErr:    ErrImageDimensions,
+		},
+		{name: "zero size header", data: pngWithHeaderSize(testPNG(t, 8, 8), 0, 8), wantErr: ErrCorruptImage},
+		{
+			name:       "heic uses the largest ispe",
+			data:       testHEIC("heic", [2]uint32{320, 240}, [2]uint32{800, 600}),
+			wantFormat: FormatHEIC,
+			wantSize:   ImageSize{Width: 800, Height: 600},
+		},
+		{name: "heic primary over the limits", data: testHEIC("heic", [2]uint32{320, 240}, [2]uint32{4032, 3024}), wantErr: ErrImageDimensions},
+		{
+			// The area of this primary overflows an int, it must not lose to the thumbnail
+			name:       "heic area overflowing int",
+			data:       testHEIC("heic", [2]uint32{320, 240}, [2]uint32{0xFFFFFFFF, 0xFFFFFFFF}),
+			wantFormat: FormatHEIC,
+			wantErr:    ErrImageDimensions,
+		},
+		{name: "heic without ispe", data: testHEIC("heic"), wantErr: ErrCorruptImage},
+		{name: "heic with empty ispe", data: testHEIC("heic", [2]uint32{0, 0}), wantErr: ErrCorruptImage},
+		{name: "heic with truncated ispe", data: testHEIC("heic", [2]uint32{320, 240})[:30], wantErr: ErrCorruptImage},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upload, err := ValidateImage(tt.data, limits)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rejected: %v", err)
+			}
+			if upload.Format != tt.wantFormat || upload.Size != tt.wantSize {
+				t.Errorf("got %q %+v, want %q %+v", upload.Format, upload.Size, tt.wantFormat, tt.wantSize)
+			}
+		})
+	}
+}
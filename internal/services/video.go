@@ -0,0 +1,88 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sampleVideo extracts one frame every cfg.FrameInterval with ffmpeg and keeps up to cfg.MaxFrames of
+// them, spread evenly over the clip. The clip is written to a temporary file because MP4 containers
+// often keep their index at the end, which ffmpeg cannot seek to on a pipe. ffmpeg shrinks the frames
+// to fit limits; their headers are checked again before they are decoded.
+func sampleVideo(ctx context.Context, data []byte, cfg FrameConfig, limits UploadLimits) ([]Frame, error) {
+	if cfg.FFmpegPath == "" {
+		return nil, ErrVideoUnsupported
+	}
+
+	dir, err := os.MkdirTemp("", "nsfw-frames-")
+	if err != nil {
+		return nil, fmt.Errorf("create frame directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input")
+	if err := os.WriteFile(input, data, 0o600); err != nil {
+		return nil, fmt.Errorf("write video: %w", err)
+	}
+
+	fps := strconv.FormatFloat(1/cfg.FrameInterval.Seconds(), 'f', -1, 64)
+	cmd := exec.CommandContext(ctx, cfg.FFmpegPath,
+		"-nostdin", "-v", "error",
+		"-t", strconv.FormatFloat(cfg.MaxDuration.Seconds(), 'f', -1, 64),
+		"-i", input,
+		"-vf", "fps="+fps+","+frameScaleFilter(limits),
+		"-q:v", "3",
+		filepath.Join(dir, "frame_%05d.jpg"),
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: ffmpeg: %v: %s", ErrInvalidMedia, err, strings.TrimSpace(string(out)))
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "frame_*.jpg"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("%w: no frames in video", ErrInvalidMedia)
+	}
+	sort.Strings(paths)
+
+	delays := make([]time.Duration, len(paths))
+	for i := range delays {
+		delays[i] = cfg.FrameInterval
+	}
+
+	var frames []Frame
+	for _, i := range sampleIndices(delays, cfg.MaxFrames) {
+		image, err := os.ReadFile(paths[i])
+		if err != nil {
+			return nil, fmt.Errorf("read frame: %w", err)
+		}
+		upload := NewUpload(image)
+		if upload.headerErr != nil {
+			return nil, fmt.Errorf("%w: frame %d: %v", ErrInvalidMedia, i, upload.headerErr)
+		}
+		if err := CheckImageDimensions(upload.Size, limits); err != nil {
+			return nil, fmt.Errorf("frame %d: %w", i, err)
+		}
+		frames = append(frames, Frame{Index: i, Offset: time.Duration(i) * cfg.FrameInterval, Image: upload})
+	}
+	return frames, nil
+}
+
+// frameScaleFilter returns the ffmpeg scale filter shrinking frames, keeping their aspect ratio, until
+// they fit the side and pixel limits. Frames already within them keep their size.
+func frameScaleFilter(limits UploadLimits) string {
+	factor := fmt.Sprintf("min(1,min(%d/iw,min(%d/ih,sqrt(%d/(iw*ih)))))", limits.MaxWidth, limits.MaxHeight, limits.MaxPixels)
+	return fmt.Sprintf("scale=w='max(1,trunc(iw*%s))':h='max(1,trunc(ih*%s))'", factor, factor)
+}
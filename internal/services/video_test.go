@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeFFmpeg writes a shell script standing in for ffmpeg: it records its arguments and writes frame
+// as the only extracted frame, whatever the filters ask for
+func fakeFFmpeg(t *testing.T, frame []byte) (path, argsFile string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake ffmpeg is a shell script")
+	}
+
+	dir := t.TempDir()
+	framePath, argsFile := filepath.Join(dir, "frame.jpg"), filepath.Join(dir, "args")
+	if err := os.WriteFile(framePath, frame, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	script := "#!/bin/sh\n" +
+		"for last; do :; done\n" +
+		"printf '%s\\n' \"$@\" > '" + argsFile + "'\n" +
+		"cp '" + framePath + "' \"$(dirname \"$last\")/frame_00001.jpg\"\n"
+	path = filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(path, []byte(script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return path, argsFile
+}
+
+func TestSampleVideoLimitsFrameSize(t *testing.T) {
+	limits := UploadLimits{MaxBytes: 1 << 20, MaxWidth: 1000, MaxHeight: 1000, MaxPixels: 500_000}
+	video := testHEIC("isom")
+
+	tests := []struct {
+		name    string
+		frame   []byte
+		wantErr error
+	}{
+		{name: "frame within the limits", frame: testJPEG(t, 640, 360)},
+		{name: "frame over the pixel limit", frame: testJPEG(t, 1000, 600), wantErr: ErrImageDimensions},
+		{name: "frame too wide", frame: testJPEG(t, 1200, 10), wantErr: ErrImageDimensions},
+		{name: "frame that is not an image", frame: []byte("not a frame"), wantErr: ErrInvalidMedia},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ffmpeg, argsFile := fakeFFmpeg(t, tt.frame)
+			cfg := DefaultFrameConfig()
+			cfg.FFmpegPath = ffmpeg
+
+			kind, frames, err := SampleFrames(context.Background(), NewUpload(video), cfg, limits)
+			if kind != MediaVideo {
+				t.Fatalf("kind %q", kind)
+			}
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || len(frames) != 1 || frames[0].Image.Size != (ImageSize{Width: 640, Height: 360}) {
+				t.Fatalf("got %d frames, %v", len(frames), err)
+			}
+
+			// ffmpeg is asked to shrink the frames to the limits
+			args, err := os.ReadFile(argsFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "fps=1," + frameScaleFilter(limits); !strings.Contains(string(args), want) {
+				t.Errorf("ffmpeg args %q do not contain %q", args, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Webhook signature headers. The signature is hex HMAC-SHA256 over "<timestamp>.<body>" with the
+// shared secret, so receivers can reject both forged and replayed callbacks.
+const (
+	WebhookSignatureHeader = "X-NSFW-Signature"
+	WebhookTimestampHeader = "X-NSFW-Timestamp"
+)
+
+// ErrInvalidCallbackURL is returned for callback URLs that are not absolute https URLs of a public host
+var ErrInvalidCallbackURL = errors.New("invalid callback url")
+
+// errPrivateAddress is returned when a callback would connect to a non-public address
+var errPrivateAddress = errors.New("callback address is not public")
+
+// nonPublicPrefixes are the special-purpose ranges (RFC 6890 and successors) callbacks may not reach
+// on top of what the netip predicates cover: shared address space, IETF protocol assignments,
+// documentation, benchmarking, reserved and NAT64 prefixes.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// WebhookNotifier posts signed job results to callback URLs. Callbacks only reach public addresses:
+// the host is resolved when the URL is validated and every connection is checked again when it is
+// dialled, so DNS rebinding cannot point a validated host at an internal service. Redirects are
+// not followed and proxies from the environment are not used.
+type WebhookNotifier struct {
+	Secret       []byte
+	Client       *http.Client
+	MaxAttempts  int
+	RetryDelay   time.Duration // Delay before the second attempt, growing linearly with each retry
+	AllowHTTP    bool          // Accept plain http callback URLs, for local development only
+	AllowPrivate bool          // Accept loopback and private addresses, for local development only
+}
+
+// NewWebhookNotifier returns a notifier signing with secret
+func NewWebhookNotifier(secret string) *WebhookNotifier {
+	n := &WebhookNotifier{
+		Secret:      []byte(secret),
+		MaxAttempts: 3,
+		RetryDelay:  time.Second,
+	}
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: n.controlDial}
+	n.Client = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy:               nil, // A proxy would be dialled instead of the callback host
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return n
+}
+
+// ValidateCallbackURL checks that raw is an absolute https URL whose host only resolves to public addresses
+func (n *WebhookNotifier) ValidateCallbackURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		return fmt.Errorf("%w: %q", ErrInvalidCallbackURL, raw)
+	}
+	if u.Scheme != "https" && !(n.AllowHTTP && u.Scheme == "http") {
+		return fmt.Errorf("%w: %q must use https", ErrInvalidCallbackURL, raw)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: %q must not carry credentials", ErrInvalidCallbackURL, raw)
+	}
+	if n.AllowPrivate {
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("%w: cannot resolve %q", ErrInvalidCallbackURL, u.Hostname())
+	}
+	for _, addr := range addrs {
+		if !isPublicAddr(addr) {
+			return fmt.Errorf("%w: %q resolves to non-public address %s", ErrInvalidCallbackURL, u.Hostname(), addr)
+		}
+	}
+	return nil
+}
+
+// controlDial rejects connections to non-public addresses, after DNS resolution and for every redirect or retry
+func (n *WebhookNotifier) controlDial(network, address string, _ syscall.RawConn) error {
+	if n.AllowPrivate {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errPrivateAddress, address)
+	}
+	if !isPublicAddr(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", errPrivateAddress, address)
+	}
+	return nil
+}
+
+// isPublicAddr reports whether addr is a globally routable unicast address
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsValid() || !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sign returns the signature of body sent at timestamp
+func (n *WebhookNotifier) Sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, n.Secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature matches body sent at timestamp, for receivers written in Go.
+// Receivers should also reject timestamps too far from their own clock.
+func (n *WebhookNotifier) Verify(timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(signature), []byte(n.Sign(timestamp, body)))
+}
+
+// Notify posts payload as JSON to callbackURL, retrying failed deliveries with a growing delay
+func (n *WebhookNotifier) Notify(ctx context.Context, callbackURL string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("encode callback: %w", err)
+	}
+
+	var lastErr error
+	for attempt := 1; attempt <= n.MaxAttempts; attempt++ {
+		if lastErr = n.post(ctx, callbackURL, body); lastErr == nil {
+			return nil
+		}
+		if attempt < n.MaxAttempts {
+			if err := sleepContext(ctx, time.Duration(attempt)*n.RetryDelay); err != nil {
+				return err
+			}
+		}
+	}
+	return lastErr
+}
+
+// post sends one signed delivery
+func (n *WebhookNotifier) post(ctx context.Context, callbackURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookTimestampHeader, timestamp)
+	req.Header.Set(WebhookSignatureHeader, n.Sign(timestamp, body))
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned status %d", resp.StatusCode)
+	}
+	return nil
+}
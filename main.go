@@ -8,21 +8,36 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" // Embed the IANA database, serverless runtimes may not ship one
 
 	"cloud.google.com/go/firestore"
-	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/auth"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
-	"google.golang.org/api/option"
 
+	"go-gin-project/internal/firebaseapp"
+	"go-gin-project/internal/handlers/detectnsfw"
 	"go-gin-project/internal/routes"
+	"go-gin-project/internal/services"
 )
 
 var (
 	router          *gin.Engine
 	authClient      *auth.Client
 	firestoreClient *firestore.Client
+	detector        services.Detector
+	detectionCache  *services.CachingDetector
+	policy          *services.Policy
+	shadowPolicies  []*services.Policy
+	batchConfig     detectnsfw.BatchConfig
+	jobRunner       *services.JobRunner
+	mediaConfig     detectnsfw.MediaConfig
+	uploadLimits    services.UploadLimits
+	redactConfig    services.RedactConfig
 )
 
 func init() {
@@ -34,47 +49,337 @@ func init() {
 	// Initialize Firebase
 	authClient, firestoreClient = setupFirebase()
 
+	// Initialize NSFW detector backend
+	detector = setupDetector()
+
+	// Orient, downscale and re-encode uploads before they are forwarded
+	detector = setupNormalizer(detector)
+
+	// Answer repeated uploads from the detection cache
+	detector, detectionCache = setupDetectionCache(detector, firestoreClient)
+
+	// Load and validate the NSFW classification policy
+	policy = setupPolicy()
+
+	// Candidate policies evaluated in the shadow of the active one
+	shadowPolicies = setupShadowPolicies(policy)
+
+	// Limits of the batch detection endpoint
+	batchConfig = setupBatch()
+
+	// Worker pool for asynchronous detections
+	jobRunner = setupJobs()
+
+	// Frame sampling of the animation and video endpoint
+	mediaConfig = setupMedia()
+
+	// Size, format and dimension limits of uploaded images
+	uploadLimits = setupUploadLimits()
+
+	// Regions hidden in redacted previews
+	redactConfig = setupRedact()
+
 	// Initialize Gin router
 	router = gin.Default()
-	routes.SetupRoutes(router, authClient, firestoreClient)
+	routes.SetupRoutes(router, routes.Deps{
+		AuthClient: authClient,
+		DB:         firestoreClient,
+		Detector:   detector,
+		Cache:      detectionCache,
+		Policy:     policy,
+		Shadows:    shadowPolicies,
+		Jobs:       jobRunner,
+		Limits:     uploadLimits,
+		Redact:     redactConfig,
+		Batch:      batchConfig,
+		Media:      mediaConfig,
+	})
 }
 
 // setupFirebase initializes Firebase Admin SDK and returns auth & firestore clients
 func setupFirebase() (*auth.Client, *firestore.Client) {
-	var opt option.ClientOption
-
-	// Try to load from JSON string first (for Vercel deployment)
-	credJSON := os.Getenv("FIREBASE_CREDENTIALS_JSON")
-	if credJSON != "" {
-		opt = option.WithCredentialsJSON([]byte(credJSON))
-	} else {
-		// Fallback to file path (for local development)
-		credPath := os.Getenv("FIREBASE_CREDENTIALS_PATH")
-		if credPath == "" {
-			log.Fatal("Neither FIREBASE_CREDENTIALS_JSON nor FIREBASE_CREDENTIALS_PATH environment variable is set")
+	authClient, firestoreClient, err := firebaseapp.Setup(context.Background())
+	if err != nil {
+		log.Fatalf("Error setting up Firebase: %v\n", err)
+	}
+	return authClient, firestoreClient
+}
+
+// setupDetector builds the NSFW detector client from environment variables
+func setupDetector() services.Detector {
+	// NSFW_DETECTOR_BACKEND=fake runs without the Python service (always reports a clean image)
+	if backend := os.Getenv("NSFW_DETECTOR_BACKEND"); backend == "fake" {
+		log.Println("Warning: using fake NSFW detector backend")
+		return services.NewFakeDetector()
+	} else if backend != "" && backend != "http" {
+		log.Fatalf("Unknown NSFW_DETECTOR_BACKEND %q (expected http or fake)", backend)
+	}
+
+	config := services.DefaultHTTPDetectorConfig()
+
+	if url := os.Getenv("NSFW_DETECTOR_URL"); url != "" {
+		config.URL = url
+	}
+	config.Timeout = durationFromEnv("NSFW_DETECTOR_TIMEOUT", config.Timeout)
+	if field := os.Getenv("NSFW_DETECTOR_FIELD_NAME"); field != "" {
+		config.FieldName = field
+	}
+	config.AuthHeader = os.Getenv("NSFW_DETECTOR_AUTH_HEADER")
+	config.AuthValue = os.Getenv("NSFW_DETECTOR_AUTH_VALUE")
+
+	resilience := services.DefaultResilienceConfig()
+	resilience.AttemptTimeout = durationFromEnv("NSFW_DETECTOR_ATTEMPT_TIMEOUT", resilience.AttemptTimeout)
+	resilience.MaxAttempts = intFromEnv("NSFW_DETECTOR_MAX_ATTEMPTS", resilience.MaxAttempts)
+	resilience.FailureThreshold = intFromEnv("NSFW_DETECTOR_BREAKER_THRESHOLD", resilience.FailureThreshold)
+	resilience.OpenDuration = durationFromEnv("NSFW_DETECTOR_BREAKER_COOLDOWN", resilience.OpenDuration)
+
+	log.Printf("NSFW detector endpoint: %s", config.URL)
+	return services.NewResilientDetector(services.NewHTTPDetector(config), resilience)
+}
+
+// setupNormalizer wraps next so uploads are shrunk to NSFW_NORMALIZE_MAX_EDGE pixels and re-encoded
+// with NSFW_NORMALIZE_JPEG_QUALITY before they are forwarded. A max edge of 0 forwards uploads unchanged.
+func setupNormalizer(next services.Detector) services.Detector {
+	cfg := services.DefaultNormalizeConfig()
+	cfg.MaxEdge = intFromEnv("NSFW_NORMALIZE_MAX_EDGE", cfg.MaxEdge)
+	cfg.JPEGQuality = intFromEnv("NSFW_NORMALIZE_JPEG_QUALITY", cfg.JPEGQuality)
+	if cfg.MaxEdge < 0 || cfg.JPEGQuality < 1 || cfg.JPEGQuality > 100 {
+		log.Fatalf("NSFW_NORMALIZE_MAX_EDGE must not be negative and NSFW_NORMALIZE_JPEG_QUALITY must be between 1 and 100")
+	}
+	if cfg.MaxEdge == 0 {
+		return next
+	}
+
+	log.Printf("NSFW detector uploads normalized to %dpx, JPEG quality %d", cfg.MaxEdge, cfg.JPEGQuality)
+	return services.NewNormalizingDetector(next, cfg)
+}
+
+// maxDetectionCacheDistance bounds near matching: each extra bit shortens the hash segments the memory
+// cache buckets on, so lookups compare more entries
+const maxDetectionCacheDistance = 32
+
+// setupDetectionCache wraps next with the detection cache chosen by NSFW_DETECTION_CACHE: memory
+// (default, per instance), firestore (shared) or off. The returned CachingDetector is nil when off.
+// Only uploads with the same bytes are answered unless NSFW_DETECTION_CACHE_MAX_DISTANCE opts the
+// memory cache in to near matches: an image within that many perceptual hash bits of a cached one gets
+// its detections, so a screenshot that only gained a small explicit thumbnail could inherit a clean verdict.
+func setupDetectionCache(next services.Detector, db *firestore.Client) (services.Detector, *services.CachingDetector) {
+	ttl := durationFromEnv("NSFW_DETECTION_CACHE_TTL", 24*time.Hour)
+	if ttl <= 0 {
+		log.Fatalf("NSFW_DETECTION_CACHE_TTL must be positive")
+	}
+
+	var cache services.DetectionCache
+	backend := os.Getenv("NSFW_DETECTION_CACHE")
+	switch backend {
+	case "off":
+		return next, nil
+	case "", "memory":
+		backend = "memory"
+		maxEntries := intFromEnv("NSFW_DETECTION_CACHE_MAX_ENTRIES", 10000)
+		maxDistance := intFromEnv("NSFW_DETECTION_CACHE_MAX_DISTANCE", 0)
+		if maxEntries < 1 || maxDistance < 0 || maxDistance > maxDetectionCacheDistance {
+			log.Fatalf("NSFW_DETECTION_CACHE_MAX_ENTRIES must be at least 1 and NSFW_DETECTION_CACHE_MAX_DISTANCE between 0 and %d", maxDetectionCacheDistance)
+		}
+		if maxDistance > 0 {
+			log.Printf("Warning: detection cache reuses the results of images within %d hash bits", maxDistance)
 		}
-		opt = option.WithCredentialsFile(credPath)
+		cache = services.NewMemoryDetectionCache(ttl, maxEntries, maxDistance)
+	case "firestore":
+		cache = services.NewFirestoreDetectionCache(db, ttl)
+	default:
+		log.Fatalf("Unknown NSFW_DETECTION_CACHE %q (expected memory, firestore or off)", backend)
 	}
 
-	// Inisialisasi App
-	app, err := firebase.NewApp(context.Background(), nil, opt)
-	if err != nil {
-		log.Fatalf("Error initializing Firebase app: %v\n", err)
+	log.Printf("NSFW detection cache: %s, ttl %s", backend, ttl)
+	caching := services.NewCachingDetector(next, cache, backend)
+	return caching, caching
+}
+
+// setupPolicy loads the classification policy from NSFW_POLICY_PATH, or the built-in one when unset
+func setupPolicy() *services.Policy {
+	path := os.Getenv("NSFW_POLICY_PATH")
+	if path == "" {
+		policy := services.DefaultPolicy()
+		log.Printf("NSFW classification policy: built-in %s", policy.Version)
+		return policy
 	}
 
-	// Inisialisasi Auth Client
-	authClient, err := app.Auth(context.Background())
+	policy, err := services.LoadPolicyFile(path)
 	if err != nil {
-		log.Fatalf("Error getting Firebase Auth client: %v\n", err)
+		log.Fatalf("Error loading NSFW classification policy: %v", err)
+	}
+	log.Printf("NSFW classification policy: %s from %s", policy.Version, path)
+	return policy
+}
+
+// setupShadowPolicies loads the candidate policies listed in NSFW_SHADOW_POLICY_PATHS (comma separated)
+func setupShadowPolicies(active *services.Policy) []*services.Policy {
+	var shadows []*services.Policy
+	versions := map[string]bool{active.Version: true}
+
+	for _, path := range strings.Split(os.Getenv("NSFW_SHADOW_POLICY_PATHS"), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		shadow, err := services.LoadPolicyFile(path)
+		if err != nil {
+			log.Fatalf("Error loading shadow NSFW policy: %v", err)
+		}
+		// Levels are recorded per version, so every policy needs its own
+		if versions[shadow.Version] {
+			log.Fatalf("Shadow NSFW policy %s reuses version %s", path, shadow.Version)
+		}
+		versions[shadow.Version] = true
+
+		log.Printf("NSFW shadow policy: %s from %s", shadow.Version, path)
+		shadows = append(shadows, shadow)
+	}
+	return shadows
+}
+
+// setupBatch reads the batch endpoint limits from NSFW_BATCH_MAX_IMAGES and NSFW_BATCH_CONCURRENCY
+func setupBatch() detectnsfw.BatchConfig {
+	cfg := detectnsfw.DefaultBatchConfig()
+	cfg.MaxImages = intFromEnv("NSFW_BATCH_MAX_IMAGES", cfg.MaxImages)
+	cfg.Concurrency = intFromEnv("NSFW_BATCH_CONCURRENCY", cfg.Concurrency)
+	if cfg.MaxImages < 1 || cfg.Concurrency < 1 {
+		log.Fatalf("NSFW_BATCH_MAX_IMAGES and NSFW_BATCH_CONCURRENCY must be at least 1")
+	}
+	return cfg
+}
+
+// setupJobs starts the async detection worker pool. Callbacks are only accepted when
+// NSFW_JOB_CALLBACK_SECRET is set, every callback is signed with it. Callbacks to loopback or
+// private addresses need NSFW_JOB_CALLBACK_ALLOW_PRIVATE=true, for local development only.
+//
+// Jobs live in process memory and run on background goroutines, which needs a long-lived server.
+// On serverless deployments (VERCEL is set) the goroutines freeze once the response is sent and
+// polls reach other instances, so async mode is disabled there; NSFW_ASYNC_JOBS=false disables it
+// anywhere. Returns nil when disabled.
+func setupJobs() *services.JobRunner {
+	enabled := os.Getenv("NSFW_ASYNC_JOBS") != "false"
+	if os.Getenv("VERCEL") != "" {
+		if os.Getenv("NSFW_ASYNC_JOBS") == "true" {
+			log.Fatalf("NSFW_ASYNC_JOBS needs a long-lived server, it cannot run on a serverless deployment")
+		}
+		enabled = false
+	}
+	if !enabled {
+		log.Println("Async detection jobs are disabled")
+		return nil
+	}
+
+	cfg := services.DefaultJobConfig()
+	cfg.Workers = intFromEnv("NSFW_JOB_WORKERS", cfg.Workers)
+	cfg.QueueSize = intFromEnv("NSFW_JOB_QUEUE_SIZE", cfg.QueueSize)
+	cfg.Timeout = durationFromEnv("NSFW_JOB_TIMEOUT", cfg.Timeout)
+	cfg.CallbackWorkers = intFromEnv("NSFW_JOB_CALLBACK_WORKERS", cfg.CallbackWorkers)
+	cfg.CallbackQueueSize = intFromEnv("NSFW_JOB_CALLBACK_QUEUE_SIZE", cfg.CallbackQueueSize)
+	if cfg.Workers < 1 || cfg.QueueSize < 0 || cfg.CallbackWorkers < 1 || cfg.CallbackQueueSize < 0 {
+		log.Fatalf("NSFW_JOB_WORKERS and NSFW_JOB_CALLBACK_WORKERS must be at least 1, NSFW_JOB_QUEUE_SIZE and NSFW_JOB_CALLBACK_QUEUE_SIZE not negative")
+	}
+
+	var notifier *services.WebhookNotifier
+	if secret := os.Getenv("NSFW_JOB_CALLBACK_SECRET"); secret != "" {
+		notifier = services.NewWebhookNotifier(secret)
+		notifier.AllowHTTP = os.Getenv("NSFW_JOB_CALLBACK_ALLOW_HTTP") == "true"
+		notifier.AllowPrivate = os.Getenv("NSFW_JOB_CALLBACK_ALLOW_PRIVATE") == "true"
+	}
+
+	store := services.NewMemoryJobStore(durationFromEnv("NSFW_JOB_RETENTION", time.Hour))
+	return services.NewJobRunner(cfg, store, notifier)
+}
+
+// setupMedia reads the frame sampling settings. Video needs ffmpeg, taken from NSFW_FFMPEG_PATH or
+// the PATH; without it only animated images are accepted.
+func setupMedia() detectnsfw.MediaConfig {
+	cfg := detectnsfw.DefaultMediaConfig()
+	cfg.Concurrency = intFromEnv("NSFW_MEDIA_CONCURRENCY", cfg.Concurrency)
+	cfg.Frames.MaxFrames = intFromEnv("NSFW_MEDIA_MAX_FRAMES", cfg.Frames.MaxFrames)
+	cfg.Frames.FrameInterval = durationFromEnv("NSFW_MEDIA_FRAME_INTERVAL", cfg.Frames.FrameInterval)
+	cfg.Frames.MaxDuration = durationFromEnv("NSFW_MEDIA_MAX_DURATION", cfg.Frames.MaxDuration)
+	cfg.MaxBytes = int64(intFromEnv("NSFW_MEDIA_MAX_BYTES", int(cfg.MaxBytes)))
+	if cfg.Concurrency < 1 || cfg.Frames.MaxFrames < 1 || cfg.Frames.FrameInterval <= 0 || cfg.Frames.MaxDuration <= 0 || cfg.MaxBytes < 1 {
+		log.Fatalf("NSFW_MEDIA_CONCURRENCY, NSFW_MEDIA_MAX_FRAMES, NSFW_MEDIA_FRAME_INTERVAL, NSFW_MEDIA_MAX_DURATION and NSFW_MEDIA_MAX_BYTES must be positive")
+	}
+
+	cfg.Frames.FFmpegPath = os.Getenv("NSFW_FFMPEG_PATH")
+	if cfg.Frames.FFmpegPath == "" {
+		cfg.Frames.FFmpegPath, _ = exec.LookPath("ffmpeg")
+	}
+	if cfg.Frames.FFmpegPath == "" {
+		log.Println("Warning: ffmpeg not found, video uploads will be rejected")
+	}
+	return cfg
+}
+
+// setupUploadLimits reads the upload limits from NSFW_UPLOAD_MAX_BYTES, NSFW_UPLOAD_MAX_WIDTH,
+// NSFW_UPLOAD_MAX_HEIGHT, NSFW_UPLOAD_MAX_PIXELS and NSFW_UPLOAD_MAX_ANIMATION_PIXELS (frames x canvas)
+func setupUploadLimits() services.UploadLimits {
+	limits := services.DefaultUploadLimits()
+	limits.MaxBytes = int64(intFromEnv("NSFW_UPLOAD_MAX_BYTES", int(limits.MaxBytes)))
+	limits.MaxWidth = intFromEnv("NSFW_UPLOAD_MAX_WIDTH", limits.MaxWidth)
+	limits.MaxHeight = intFromEnv("NSFW_UPLOAD_MAX_HEIGHT", limits.MaxHeight)
+	limits.MaxPixels = int64(intFromEnv("NSFW_UPLOAD_MAX_PIXELS", int(limits.MaxPixels)))
+	limits.MaxAnimationPixels = int64(intFromEnv("NSFW_UPLOAD_MAX_ANIMATION_PIXELS", int(limits.MaxAnimationPixels)))
+	if limits.MaxBytes < 1 || limits.MaxWidth < 1 || limits.MaxHeight < 1 || limits.MaxPixels < 1 || limits.MaxAnimationPixels < 1 {
+		log.Fatalf("NSFW_UPLOAD_MAX_BYTES, NSFW_UPLOAD_MAX_WIDTH, NSFW_UPLOAD_MAX_HEIGHT, NSFW_UPLOAD_MAX_PIXELS and NSFW_UPLOAD_MAX_ANIMATION_PIXELS must be positive")
+	}
+	return limits
+}
+
+// setupRedact reads the redacted preview settings: NSFW_REDACT_MIN_SCORE and NSFW_REDACT_CLASSES
+// (comma separated class names, each must be declared in the active policy)
+func setupRedact() services.RedactConfig {
+	cfg := services.DefaultRedactConfig()
+	if value := os.Getenv("NSFW_REDACT_MIN_SCORE"); value != "" {
+		score, err := strconv.ParseFloat(value, 64)
+		if err != nil || score < 0 || score > 1 {
+			log.Fatalf("Invalid NSFW_REDACT_MIN_SCORE %q: must be between 0 and 1", value)
+		}
+		cfg.MinScore = score
+	}
+	if value := os.Getenv("NSFW_REDACT_CLASSES"); value != "" {
+		cfg.Classes = nil
+		for _, class := range strings.Split(value, ",") {
+			if class = strings.TrimSpace(class); class != "" {
+				cfg.Classes = append(cfg.Classes, class)
+			}
+			if _, ok := policy.Classes[class]; class != "" && !ok {
+				log.Fatalf("NSFW_REDACT_CLASSES: class %s is not declared in policy %s", class, policy.Version)
+			}
+		}
 	}
+	return cfg
+}
 
-	// Inisialisasi Firestore Client
-	firestoreClient, err := app.Firestore(context.Background())
+// durationFromEnv parses a Go duration (e.g. "5s") from key, falling back to def when unset
+func durationFromEnv(key string, def time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
 	if err != nil {
-		log.Fatalf("Error initializing Firestore client: %v", err)
+		log.Fatalf("Invalid %s %q: %v", key, value, err)
 	}
+	return d
+}
 
-	return authClient, firestoreClient
+// intFromEnv parses an integer from key, falling back to def when unset
+func intFromEnv(key string, def int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, value, err)
+	}
+	return n
 }
 
 // getLocalIP returns the local IP address of the machine